@@ -0,0 +1,133 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	apkInstalledPath = "/lib/apk/db/installed"
+)
+
+// apkExtraFields maps the single letter keys of the apk installed database to the names used
+// in the Extra fields of each package
+var apkExtraFields = map[string]string{
+	"o": "origin",
+	"L": "license",
+	"m": "maintainer",
+}
+
+// alpineLister reads the apk installed database, which is a series of blank line separated
+// package records where each line is a single letter key, a colon, and the value
+type alpineLister struct {
+	installedPath string
+	logger        *zap.Logger
+}
+
+// AlpineLister creates a lister for the packages installed by Alpine's apk in the filesystem at root
+func AlpineLister(root string, logger *zap.Logger) SoftwarePackageLister {
+	return &alpineLister{
+		installedPath: rootedPath(root, apkInstalledPath),
+		logger:        logger,
+	}
+}
+
+func (a *alpineLister) PackagingSystem() string {
+	return "apk"
+}
+
+func (a *alpineLister) IsSupported() bool {
+	_, err := os.Stat(a.installedPath)
+	return err == nil
+}
+
+func (a *alpineLister) WatchPaths() []string {
+	return []string{a.installedPath}
+}
+
+func (a *alpineLister) Fingerprint() (string, error) {
+	return fingerprintPaths(a.WatchPaths())
+}
+
+func (a *alpineLister) ListPackages(ctx context.Context) ([]SoftwarePackage, error) {
+	a.logger.Debug("reading apk installed database", zap.String("path", a.installedPath))
+	file, err := os.Open(a.installedPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open apk installed database: %w", err)
+	}
+	defer file.Close()
+
+	return parseApkInstalled(&contextReader{ctx: ctx, reader: file})
+}
+
+func parseApkInstalled(reader io.Reader) ([]SoftwarePackage, error) {
+	var pkgs []SoftwarePackage
+
+	var current *SoftwarePackage
+	flush := func() {
+		if current != nil && current.Name != "" {
+			pkgs = append(pkgs, *current)
+		}
+		current = nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+
+		if line == "" {
+			flush()
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("apk installed database line %d was malformed: %s", lineNumber, line)
+		}
+		if current == nil {
+			current = &SoftwarePackage{Extra: make(map[string]string)}
+		}
+
+		switch key, value := parts[0], parts[1]; key {
+		case "P":
+			current.Name = value
+		case "V":
+			current.Version = value
+		case "A":
+			current.Arch = value
+		default:
+			if name, ok := apkExtraFields[key]; ok {
+				current.Extra[name] = value
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read apk installed database: %w", err)
+	}
+	flush()
+
+	return pkgs, nil
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAlpineLister_ListPackages(t *testing.T) {
+	lister := &alpineLister{
+		installedPath: filepath.Join("testdata", "apk", "installed"),
+		logger:        zap.NewNop(),
+	}
+
+	assert.Equal(t, "apk", lister.PackagingSystem())
+	require.True(t, lister.IsSupported())
+
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	require.Len(t, packages, 3)
+
+	assert.Equal(t, SoftwarePackage{
+		Name:    "musl",
+		Version: "1.2.4-r2",
+		Arch:    "x86_64",
+		Extra: map[string]string{
+			"origin":     "musl",
+			"license":    "MIT",
+			"maintainer": "Timo Teräs <timo.teras@iki.fi>",
+		},
+	}, packages[0])
+	assert.Equal(t, "busybox", packages[1].Name)
+	assert.Equal(t, "alpine-baselayout-data", packages[2].Name)
+	assert.Equal(t, "alpine-baselayout", packages[2].Extra["origin"])
+}
+
+func TestAlpineLister_notSupported(t *testing.T) {
+	lister := &alpineLister{
+		installedPath: filepath.Join("testdata", "not-apk", "installed"),
+		logger:        zap.NewNop(),
+	}
+
+	assert.False(t, lister.IsSupported())
+}
+
+func TestParseApkInstalled_malformed(t *testing.T) {
+	_, err := parseApkInstalled(strings.NewReader("P:musl\nnonsense\n"))
+	assert.EqualError(t, err, "apk installed database line 2 was malformed: nonsense")
+}
@@ -0,0 +1,252 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ReportMode determines if each collection reports the full inventory, the changes since the
+// previous collection, or both
+type ReportMode string
+
+const (
+	ReportFull    ReportMode = "full"
+	ReportChanges ReportMode = "changes"
+	ReportBoth    ReportMode = "both"
+)
+
+// ParseReportMode validates the given mode, where an empty value is ReportFull
+func ParseReportMode(value string) (ReportMode, error) {
+	switch ReportMode(value) {
+	case "", ReportFull:
+		return ReportFull, nil
+	case ReportChanges, ReportBoth:
+		return ReportMode(value), nil
+	default:
+		return "", fmt.Errorf("unknown report mode %q, expected %s, %s, or %s",
+			value, ReportFull, ReportChanges, ReportBoth)
+	}
+}
+
+// UnmarshalText allows for the mode to be validated when decoded from a config file
+func (m *ReportMode) UnmarshalText(text []byte) error {
+	mode, err := ParseReportMode(string(text))
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
+}
+
+type ChangeType string
+
+const (
+	PackageInstalled  ChangeType = "installed"
+	PackageRemoved    ChangeType = "removed"
+	PackageUpgraded   ChangeType = "upgraded"
+	PackageDowngraded ChangeType = "downgraded"
+)
+
+// PackageChange is a difference in a package between two collections, where OldVersion is
+// empty for an installed package and NewVersion is empty for a removed package
+type PackageChange struct {
+	Change     ChangeType `json:"change"`
+	Name       string     `json:"name"`
+	Arch       string     `json:"arch,omitempty"`
+	Location   string     `json:"location,omitempty"`
+	OldVersion string     `json:"old-version,omitempty"`
+	NewVersion string     `json:"new-version,omitempty"`
+}
+
+// packageKey identifies a package independent of its version, where the same package can be
+// installed for multiple architectures or at multiple locations
+type packageKey struct {
+	name     string
+	arch     string
+	location string
+}
+
+// packageInventory is the versions installed of each package, where some packaging systems,
+// such as rpm with kernels, allow for more than one version of the same package
+type packageInventory map[packageKey][]string
+
+func newPackageInventory(packages []SoftwarePackage) packageInventory {
+	inventory := make(packageInventory, len(packages))
+	for _, pkg := range packages {
+		key := packageKey{name: pkg.Name, arch: pkg.Arch, location: pkg.Location}
+		inventory[key] = append(inventory[key], pkg.Version)
+	}
+	for _, versions := range inventory {
+		sort.Strings(versions)
+	}
+	return inventory
+}
+
+// ChangeTracker remembers the most recently reported inventory of each packaging system so
+// that the changes of the next collection can be determined
+type ChangeTracker struct {
+	mu       sync.Mutex
+	previous map[string]packageInventory
+}
+
+func NewChangeTracker() *ChangeTracker {
+	return &ChangeTracker{previous: make(map[string]packageInventory)}
+}
+
+// Update replaces the inventory of the packaging system and returns the changes since the
+// previous inventory. The boolean result is false when there was no previous inventory to
+// compare against.
+func (c *ChangeTracker) Update(system string, packages []SoftwarePackage) ([]PackageChange, bool) {
+	current := newPackageInventory(packages)
+
+	c.mu.Lock()
+	previous, hasPrevious := c.previous[system]
+	c.previous[system] = current
+	c.mu.Unlock()
+
+	if !hasPrevious {
+		return nil, false
+	}
+	return diffInventories(system, previous, current), true
+}
+
+// Seed sets the inventory of the packaging system, such as one restored from a previous run,
+// without determining any changes
+func (c *ChangeTracker) Seed(system string, packages []SoftwarePackage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.previous[system] = newPackageInventory(packages)
+}
+
+// TrackBatch decorates the batch so that the packages reported to it update this tracker
+// and are forwarded according to the mode
+func (c *ChangeTracker) TrackBatch(batch PackagesReporterBatch, mode ReportMode) PackagesReporterBatch {
+	return &changeTrackingBatch{PackagesReporterBatch: batch, tracker: c, mode: mode}
+}
+
+func diffInventories(system string, previous, current packageInventory) []PackageChange {
+	var changes []PackageChange
+
+	for key, newVersions := range current {
+		oldVersions := previous[key]
+		if len(oldVersions) == 1 && len(newVersions) == 1 {
+			oldVersion, newVersion := oldVersions[0], newVersions[0]
+			if oldVersion == newVersion {
+				continue
+			}
+			change := PackageUpgraded
+			if CompareVersions(system, newVersion, oldVersion) < 0 {
+				change = PackageDowngraded
+			}
+			changes = append(changes, newPackageChange(change, key, oldVersion, newVersion))
+			continue
+		}
+
+		for _, version := range subtractVersions(newVersions, oldVersions) {
+			changes = append(changes, newPackageChange(PackageInstalled, key, "", version))
+		}
+		for _, version := range subtractVersions(oldVersions, newVersions) {
+			changes = append(changes, newPackageChange(PackageRemoved, key, version, ""))
+		}
+	}
+
+	for key, oldVersions := range previous {
+		if _, exists := current[key]; exists {
+			continue
+		}
+		for _, version := range oldVersions {
+			changes = append(changes, newPackageChange(PackageRemoved, key, version, ""))
+		}
+	}
+
+	// the map iteration is random, so order the changes consistently
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Arch != b.Arch {
+			return a.Arch < b.Arch
+		}
+		if a.Location != b.Location {
+			return a.Location < b.Location
+		}
+		return a.OldVersion+a.NewVersion < b.OldVersion+b.NewVersion
+	})
+	return changes
+}
+
+func newPackageChange(change ChangeType, key packageKey, oldVersion, newVersion string) PackageChange {
+	return PackageChange{
+		Change:     change,
+		Name:       key.name,
+		Arch:       key.arch,
+		Location:   key.location,
+		OldVersion: oldVersion,
+		NewVersion: newVersion,
+	}
+}
+
+// subtractVersions returns the versions in a that are not in b
+func subtractVersions(a, b []string) []string {
+	var result []string
+	for _, version := range a {
+		found := false
+		for _, other := range b {
+			if version == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, version)
+		}
+	}
+	return result
+}
+
+// changeTrackingBatch forwards the full inventory, the changes, or both to the decorated
+// batch. The full inventory is always forwarded when there is nothing to compare against,
+// such as the first collection, so that the receiver has a baseline for the changes.
+type changeTrackingBatch struct {
+	PackagesReporterBatch
+	tracker *ChangeTracker
+	mode    ReportMode
+}
+
+func (c *changeTrackingBatch) ReportSuccess(system string, packages []SoftwarePackage) {
+	changes, hasBaseline := c.tracker.Update(system, packages)
+
+	if c.mode != ReportChanges || !hasBaseline {
+		c.PackagesReporterBatch.ReportSuccess(system, packages)
+	}
+	if c.mode != ReportFull && hasBaseline {
+		c.PackagesReporterBatch.ReportChanges(system, changes)
+	}
+}
+
+// ReportPartialSuccess leaves the tracked inventory as is, since the changes can't be
+// determined from a partial inventory, and only forwards the packages when the full
+// inventory is reported
+func (c *changeTrackingBatch) ReportPartialSuccess(system string, packages []SoftwarePackage) {
+	if c.mode != ReportChanges {
+		reportPartialSuccess(c.PackagesReporterBatch, system, packages)
+	}
+}
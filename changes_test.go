@@ -0,0 +1,135 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestChangeTracker_Update(t *testing.T) {
+	tracker := NewChangeTracker()
+
+	changes, hasBaseline := tracker.Update("rpm", []SoftwarePackage{
+		{Name: "bash", Version: "4.4.19-10.el8", Arch: "x86_64"},
+		{Name: "dbus", Version: "1:1.12.8-7.el8", Arch: "x86_64"},
+		{Name: "kernel", Version: "4.18.0-80.el8", Arch: "x86_64"},
+		{Name: "openssl", Version: "1:1.1.1c-2.el8", Arch: "x86_64"},
+		{Name: "tzdata", Version: "2019a-1.el8", Arch: "noarch"},
+	})
+	assert.False(t, hasBaseline)
+	assert.Empty(t, changes)
+
+	changes, hasBaseline = tracker.Update("rpm", []SoftwarePackage{
+		{Name: "bash", Version: "4.4.19-10.el8", Arch: "x86_64"},
+		{Name: "curl", Version: "7.61.1-8.el8", Arch: "x86_64"},
+		{Name: "dbus", Version: "1:1.12.8-9.el8", Arch: "x86_64"},
+		// a second kernel is installed alongside the first
+		{Name: "kernel", Version: "4.18.0-80.el8", Arch: "x86_64"},
+		{Name: "kernel", Version: "4.18.0-147.el8", Arch: "x86_64"},
+		{Name: "openssl", Version: "1:1.1.1-1.el8", Arch: "x86_64"},
+	})
+	assert.True(t, hasBaseline)
+	assert.Equal(t, []PackageChange{
+		{Change: PackageInstalled, Name: "curl", Arch: "x86_64", NewVersion: "7.61.1-8.el8"},
+		{Change: PackageUpgraded, Name: "dbus", Arch: "x86_64", OldVersion: "1:1.12.8-7.el8", NewVersion: "1:1.12.8-9.el8"},
+		{Change: PackageInstalled, Name: "kernel", Arch: "x86_64", NewVersion: "4.18.0-147.el8"},
+		{Change: PackageDowngraded, Name: "openssl", Arch: "x86_64", OldVersion: "1:1.1.1c-2.el8", NewVersion: "1:1.1.1-1.el8"},
+		{Change: PackageRemoved, Name: "tzdata", Arch: "noarch", OldVersion: "2019a-1.el8"},
+	}, changes)
+
+	// each system is tracked separately
+	_, hasBaseline = tracker.Update("debian", nil)
+	assert.False(t, hasBaseline)
+}
+
+func TestChangeTracker_TrackBatch(t *testing.T) {
+	first := []SoftwarePackage{{Name: "dpkg", Version: "1.19.7", Arch: "amd64"}}
+	second := []SoftwarePackage{{Name: "dpkg", Version: "1.19.8", Arch: "amd64"}}
+	changes := []PackageChange{
+		{Change: PackageUpgraded, Name: "dpkg", Arch: "amd64", OldVersion: "1.19.7", NewVersion: "1.19.8"},
+	}
+
+	t.Run("changes", func(t *testing.T) {
+		tracker := NewChangeTracker()
+		batch := &mockReporterBatch{}
+		batch.On("ReportSuccess", mock.Anything, mock.Anything)
+		batch.On("ReportChanges", mock.Anything, mock.Anything)
+		batch.On("ReportFailure", mock.Anything, mock.Anything)
+
+		// the full inventory provides the baseline
+		tracker.TrackBatch(batch, ReportChanges).ReportSuccess("debian", first)
+		batch.AssertCalled(t, "ReportSuccess", "debian", first)
+		batch.AssertNotCalled(t, "ReportChanges", mock.Anything, mock.Anything)
+
+		// failures are passed along and leave the baseline as is
+		tracker.TrackBatch(batch, ReportChanges).ReportFailure("debian", errors.New("failed"))
+		batch.AssertNumberOfCalls(t, "ReportFailure", 1)
+
+		tracker.TrackBatch(batch, ReportChanges).ReportSuccess("debian", second)
+		batch.AssertNumberOfCalls(t, "ReportSuccess", 1)
+		batch.AssertCalled(t, "ReportChanges", "debian", changes)
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		tracker := NewChangeTracker()
+		batch := &mockReporterBatch{}
+		batch.On("ReportSuccess", mock.Anything, mock.Anything)
+		batch.On("ReportChanges", mock.Anything, mock.Anything)
+
+		tracker.TrackBatch(batch, ReportBoth).ReportSuccess("debian", first)
+		// the partial inventory is reported, but the baseline is left as is
+		tracker.TrackBatch(batch, ReportBoth).(PartialInventoryReporter).ReportPartialSuccess("debian", nil)
+		batch.AssertCalled(t, "ReportSuccess", "debian", []SoftwarePackage(nil))
+		batch.AssertNotCalled(t, "ReportChanges", mock.Anything, mock.Anything)
+
+		tracker.TrackBatch(batch, ReportBoth).ReportSuccess("debian", second)
+		batch.AssertCalled(t, "ReportChanges", "debian", changes)
+		batch.AssertNumberOfCalls(t, "ReportChanges", 1)
+	})
+
+	t.Run("both", func(t *testing.T) {
+		tracker := NewChangeTracker()
+		batch := &mockReporterBatch{}
+		batch.On("ReportSuccess", mock.Anything, mock.Anything)
+		batch.On("ReportChanges", mock.Anything, mock.Anything)
+
+		tracker.TrackBatch(batch, ReportBoth).ReportSuccess("debian", first)
+		tracker.TrackBatch(batch, ReportBoth).ReportSuccess("debian", second)
+
+		batch.AssertCalled(t, "ReportSuccess", "debian", first)
+		batch.AssertCalled(t, "ReportSuccess", "debian", second)
+		batch.AssertCalled(t, "ReportChanges", "debian", changes)
+		batch.AssertNumberOfCalls(t, "ReportChanges", 1)
+	})
+}
+
+func TestParseReportMode(t *testing.T) {
+	mode, err := ParseReportMode("")
+	require.NoError(t, err)
+	assert.Equal(t, ReportFull, mode)
+
+	mode, err = ParseReportMode("changes")
+	require.NoError(t, err)
+	assert.Equal(t, ReportChanges, mode)
+
+	_, err = ParseReportMode("diff")
+	assert.EqualError(t, err, `unknown report mode "diff", expected full, changes, or both`)
+}
@@ -18,11 +18,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/itzg/go-flagsfiller"
 	"github.com/itzg/zapconfigs"
 	packagesagent "github.com/racker/salus-packages-agent"
 	"go.uber.org/zap"
+	"io"
 	"os"
 	"time"
 )
@@ -35,17 +37,37 @@ var (
 )
 
 var args struct {
-	Debug   bool   `usage:"enables debug logging"`
-	Version bool   `usage:"show version and exit" env:""`
-	Configs string `usage:"directory containing config files that define continuous monitoring"`
-	Include struct {
-		Debian bool `default:"true" usage:"enables debian package listing, when not using configs"`
-		Rpm    bool `default:"true" usage:"enables rpm package listing, when not using configs"`
+	Debug    bool   `usage:"enables debug logging"`
+	Version  bool   `usage:"show version and exit" env:""`
+	Configs  string `usage:"directory containing config files that define continuous monitoring"`
+	StateDir string `usage:"directory where the last collection of each config is persisted across restarts, when using configs"`
+	Root     string `usage:"path of a mounted filesystem, such as a container rootfs or disk image, to list packages from instead of the host, when not using configs"`
+	Image    string `usage:"path of an OCI image layout directory or docker save tarball to list packages from instead of the host, when not using configs"`
+	Include  struct {
+		Debian  bool `default:"true" usage:"enables debian package listing, when not using configs"`
+		Rpm     bool `default:"true" usage:"enables rpm package listing, when not using configs"`
+		Apk     bool `default:"true" usage:"enables apk package listing, when not using configs"`
+		Pacman  bool `default:"true" usage:"enables pacman package listing, when not using configs"`
+		Snap    bool `default:"true" usage:"enables snap package listing, when not using configs"`
+		Flatpak bool `default:"true" usage:"enables flatpak application listing, when not using configs"`
+		Python  bool `usage:"enables python package listing, when not using configs"`
+		Npm     bool `usage:"enables npm package listing, when not using configs"`
+		Gomod   bool `usage:"enables listing of modules in Go executables, when not using configs"`
 	}
+	PythonPaths  []string      `usage:"comma separated search roots for python site-packages, when not using configs"`
+	NpmPaths     []string      `usage:"comma separated search roots for node_modules directories, when not using configs"`
+	GomodPaths   []string      `usage:"comma separated search roots for Go executables, when not using configs"`
+	Timeout      time.Duration `default:"5m" usage:"the time allowed for listing each package system, when not using configs"`
+	OnError      string        `default:"continue" usage:"either continue or abort the collection of the remaining package systems when one fails, when not using configs"`
+	Extended     bool          `usage:"reports the extended package metadata, such as license and vendor, when not using configs, which is implied by the SBOM output formats"`
+	OsTags       bool          `usage:"adds tags identifying the distribution to each measurement, when not using configs"`
+	OsvDatabase  string        `usage:"path of an OSV database export, as a zip file or directory of advisories, that the packages are matched against to report the vulnerable packages, when not using configs"`
 	LineProtocol struct {
 		ToConsole bool   `usage:"indicates that line-protocol lines should be output to stdout"`
 		ToSocket  string `usage:"the [host:port] of a telegraf TCP socket_listener"`
 	}
+	OutputFormat string `usage:"writes each collection as json, a document per collection, ndjson, a record per package, or cyclonedx, cyclonedx-xml, spdx, or spdx-tag-value, an SBOM per collection, rather than line-protocol"`
+	OutputFile   string `usage:"the file that the output format is written to rather than stdout, which is replaced by each document or appended to with ndjson"`
 }
 
 func main() {
@@ -72,7 +94,35 @@ func main() {
 
 	var reporter packagesagent.PackagesReporter
 
-	if args.LineProtocol.ToConsole {
+	if args.OutputFormat != "" {
+		if args.LineProtocol.ToConsole || args.LineProtocol.ToSocket != "" {
+			logger.Fatal("the output format and line-protocol options cannot be used together")
+		}
+		if args.Configs != "" && args.OutputFile != "" && args.OutputFormat != "ndjson" {
+			// each collection would be another document in the same file, which then can't be parsed
+			logger.Fatal("only the ndjson output format can be written to an output file when using configs")
+		}
+		out := os.Stdout
+		if args.OutputFile != "" {
+			// a second document appended to the file would make it unparseable, unlike the
+			// records of ndjson
+			flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			if args.OutputFormat == "ndjson" {
+				flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+			}
+			out, err = os.OpenFile(args.OutputFile, flags, 0644)
+			if err != nil {
+				logger.Fatal("failed to open output file", zap.Error(err))
+			}
+			defer out.Close()
+		}
+		reporter, err = newOutputReporter(args.OutputFormat, out, logger)
+		if err != nil {
+			logger.Fatal("failed to setup output format", zap.Error(err))
+		}
+	} else if args.OutputFile != "" {
+		logger.Fatal("the output file option requires an output format")
+	} else if args.LineProtocol.ToConsole {
 		reporter = packagesagent.NewLineProtocolConsoleReporter(logger)
 	} else if args.LineProtocol.ToSocket != "" {
 		reporter, err = packagesagent.NewLineProtocolSocketReporter(ctx, args.LineProtocol.ToSocket, logger)
@@ -90,29 +140,138 @@ func main() {
 			logger.Fatal("failed to load configs", zap.Error(err))
 		}
 
-		packagesagent.CollectWithConfigs(ctx, configs, reporter, logger)
+		var store *packagesagent.StateStore
+		if args.StateDir != "" {
+			store, err = packagesagent.NewStateStore(args.StateDir)
+			if err != nil {
+				logger.Fatal("failed to setup state store", zap.Error(err))
+			}
+		}
+
+		packagesagent.CollectWithConfigs(ctx, configs, reporter, store, logger)
 
 		// block and allow collector routines to run
 		select {}
 	} else {
-		var listers []packagesagent.SoftwarePackageLister
-		if args.Include.Debian {
-			listers = append(listers, packagesagent.DebianLister(logger))
-		}
-		if args.Include.Rpm {
-			listers = append(listers, packagesagent.RpmLister(logger))
+		err := collectOnce(reporter, logger)
+		if err != nil {
+			logger.Fatal("failed to collect packages", zap.Error(err))
 		}
+	}
+}
+
+// newOutputReporter creates the reporter of the given output format that writes to out
+func newOutputReporter(format string, out io.Writer, logger *zap.Logger) (packagesagent.PackagesReporter, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine hostname: %w", err)
+	}
 
-		batch := reporter.StartBatch(time.Now())
+	switch format {
+	case "json":
+		return packagesagent.NewJsonReporter(out, hostname, logger), nil
+	case "ndjson":
+		return packagesagent.NewNdjsonReporter(out, hostname, logger), nil
+	case "cyclonedx":
+		return packagesagent.NewCycloneDxReporter(out, packagesagent.CycloneDxJson, hostname, version, logger), nil
+	case "cyclonedx-xml":
+		return packagesagent.NewCycloneDxReporter(out, packagesagent.CycloneDxXml, hostname, version, logger), nil
+	case "spdx":
+		return packagesagent.NewSpdxReporter(out, packagesagent.SpdxJson, hostname, version, logger), nil
+	case "spdx-tag-value":
+		return packagesagent.NewSpdxReporter(out, packagesagent.SpdxTagValue, hostname, version, logger), nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q, expected json, ndjson, cyclonedx, cyclonedx-xml, spdx, or spdx-tag-value",
+			format)
+	}
+}
+
+// collectOnce lists the packages of the host, alternate root, or image and reports them as
+// a single batch
+func collectOnce(reporter packagesagent.PackagesReporter, logger *zap.Logger) error {
+	onError, err := packagesagent.ParseErrorPolicy(args.OnError)
+	if err != nil {
+		return err
+	}
+
+	root := args.Root
+	var batchTags map[string]string
+	if args.Image != "" {
+		if args.Root != "" {
+			return errors.New("the root and image options cannot be used together")
+		}
+		image, err := packagesagent.ExtractImage(args.Image, logger)
+		if err != nil {
+			return fmt.Errorf("failed to extract image: %w", err)
+		}
 		defer func() {
-			closeErr := batch.Close()
+			closeErr := image.Close()
 			if closeErr != nil {
-				logger.Error("failed to close reporter batch", zap.Error(err))
+				logger.Error("failed to remove extracted image", zap.Error(closeErr))
 			}
 		}()
-		err := packagesagent.CollectPackages(listers, batch, false)
+		root = image.Root
+		batchTags = image.ReporterTags()
+	} else if root != "" {
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			return fmt.Errorf("root %s is not an accessible directory", root)
+		}
+	}
+
+	var listers []packagesagent.SoftwarePackageLister
+	if args.Include.Debian {
+		listers = append(listers, packagesagent.DebianLister(root, logger))
+	}
+	if args.Include.Rpm {
+		listers = append(listers, packagesagent.RpmLister(root, logger))
+	}
+	if args.Include.Apk {
+		listers = append(listers, packagesagent.AlpineLister(root, logger))
+	}
+	if args.Include.Pacman {
+		listers = append(listers, packagesagent.PacmanLister(root, logger))
+	}
+	if args.Include.Snap {
+		listers = append(listers, packagesagent.SnapLister(root, logger))
+	}
+	if args.Include.Flatpak {
+		listers = append(listers, packagesagent.FlatpakLister(root, logger))
+	}
+	if args.Include.Python {
+		listers = append(listers, packagesagent.PythonLister(root, args.PythonPaths, logger))
+	}
+	if args.Include.Npm {
+		listers = append(listers, packagesagent.NpmLister(root, args.NpmPaths, logger))
+	}
+	if args.Include.Gomod {
+		listers = append(listers, packagesagent.GoBinaryLister(root, args.GomodPaths, logger))
+	}
+
+	var osv *packagesagent.OsvDatabase
+	if args.OsvDatabase != "" {
+		osv, err = packagesagent.LoadOsvDatabase(args.OsvDatabase, logger)
 		if err != nil {
-			logger.Fatal("failed to collect packages", zap.Error(err))
+			return err
 		}
 	}
+
+	osInfo := packagesagent.DetectOsInfo(root, logger)
+	if args.OsTags {
+		batchTags = packagesagent.MergeTags(osInfo.Tags(), batchTags)
+	}
+
+	batch := reporter.StartBatch(time.Now(), batchTags)
+	defer func() {
+		closeErr := batch.Close()
+		if closeErr != nil {
+			logger.Error("failed to close reporter batch", zap.Error(closeErr))
+		}
+	}()
+	return packagesagent.CollectPackages(context.Background(), listers, batch, packagesagent.CollectOptions{
+		OnError:  onError,
+		Timeout:  args.Timeout,
+		Extended: args.Extended,
+		OsInfo:   osInfo,
+		Osv:      osv,
+	})
 }
@@ -18,9 +18,12 @@ package packagesagent
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"io"
+	"sort"
 	"time"
 )
 
@@ -29,43 +32,254 @@ var (
 )
 
 type PackagesReporter interface {
-	StartBatch(timestamp time.Time) PackagesReporterBatch
+	// StartBatch begins the reporting of a collection, where the given tags, if any, identify
+	// the collection in each reported measurement
+	StartBatch(timestamp time.Time, tags map[string]string) PackagesReporterBatch
 }
 
 type PackagesReporterBatch interface {
 	io.Closer
 	ReportSuccess(system string, packages []SoftwarePackage)
+	// ReportChanges reports the differences in the packages since the previous collection
+	ReportChanges(system string, changes []PackageChange)
 	ReportFailure(system string, err error)
+	// ReportCollection reports the outcome of collecting the package system, such as its
+	// listing being skipped or the package manager output having malformed records
+	ReportCollection(system string, summary CollectionSummary)
+	// ReportOsInfo reports the operating system being collected, which precedes the package
+	// systems of the batch
+	ReportOsInfo(info OsInfo)
+	// ReportVulnerabilities reports the packages of the package system that are affected by
+	// the advisories of a vulnerability database, which follows the report of its packages
+	ReportVulnerabilities(system string, vulnerabilities []PackageVulnerability)
 }
 
-func CollectPackages(listers []SoftwarePackageLister, reporterBatch PackagesReporterBatch, reportWhenNotSupported bool) error {
+// CollectionSummary describes the collection of a package system beyond its packages
+type CollectionSummary struct {
+	// Skipped indicates that the listing was skipped since the package database is unchanged
+	Skipped bool
+	// MalformedRecords is the number of records of the package manager output that could not
+	// be parsed and were left out of the reported packages
+	MalformedRecords int
+}
+
+// ExtendedMetadataReporter is implemented by the reporter batches of output formats that are
+// incomplete without the extended metadata of the packages, such as the license and vendor
+// of an SBOM, which is then collected regardless of CollectOptions.Extended
+type ExtendedMetadataReporter interface {
+	RequiresExtended() bool
+}
+
+// PartialInventoryReporter is implemented by the reporter batches that keep the inventory
+// reported to them, such as to track changes or to persist the state, which must not be
+// replaced by the packages of a listing with malformed records since the packages left out
+// would otherwise appear removed
+type PartialInventoryReporter interface {
+	ReportPartialSuccess(system string, packages []SoftwarePackage)
+}
+
+// CollectOptions declares how CollectPackages handles unsupported and failing listers
+type CollectOptions struct {
+	// ReportWhenNotSupported reports a failure for each lister that is not supported
+	ReportWhenNotSupported bool
+	// OnError determines if the remaining listers are collected after one fails
+	OnError ErrorPolicy
+	// Timeout bounds the listing of each package system, where zero is unbounded
+	Timeout time.Duration
+	// Extended includes the extended metadata of the packages, such as license and vendor,
+	// when provided by the listers. It is implied by an ExtendedMetadataReporter.
+	Extended bool
+	// Fingerprints, when not nil, holds the fingerprint of each package system at its last
+	// successful listing. A package system with an unchanged fingerprint is not listed again
+	// and each collected package system is reported with ReportCollection. Otherwise, only
+	// the package systems with malformed records are reported with ReportCollection.
+	Fingerprints map[string]string
+	// OsInfo, when not nil, is reported at the start of the collection and its distribution
+	// namespaces and qualifies the package URLs of operating system packages
+	OsInfo *OsInfo
+	// Osv, when not nil, is the vulnerability database that the packages of each successfully
+	// listed package system are matched against and reported with ReportVulnerabilities
+	Osv *OsvDatabase
+}
+
+// TimeoutError is reported when a package system could not be listed within the timeout
+type TimeoutError struct {
+	System  string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("listing %s packages timed out after %s", e.System, e.Timeout)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// CollectPackages lists the packages of each supported lister and reports them to the batch.
+// With ContinueOnError, the failure of a lister is reported and the remaining listers are
+// still collected, where the returned error aggregates the failure of each. With AbortOnError,
+// the collection stops at the first failure.
+func CollectPackages(ctx context.Context, listers []SoftwarePackageLister, reporterBatch PackagesReporterBatch, options CollectOptions) error {
+	var distro *OsRelease
+	if options.OsInfo != nil {
+		reporterBatch.ReportOsInfo(*options.OsInfo)
+		distro = options.OsInfo.Distro
+	}
+
+	var errs error
 	for _, lister := range listers {
+		if ctx.Err() != nil {
+			return multierr.Append(errs, ctx.Err())
+		}
 		system := lister.PackagingSystem()
 
 		if !lister.IsSupported() {
-			if reportWhenNotSupported {
+			if options.ReportWhenNotSupported {
 				reporterBatch.ReportFailure(system, fmt.Errorf("package system %s is not supported", system))
 			}
 			continue
 		}
 
-		packages, err := lister.ListPackages()
+		var fingerprint string
+		if options.Fingerprints != nil {
+			fingerprint = listerFingerprint(lister)
+			if fingerprint != "" && options.Fingerprints[system] == fingerprint {
+				reporterBatch.ReportCollection(system, CollectionSummary{Skipped: true})
+				continue
+			}
+		}
+
+		packages, err := listPackages(ctx, lister, options.Timeout)
+		var summary CollectionSummary
+		var malformed *MalformedRecordsError
+		if errors.As(err, &malformed) && len(packages) > 0 {
+			// the packages that could be parsed are still reported, along with a warning
+			summary.MalformedRecords = malformed.Count
+			err = nil
+		}
 		if err != nil {
+			if options.Fingerprints != nil {
+				// retry the listing next time even if the database is unchanged
+				delete(options.Fingerprints, system)
+			}
 			reporterBatch.ReportFailure(system, err)
-			return fmt.Errorf("failed to collect %s packages: %w", system, err)
+			err = fmt.Errorf("failed to collect %s packages: %w", system, err)
+			if options.OnError == AbortOnError {
+				return err
+			}
+			errs = multierr.Append(errs, err)
 		} else {
-			reporterBatch.ReportSuccess(system, packages)
+			var vulnerabilities []PackageVulnerability
+			if options.Osv != nil {
+				// matched before the extended metadata is removed since distributions publish
+				// their advisories by source package
+				vulnerabilities = options.Osv.Match(system, packages, distro)
+			}
+			if !options.Extended && !requiresExtended(reporterBatch) {
+				packages = withoutExtended(packages)
+			}
+			packages = withPackageURLs(system, packages, distro)
+			if summary.MalformedRecords > 0 {
+				reportPartialSuccess(reporterBatch, system, packages)
+			} else {
+				reporterBatch.ReportSuccess(system, packages)
+			}
+			if options.Osv != nil {
+				reporterBatch.ReportVulnerabilities(system, vulnerabilities)
+			}
+			if options.Fingerprints != nil {
+				if summary.MalformedRecords > 0 {
+					// retry the listing next time since the malformed records can be transient
+					delete(options.Fingerprints, system)
+				} else if fingerprint != "" {
+					options.Fingerprints[system] = fingerprint
+				}
+			}
+			if options.Fingerprints != nil || summary.MalformedRecords > 0 {
+				reporterBatch.ReportCollection(system, summary)
+			}
 		}
 	}
 
-	return nil
+	return errs
+}
+
+// listPackages bounds the listing by the timeout, if any, and distinguishes the timeout from
+// the other failures of the lister. The listing is abandoned, rather than waited on, when the
+// context is done since a lister can be blocked reading a file, such as from a stuck mount,
+// where the context can't be observed.
+func listPackages(ctx context.Context, lister SoftwarePackageLister, timeout time.Duration) ([]SoftwarePackage, error) {
+	listCtx, cancel := context.WithCancel(ctx)
+	if timeout > 0 {
+		listCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	type listResult struct {
+		packages []SoftwarePackage
+		err      error
+	}
+	// buffered so that an abandoned listing can still complete
+	results := make(chan listResult, 1)
+	go func() {
+		packages, err := lister.ListPackages(listCtx)
+		results <- listResult{packages: packages, err: err}
+	}()
+
+	var result listResult
+	select {
+	case result = <-results:
+	case <-listCtx.Done():
+		result.err = listCtx.Err()
+	}
+	if result.err != nil && ctx.Err() == nil && listCtx.Err() == context.DeadlineExceeded {
+		return nil, &TimeoutError{System: lister.PackagingSystem(), Timeout: timeout}
+	}
+	return result.packages, result.err
+}
+
+// withPackageURLs returns a copy of the packages with the package URL of each populated
+func withPackageURLs(system string, packages []SoftwarePackage, distro *OsRelease) []SoftwarePackage {
+	withPurls := make([]SoftwarePackage, 0, len(packages))
+	for _, pkg := range packages {
+		pkg.Purl = buildPackageURL(system, pkg, distro).String()
+		withPurls = append(withPurls, pkg)
+	}
+	return withPurls
+}
+
+// reportPartialSuccess reports the packages of a listing with malformed records to a
+// PartialInventoryReporter, otherwise they are reported as usual
+func reportPartialSuccess(reporterBatch PackagesReporterBatch, system string, packages []SoftwarePackage) {
+	if reporter, ok := reporterBatch.(PartialInventoryReporter); ok {
+		reporter.ReportPartialSuccess(system, packages)
+	} else {
+		reporterBatch.ReportSuccess(system, packages)
+	}
+}
+
+// requiresExtended determines if the reporter batch is an ExtendedMetadataReporter that
+// requires the extended metadata
+func requiresExtended(reporterBatch PackagesReporterBatch) bool {
+	reporter, ok := reporterBatch.(ExtendedMetadataReporter)
+	return ok && reporter.RequiresExtended()
+}
+
+func withoutExtended(packages []SoftwarePackage) []SoftwarePackage {
+	basic := make([]SoftwarePackage, 0, len(packages))
+	for _, pkg := range packages {
+		basic = append(basic, pkg.withoutExtended())
+	}
+	return basic
 }
 
 // CollectWithConfigs will start a go routine each to periodically collect packages according
-// to each given configuration.
-func CollectWithConfigs(ctx context.Context, configs []*Config, reporter PackagesReporter, logger *zap.Logger) {
+// to each given configuration. When a state store is given, the last collection of each
+// configuration is persisted to it and restored from it at startup.
+func CollectWithConfigs(ctx context.Context, configs []*Config, reporter PackagesReporter, store *StateStore, logger *zap.Logger) {
 	for _, config := range configs {
-		go collectWithConfig(ctx, config, reporter, logger)
+		go collectWithConfig(ctx, config, reporter, store, logger)
 	}
 }
 
@@ -73,23 +287,115 @@ func CollectWithConfigs(ctx context.Context, configs []*Config, reporter Package
 var listersFromConfig = func(config *Config, logger *zap.Logger) []SoftwarePackageLister {
 	var listers []SoftwarePackageLister
 	if config.IncludeDebian {
-		listers = append(listers, DebianLister(logger))
+		listers = append(listers, DebianLister(config.Root, logger))
 	}
 	if config.IncludeRpm {
-		listers = append(listers, RpmLister(logger))
+		listers = append(listers, RpmLister(config.Root, logger))
+	}
+	if config.IncludeApk {
+		listers = append(listers, AlpineLister(config.Root, logger))
+	}
+	if config.IncludePacman {
+		listers = append(listers, PacmanLister(config.Root, logger))
+	}
+	if config.IncludePython {
+		listers = append(listers, PythonLister(config.Root, config.PythonPaths, logger))
+	}
+	if config.IncludeNpm {
+		listers = append(listers, NpmLister(config.Root, config.NpmPaths, logger))
+	}
+	if config.IncludeGomod {
+		listers = append(listers, GoBinaryLister(config.Root, config.GomodPaths, logger))
+	}
+	if config.IncludeSnap {
+		listers = append(listers, SnapLister(config.Root, logger))
+	}
+	if config.IncludeFlatpak {
+		listers = append(listers, FlatpakLister(config.Root, logger))
 	}
 	return listers
 }
 
-func collectWithConfig(ctx context.Context, config *Config, reporter PackagesReporter, logger *zap.Logger) {
-	initialDelayChan := time.After(initialCollectionDelay)
-	ticker := time.NewTicker(time.Duration(config.Interval))
-
+func collectWithConfig(ctx context.Context, config *Config, reporter PackagesReporter, store *StateStore, logger *zap.Logger) {
 	listers := listersFromConfig(config, logger)
+	tracker := NewChangeTracker()
+	var fingerprints map[string]string
+	if config.SkipUnchanged {
+		fingerprints = make(map[string]string)
+	}
+	var osvLoader *osvDatabaseLoader
+	if config.OsvDatabase != "" {
+		osvLoader = &osvDatabaseLoader{path: config.OsvDatabase}
+	}
+	initialDelay := initialCollectionDelay
+
+	var state *CollectionState
+	if store != nil && config.Name != "" {
+		var err error
+		state, err = store.Load(config.Name)
+		if err != nil {
+			logger.Warn("failed to restore collection state", zap.String("config", config.Name), zap.Error(err))
+		}
+		for system, systemState := range state.Systems {
+			tracker.Seed(system, systemState.Packages)
+		}
+
+		// a restart shouldn't cause collections to happen more often than the interval
+		if !state.LastCollection.IsZero() {
+			remaining := time.Until(state.LastCollection.Add(time.Duration(config.Interval)))
+			if remaining > initialDelay {
+				logger.Info("delaying initial collection until the interval has elapsed",
+					zap.String("config", config.Name), zap.Duration("delay", remaining))
+				initialDelay = remaining
+			}
+		}
+	}
 
+	listing := &listingState{}
 	handleTick := func(timestamp time.Time) {
-		batch := reporter.StartBatch(timestamp)
-		err := CollectPackages(listers, batch, config.FailWhenNotSupported)
+		// re-detected each time since the distribution can be upgraded in place
+		osInfo := DetectOsInfo(config.Root, logger)
+		var tags map[string]string
+		if config.OsTags {
+			tags = osInfo.Tags()
+		}
+
+		var osv *OsvDatabase
+		if osvLoader != nil {
+			var reloaded bool
+			osv, reloaded = osvLoader.load(logger)
+			if reloaded && fingerprints != nil {
+				// the unchanged package systems need to be matched against the new advisories
+				for system := range fingerprints {
+					delete(fingerprints, system)
+				}
+			}
+		}
+
+		batch := reporter.StartBatch(timestamp, tags)
+		if config.ReportMode != ReportFull {
+			batch = tracker.TrackBatch(batch, config.ReportMode)
+		}
+		if state != nil {
+			batch = &stateRecordingBatch{
+				PackagesReporterBatch: batch,
+				store:                 store,
+				name:                  config.Name,
+				state:                 state,
+				timestamp:             timestamp,
+			}
+		}
+		listing.set(true)
+		err := CollectPackages(ctx, listers, batch, CollectOptions{
+			ReportWhenNotSupported: config.FailWhenNotSupported,
+			OnError:                config.OnError,
+			Timeout:                time.Duration(config.Timeout),
+			Extended:               config.Extended,
+			Fingerprints:           fingerprints,
+			OsInfo:                 osInfo,
+			Osv:                    osv,
+		})
+		listing.set(false)
 		if err != nil {
 			logger.Error("failed to collect packages", zap.Error(err))
 		}
@@ -99,12 +405,26 @@ func collectWithConfig(ctx context.Context, config *Config, reporter PackagesRep
 		}
 	}
 
+	initialDelayChan := time.After(initialDelay)
+	// the ticker starts with the initial collection, so that the interval is measured from it
+	var tickerChan <-chan time.Time
+	var watchChan <-chan struct{}
+	if config.Watch {
+		watchChan = watchPackageDatabases(ctx, listers, time.Duration(config.WatchDebounce), listing, logger)
+	}
+
 	for {
 		select {
 		case timestamp := <-initialDelayChan:
 			handleTick(timestamp)
-		case timestamp := <-ticker.C:
+			ticker := time.NewTicker(time.Duration(config.Interval))
+			defer ticker.Stop()
+			tickerChan = ticker.C
+		case timestamp := <-tickerChan:
 			handleTick(timestamp)
+		case <-watchChan:
+			logger.Info("collecting after a package database changed", zap.String("config", config.Name))
+			handleTick(time.Now())
 		case <-ctx.Done():
 			return
 		}
@@ -120,9 +440,12 @@ func NewConsoleReporter() PackagesReporter {
 
 type consoleReporterBatch struct{}
 
-func (c *consoleReporter) StartBatch(timestamp time.Time) PackagesReporterBatch {
+func (c *consoleReporter) StartBatch(timestamp time.Time, tags map[string]string) PackagesReporterBatch {
 	fmt.Printf("============================================================\n")
 	fmt.Printf("%s\n", timestamp.Format(time.RFC822))
+	for _, key := range sortedKeys(tags) {
+		fmt.Printf("%s: %s\n", key, tags[key])
+	}
 
 	return &consoleReporterBatch{}
 }
@@ -139,6 +462,51 @@ func (c *consoleReporterBatch) ReportSuccess(system string, packages []SoftwareP
 	}
 }
 
+func (c *consoleReporterBatch) ReportChanges(system string, changes []PackageChange) {
+	fmt.Printf("-- %s changes ------------------------------------------\n", system)
+	for _, change := range changes {
+		fmt.Printf("%-10s %-20s %-25s %-25s %s\n",
+			change.Change, change.Name, change.OldVersion, change.NewVersion, change.Arch)
+	}
+}
+
 func (c *consoleReporterBatch) ReportFailure(system string, err error) {
 	// outer caller will log this
 }
+
+func (c *consoleReporterBatch) ReportCollection(system string, summary CollectionSummary) {
+	if summary.Skipped {
+		fmt.Printf("-- %s unchanged, skipped ---------------------------------\n", system)
+	}
+	if summary.MalformedRecords > 0 {
+		fmt.Printf("-- %s had %d malformed records ---------------------------\n", system, summary.MalformedRecords)
+	}
+}
+
+func (c *consoleReporterBatch) ReportVulnerabilities(system string, vulnerabilities []PackageVulnerability) {
+	if len(vulnerabilities) == 0 {
+		return
+	}
+	fmt.Printf("-- %s vulnerabilities ------------------------------------\n", system)
+	for _, v := range vulnerabilities {
+		fmt.Printf("%-20s %-25s %-20s %-10s %s\n", v.Name, v.Version, v.Id, v.Severity, v.FixedVersion)
+	}
+}
+
+func (c *consoleReporterBatch) ReportOsInfo(info OsInfo) {
+	if info.Distro != nil {
+		fmt.Printf("OS: %s %s\n", info.Distro.ID, info.Distro.VersionID)
+	}
+	if info.KernelRelease != "" {
+		fmt.Printf("Kernel: %s %s\n", info.KernelRelease, info.Arch)
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -22,7 +22,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -41,7 +43,7 @@ func (m *mockPackageLister) PackagingSystem() string {
 	return args.String(0)
 }
 
-func (m *mockPackageLister) ListPackages() ([]SoftwarePackage, error) {
+func (m *mockPackageLister) ListPackages(ctx context.Context) ([]SoftwarePackage, error) {
 	args := m.Called()
 	pkgs := args.Get(0)
 	// slices and especially possibly nil ones are weird to handle in testify's mocking
@@ -56,8 +58,8 @@ type mockReporter struct {
 	mock.Mock
 }
 
-func (m *mockReporter) StartBatch(timestamp time.Time) PackagesReporterBatch {
-	args := m.Called(timestamp)
+func (m *mockReporter) StartBatch(timestamp time.Time, tags map[string]string) PackagesReporterBatch {
+	args := m.Called(timestamp, tags)
 	return args.Get(0).(PackagesReporterBatch)
 }
 
@@ -74,10 +76,26 @@ func (m *mockReporterBatch) ReportSuccess(system string, packages []SoftwarePack
 	m.Called(system, packages)
 }
 
+func (m *mockReporterBatch) ReportChanges(system string, changes []PackageChange) {
+	m.Called(system, changes)
+}
+
 func (m *mockReporterBatch) ReportFailure(system string, err error) {
 	m.Called(system, err)
 }
 
+func (m *mockReporterBatch) ReportCollection(system string, summary CollectionSummary) {
+	m.Called(system, summary)
+}
+
+func (m *mockReporterBatch) ReportOsInfo(info OsInfo) {
+	m.Called(info)
+}
+
+func (m *mockReporterBatch) ReportVulnerabilities(system string, vulnerabilities []PackageVulnerability) {
+	m.Called(system, vulnerabilities)
+}
+
 func TestCollectPackages_success(t *testing.T) {
 	lister1 := &mockPackageLister{}
 	lister1.On("PackagingSystem").Return("mock1")
@@ -98,7 +116,7 @@ func TestCollectPackages_success(t *testing.T) {
 	batch := &mockReporterBatch{}
 	batch.On("ReportSuccess", mock.Anything, mock.Anything)
 
-	err := CollectPackages([]SoftwarePackageLister{lister1, lister2}, batch, false)
+	err := CollectPackages(context.Background(), []SoftwarePackageLister{lister1, lister2}, batch, CollectOptions{})
 	require.NoError(t, err)
 
 	lister1.AssertExpectations(t)
@@ -109,38 +127,159 @@ func TestCollectPackages_success(t *testing.T) {
 }
 
 func TestCollectPackages_handleErrorInOne(t *testing.T) {
+	// lister1 is going to simulate an error during invoking the package manager
 	lister1 := &mockPackageLister{}
 	lister1.On("PackagingSystem").Return("mock1")
 	lister1.On("IsSupported").Return(true)
-	packages1 := []SoftwarePackage{
-		{Name: "dbus", Version: "1:1.12.8-7.el8", Arch: "x86_64"},
-	}
-	lister1.On("ListPackages").Return(packages1, nil)
+	lister1.On("ListPackages").Return(nil,
+		errors.New("something went wrong"))
 
-	// lister2 is going to simulate an error during invoking the package manager
 	lister2 := &mockPackageLister{}
 	lister2.On("PackagingSystem").Return("mock2")
 	lister2.On("IsSupported").Return(true)
-	lister2.On("ListPackages").Return(nil,
-		errors.New("something went wrong"))
+	packages2 := []SoftwarePackage{
+		{Name: "dbus", Version: "1:1.12.8-7.el8", Arch: "x86_64"},
+	}
+	lister2.On("ListPackages").Return(packages2, nil)
 
 	batch := &mockReporterBatch{}
 	batch.On("ReportSuccess", mock.Anything, mock.Anything)
 	batch.On("ReportFailure", mock.Anything, mock.Anything)
 
-	err := CollectPackages([]SoftwarePackageLister{lister1, lister2}, batch, false)
+	err := CollectPackages(context.Background(), []SoftwarePackageLister{lister1, lister2}, batch, CollectOptions{})
 	// this one propagates the error since the package manager was supposed to be supported here
-	assert.Error(t, err)
+	assert.EqualError(t, err, "failed to collect mock1 packages: something went wrong")
 
+	// ...but the failure didn't prevent collecting the next one
 	lister1.AssertExpectations(t)
 	lister2.AssertExpectations(t)
 
-	batch.AssertCalled(t, "ReportSuccess", "mock1", packages1)
-	batch.AssertCalled(t, "ReportFailure", "mock2",
+	batch.AssertCalled(t, "ReportFailure", "mock1",
 		mock.MatchedBy(func(err error) bool {
 			return err.Error() == "something went wrong"
 		}),
 	)
+	batch.AssertCalled(t, "ReportSuccess", "mock2", packages2)
+}
+
+func TestCollectPackages_aggregatesErrors(t *testing.T) {
+	lister1 := &mockPackageLister{}
+	lister1.On("PackagingSystem").Return("mock1")
+	lister1.On("IsSupported").Return(true)
+	lister1.On("ListPackages").Return(nil, errors.New("database is corrupt"))
+
+	lister2 := &mockPackageLister{}
+	lister2.On("PackagingSystem").Return("mock2")
+	lister2.On("IsSupported").Return(true)
+	lister2.On("ListPackages").Return(nil, errors.New("permission denied"))
+
+	batch := &mockReporterBatch{}
+	batch.On("ReportFailure", mock.Anything, mock.Anything)
+
+	err := CollectPackages(context.Background(), []SoftwarePackageLister{lister1, lister2}, batch, CollectOptions{})
+	require.Error(t, err)
+
+	errs := multierr.Errors(err)
+	require.Len(t, errs, 2)
+	assert.EqualError(t, errs[0], "failed to collect mock1 packages: database is corrupt")
+	assert.EqualError(t, errs[1], "failed to collect mock2 packages: permission denied")
+
+	batch.AssertNumberOfCalls(t, "ReportFailure", 2)
+}
+
+func TestCollectPackages_abortOnError(t *testing.T) {
+	lister1 := &mockPackageLister{}
+	lister1.On("PackagingSystem").Return("mock1")
+	lister1.On("IsSupported").Return(true)
+	lister1.On("ListPackages").Return(nil, errors.New("something went wrong"))
+
+	lister2 := &mockPackageLister{}
+	lister2.On("PackagingSystem").Return("mock2")
+
+	batch := &mockReporterBatch{}
+	batch.On("ReportFailure", mock.Anything, mock.Anything)
+
+	err := CollectPackages(context.Background(), []SoftwarePackageLister{lister1, lister2}, batch, CollectOptions{OnError: AbortOnError})
+	assert.EqualError(t, err, "failed to collect mock1 packages: something went wrong")
+
+	lister1.AssertExpectations(t)
+	lister2.AssertNotCalled(t, "IsSupported")
+	lister2.AssertNotCalled(t, "ListPackages")
+	batch.AssertNotCalled(t, "ReportSuccess", mock.Anything, mock.Anything)
+}
+
+// blockingPackageLister simulates a package manager that hangs until it is cancelled
+type blockingPackageLister struct{}
+
+func (b *blockingPackageLister) PackagingSystem() string {
+	return "blocking"
+}
+
+func (b *blockingPackageLister) IsSupported() bool {
+	return true
+}
+
+func (b *blockingPackageLister) ListPackages(ctx context.Context) ([]SoftwarePackage, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCollectPackages_timeout(t *testing.T) {
+	lister2 := &mockPackageLister{}
+	lister2.On("PackagingSystem").Return("mock2")
+	lister2.On("IsSupported").Return(true)
+	packages2 := []SoftwarePackage{
+		{Name: "dpkg", Version: "1.19.7", Arch: "amd64"},
+	}
+	lister2.On("ListPackages").Return(packages2, nil)
+
+	batch := &mockReporterBatch{}
+	batch.On("ReportSuccess", mock.Anything, mock.Anything)
+	batch.On("ReportFailure", mock.Anything, mock.Anything)
+
+	err := CollectPackages(context.Background(), []SoftwarePackageLister{&blockingPackageLister{}, lister2}, batch,
+		CollectOptions{Timeout: 10 * time.Millisecond})
+	assert.EqualError(t, err, "failed to collect blocking packages: listing blocking packages timed out after 10ms")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	batch.AssertCalled(t, "ReportFailure", "blocking",
+		mock.MatchedBy(func(err error) bool {
+			var timeoutErr *TimeoutError
+			return errors.As(err, &timeoutErr) && timeoutErr.System == "blocking"
+		}),
+	)
+	batch.AssertCalled(t, "ReportSuccess", "mock2", packages2)
+}
+
+// stuckPackageLister simulates a listing blocked on a read that can't observe the context,
+// such as of a database on a hung mount
+type stuckPackageLister struct {
+	release chan struct{}
+}
+
+func (s *stuckPackageLister) PackagingSystem() string {
+	return "stuck"
+}
+
+func (s *stuckPackageLister) IsSupported() bool {
+	return true
+}
+
+func (s *stuckPackageLister) ListPackages(ctx context.Context) ([]SoftwarePackage, error) {
+	<-s.release
+	return nil, nil
+}
+
+func TestCollectPackages_timeoutOfStuckLister(t *testing.T) {
+	lister := &stuckPackageLister{release: make(chan struct{})}
+	defer close(lister.release)
+
+	batch := &mockReporterBatch{}
+	batch.On("ReportFailure", mock.Anything, mock.Anything)
+
+	err := CollectPackages(context.Background(), []SoftwarePackageLister{lister}, batch,
+		CollectOptions{Timeout: 10 * time.Millisecond})
+	assert.EqualError(t, err, "failed to collect stuck packages: listing stuck packages timed out after 10ms")
 }
 
 func TestCollectPackages_reportNotSupported(t *testing.T) {
@@ -151,7 +290,7 @@ func TestCollectPackages_reportNotSupported(t *testing.T) {
 	batch := &mockReporterBatch{}
 	batch.On("ReportFailure", mock.Anything, mock.Anything)
 
-	err := CollectPackages([]SoftwarePackageLister{lister}, batch, true)
+	err := CollectPackages(context.Background(), []SoftwarePackageLister{lister}, batch, CollectOptions{ReportWhenNotSupported: true})
 	// outer call itself purposely reports no error, but reporter batch, below, will get it
 	require.NoError(t, err)
 
@@ -165,6 +304,267 @@ func TestCollectPackages_reportNotSupported(t *testing.T) {
 	)
 }
 
+func TestCollectPackages_extended(t *testing.T) {
+	lister := &mockPackageLister{}
+	lister.On("PackagingSystem").Return("mock1")
+	lister.On("IsSupported").Return(true)
+	lister.On("ListPackages").Return([]SoftwarePackage{
+		{Name: "dbus-common", Version: "1:1.12.8-7.el8", Arch: "noarch", Epoch: "1", License: "GPLv2+"},
+	}, nil)
+
+	batch := &mockReporterBatch{}
+	batch.On("ReportSuccess", mock.Anything, mock.Anything)
+
+	require.NoError(t, CollectPackages(context.Background(), []SoftwarePackageLister{lister}, batch, CollectOptions{}))
+	batch.AssertCalled(t, "ReportSuccess", "mock1", []SoftwarePackage{
+		{Name: "dbus-common", Version: "1:1.12.8-7.el8", Arch: "noarch"},
+	})
+
+	require.NoError(t, CollectPackages(context.Background(), []SoftwarePackageLister{lister}, batch, CollectOptions{Extended: true}))
+	batch.AssertCalled(t, "ReportSuccess", "mock1", []SoftwarePackage{
+		{Name: "dbus-common", Version: "1:1.12.8-7.el8", Arch: "noarch", Epoch: "1", License: "GPLv2+"},
+	})
+}
+
+// mockExtendedReporterBatch is a reporter batch, such as an SBOM, that requires the extended metadata
+type mockExtendedReporterBatch struct {
+	mockReporterBatch
+}
+
+func (m *mockExtendedReporterBatch) RequiresExtended() bool {
+	return true
+}
+
+func TestCollectPackages_extendedRequiredByReporter(t *testing.T) {
+	lister := &mockPackageLister{}
+	lister.On("PackagingSystem").Return("mock1")
+	lister.On("IsSupported").Return(true)
+	lister.On("ListPackages").Return([]SoftwarePackage{
+		{Name: "dbus-common", Version: "1:1.12.8-7.el8", Arch: "noarch", Epoch: "1", License: "GPLv2+"},
+	}, nil)
+
+	batch := &mockExtendedReporterBatch{}
+	batch.On("ReportSuccess", mock.Anything, mock.Anything)
+
+	require.NoError(t, CollectPackages(context.Background(), []SoftwarePackageLister{lister}, batch, CollectOptions{}))
+	batch.AssertCalled(t, "ReportSuccess", "mock1", []SoftwarePackage{
+		{Name: "dbus-common", Version: "1:1.12.8-7.el8", Arch: "noarch", Epoch: "1", License: "GPLv2+"},
+	})
+}
+
+func TestCollectPackages_osInfo(t *testing.T) {
+	lister := &mockPackageLister{}
+	lister.On("PackagingSystem").Return("rpm")
+	lister.On("IsSupported").Return(true)
+	lister.On("ListPackages").Return([]SoftwarePackage{
+		{Name: "dbus-common", Version: "1:1.12.8-7.el8", Arch: "noarch"},
+	}, nil)
+
+	batch := &mockReporterBatch{}
+	batch.On("ReportSuccess", mock.Anything, mock.Anything)
+
+	batch.On("ReportOsInfo", mock.Anything)
+
+	osInfo := &OsInfo{Distro: &OsRelease{ID: "rhel", VersionID: "8.1"}, Arch: "x86_64"}
+	require.NoError(t, CollectPackages(context.Background(), []SoftwarePackageLister{lister}, batch, CollectOptions{
+		OsInfo: osInfo,
+	}))
+	batch.AssertCalled(t, "ReportOsInfo", *osInfo)
+	batch.AssertCalled(t, "ReportSuccess", "rpm", []SoftwarePackage{
+		{Name: "dbus-common", Version: "1:1.12.8-7.el8", Arch: "noarch",
+			Purl: "pkg:rpm/rhel/dbus-common@1.12.8-7.el8?arch=noarch&distro=rhel-8.1&epoch=1"},
+	})
+}
+
+func TestCollectPackages_vulnerabilities(t *testing.T) {
+	lister := &mockPackageLister{}
+	lister.On("PackagingSystem").Return("debian")
+	lister.On("IsSupported").Return(true)
+	lister.On("ListPackages").Return([]SoftwarePackage{
+		{Name: "libc6", Version: "2.28-10", Arch: "amd64", SourcePackage: "glibc"},
+		{Name: "tzdata", Version: "2019c-0+deb10u1", Arch: "all", SourcePackage: "tzdata"},
+	}, nil)
+	unmatched := &mockPackageLister{}
+	unmatched.On("PackagingSystem").Return("snap")
+	unmatched.On("IsSupported").Return(true)
+	unmatched.On("ListPackages").Return([]SoftwarePackage{
+		{Name: "core18", Version: "20191126"},
+	}, nil)
+
+	batch := &mockReporterBatch{}
+	batch.On("ReportOsInfo", mock.Anything)
+	batch.On("ReportSuccess", mock.Anything, mock.Anything)
+	batch.On("ReportVulnerabilities", mock.Anything, mock.Anything)
+
+	osv, err := LoadOsvDatabase(filepath.Join("testdata", "osv"), zap.NewNop())
+	require.NoError(t, err)
+	require.NoError(t, CollectPackages(context.Background(), []SoftwarePackageLister{lister, unmatched}, batch, CollectOptions{
+		OsInfo: &OsInfo{Distro: &OsRelease{ID: "debian", VersionID: "10"}},
+		Osv:    osv,
+	}))
+
+	// the source package is used for matching even though extended metadata isn't reported
+	batch.AssertCalled(t, "ReportSuccess", "debian", []SoftwarePackage{
+		{Name: "libc6", Version: "2.28-10", Arch: "amd64",
+			Purl: "pkg:deb/debian/libc6@2.28-10?arch=amd64&distro=debian-10"},
+		{Name: "tzdata", Version: "2019c-0+deb10u1", Arch: "all",
+			Purl: "pkg:deb/debian/tzdata@2019c-0%2Bdeb10u1?arch=all&distro=debian-10"},
+	})
+	batch.AssertCalled(t, "ReportVulnerabilities", "debian", []PackageVulnerability{
+		{Name: "libc6", Version: "2.28-10", Arch: "amd64", Id: "DEBIAN-CVE-2021-3326",
+			Severity: "low", FixedVersion: "2.28-10+deb10u1"},
+	})
+	batch.AssertCalled(t, "ReportVulnerabilities", "snap", []PackageVulnerability(nil))
+}
+
+func TestCollectPackages_malformedRecords(t *testing.T) {
+	packages := []SoftwarePackage{
+		{Name: "tzdata", Version: "2019a-1.el8", Arch: "noarch"},
+	}
+	partial := &mockPackageLister{}
+	partial.On("PackagingSystem").Return("mock1")
+	partial.On("IsSupported").Return(true)
+	partial.On("ListPackages").Return(packages, &MalformedRecordsError{Count: 2, Example: "bash"})
+
+	allMalformed := &mockPackageLister{}
+	allMalformed.On("PackagingSystem").Return("mock2")
+	allMalformed.On("IsSupported").Return(true)
+	allMalformed.On("ListPackages").Return(nil, &MalformedRecordsError{Count: 1, Example: "bash"})
+
+	batch := &mockReporterBatch{}
+	batch.On("ReportSuccess", mock.Anything, mock.Anything)
+	batch.On("ReportCollection", mock.Anything, mock.Anything)
+	batch.On("ReportFailure", mock.Anything, mock.Anything)
+
+	err := CollectPackages(context.Background(), []SoftwarePackageLister{partial, allMalformed}, batch, CollectOptions{})
+	assert.EqualError(t, err,
+		`failed to collect mock2 packages: 1 package manager output records were malformed, such as "bash"`)
+
+	batch.AssertCalled(t, "ReportSuccess", "mock1", packages)
+	batch.AssertCalled(t, "ReportCollection", "mock1", CollectionSummary{MalformedRecords: 2})
+	batch.AssertNotCalled(t, "ReportSuccess", "mock2", mock.Anything)
+	batch.AssertCalled(t, "ReportFailure", "mock2", mock.Anything)
+}
+
+func TestCollectPackages_malformedRecordsKeepInventory(t *testing.T) {
+	complete := []SoftwarePackage{
+		{Name: "bash", Version: "4.4.19-10.el8", Arch: "x86_64"},
+		{Name: "tzdata", Version: "2019a-1.el8", Arch: "noarch"},
+	}
+	lister := &fingerprintingPackageLister{fingerprint: "rpmdb.sqlite:100:1"}
+	lister.On("PackagingSystem").Return("mock1")
+	lister.On("IsSupported").Return(true)
+	lister.On("ListPackages").Return(complete[1:], &MalformedRecordsError{Count: 1, Example: "bash"})
+
+	tracker := NewChangeTracker()
+	tracker.Seed("mock1", complete)
+	state := &CollectionState{Systems: map[string]*SystemState{
+		"mock1": {Packages: complete},
+	}}
+	fingerprints := map[string]string{"mock1": "rpmdb.sqlite:99:1"}
+
+	batch := &mockReporterBatch{}
+	batch.On("ReportCollection", mock.Anything, mock.Anything)
+	err := CollectPackages(context.Background(), []SoftwarePackageLister{lister},
+		&stateRecordingBatch{
+			PackagesReporterBatch: tracker.TrackBatch(batch, ReportChanges),
+			state:                 state,
+		},
+		CollectOptions{Fingerprints: fingerprints})
+	require.NoError(t, err)
+
+	// the package left out is neither reported as removed nor forgotten
+	batch.AssertNotCalled(t, "ReportChanges", mock.Anything, mock.Anything)
+	batch.AssertNotCalled(t, "ReportSuccess", mock.Anything, mock.Anything)
+	batch.AssertCalled(t, "ReportCollection", "mock1", CollectionSummary{MalformedRecords: 1})
+	assert.Equal(t, complete, state.Systems["mock1"].Packages)
+	changes, hasBaseline := tracker.Update("mock1", complete)
+	assert.True(t, hasBaseline)
+	assert.Empty(t, changes)
+	// ...and the listing is retried next time
+	assert.NotContains(t, fingerprints, "mock1")
+}
+
+type fingerprintingPackageLister struct {
+	mockPackageLister
+	fingerprint string
+}
+
+func (f *fingerprintingPackageLister) Fingerprint() (string, error) {
+	return f.fingerprint, nil
+}
+
+func TestCollectPackages_skipUnchanged(t *testing.T) {
+	lister := &fingerprintingPackageLister{fingerprint: "status:100:1"}
+	lister.On("PackagingSystem").Return("mock1")
+	lister.On("IsSupported").Return(true)
+	packages := []SoftwarePackage{
+		{Name: "dpkg", Version: "1.19.7", Arch: "amd64"},
+	}
+	lister.On("ListPackages").Return(packages, nil)
+
+	// a lister that can't be fingerprinted is always listed
+	otherLister := &mockPackageLister{}
+	otherLister.On("PackagingSystem").Return("mock2")
+	otherLister.On("IsSupported").Return(true)
+	otherLister.On("ListPackages").Return(packages, nil)
+
+	listers := []SoftwarePackageLister{lister, otherLister}
+	options := CollectOptions{Fingerprints: make(map[string]string)}
+
+	batch := &mockReporterBatch{}
+	batch.On("ReportSuccess", mock.Anything, mock.Anything)
+	batch.On("ReportCollection", mock.Anything, mock.Anything)
+
+	require.NoError(t, CollectPackages(context.Background(), listers, batch, options))
+	batch.AssertCalled(t, "ReportCollection", "mock1", CollectionSummary{})
+	assert.Equal(t, map[string]string{"mock1": "status:100:1"}, options.Fingerprints)
+
+	batch = &mockReporterBatch{}
+	batch.On("ReportSuccess", mock.Anything, mock.Anything)
+	batch.On("ReportCollection", mock.Anything, mock.Anything)
+
+	require.NoError(t, CollectPackages(context.Background(), listers, batch, options))
+	batch.AssertCalled(t, "ReportCollection", "mock1", CollectionSummary{Skipped: true})
+	batch.AssertNotCalled(t, "ReportSuccess", "mock1", mock.Anything)
+	batch.AssertCalled(t, "ReportSuccess", "mock2", packages)
+	batch.AssertCalled(t, "ReportCollection", "mock2", CollectionSummary{})
+	lister.AssertNumberOfCalls(t, "ListPackages", 1)
+	otherLister.AssertNumberOfCalls(t, "ListPackages", 2)
+
+	lister.fingerprint = "status:120:2"
+	batch = &mockReporterBatch{}
+	batch.On("ReportSuccess", mock.Anything, mock.Anything)
+	batch.On("ReportCollection", mock.Anything, mock.Anything)
+
+	require.NoError(t, CollectPackages(context.Background(), listers, batch, options))
+	batch.AssertCalled(t, "ReportSuccess", "mock1", packages)
+	batch.AssertCalled(t, "ReportCollection", "mock1", CollectionSummary{})
+	lister.AssertNumberOfCalls(t, "ListPackages", 2)
+}
+
+func TestCollectPackages_skipUnchangedRetriesFailure(t *testing.T) {
+	lister := &fingerprintingPackageLister{fingerprint: "status:100:1"}
+	lister.On("PackagingSystem").Return("mock1")
+	lister.On("IsSupported").Return(true)
+	lister.On("ListPackages").Return(nil, errors.New("locked"))
+
+	// the fingerprint of an earlier, successful listing
+	options := CollectOptions{Fingerprints: map[string]string{"mock1": "status:100:0"}}
+
+	batch := &mockReporterBatch{}
+	batch.On("ReportFailure", mock.Anything, mock.Anything)
+
+	err := CollectPackages(context.Background(), []SoftwarePackageLister{lister}, batch, options)
+	require.Error(t, err)
+	assert.Empty(t, options.Fingerprints)
+
+	err = CollectPackages(context.Background(), []SoftwarePackageLister{lister}, batch, options)
+	require.Error(t, err)
+	lister.AssertNumberOfCalls(t, "ListPackages", 2)
+	batch.AssertNotCalled(t, "ReportCollection", mock.Anything, mock.Anything)
+}
+
 func TestCollectWithConfigs(t *testing.T) {
 	lister := &mockPackageLister{}
 	lister.On("PackagingSystem").Return("mock1")
@@ -183,10 +583,11 @@ func TestCollectWithConfigs(t *testing.T) {
 	batch.On("ReportSuccess", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
 		batchArgs <- args
 	})
+	batch.On("ReportOsInfo", mock.Anything)
 	batch.On("Close").Return(nil)
 
 	reporter := &mockReporter{}
-	reporter.On("StartBatch", mock.Anything).Return(batch)
+	reporter.On("StartBatch", mock.Anything, mock.Anything).Return(batch)
 
 	processedConfigs := make(chan *Config, 1)
 	// swap out package level helper
@@ -200,7 +601,7 @@ func TestCollectWithConfigs(t *testing.T) {
 	config := &Config{Interval: Interval(
 		// ...and configured interval suitably long where the unit tests cancels the context long before it fires
 		1 * time.Hour)}
-	CollectWithConfigs(ctx, []*Config{config}, reporter, zap.NewNop())
+	CollectWithConfigs(ctx, []*Config{config}, reporter, nil, zap.NewNop())
 
 	select {
 	case actualConfig := <-processedConfigs:
@@ -221,3 +622,62 @@ func TestCollectWithConfigs(t *testing.T) {
 
 	mock.AssertExpectationsForObjects(t, lister, batch, reporter)
 }
+
+func TestCollectWithConfigs_osInfo(t *testing.T) {
+	lister := &mockPackageLister{}
+	lister.On("PackagingSystem").Return("apk")
+	lister.On("IsSupported").Return(true)
+	lister.On("ListPackages").Return([]SoftwarePackage{
+		{Name: "musl", Version: "1.1.24-r0", Arch: "x86_64"},
+	}, nil)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	reported := make(chan mock.Arguments, 1)
+
+	batch := &mockReporterBatch{}
+	batch.On("ReportOsInfo", mock.Anything)
+	batch.On("ReportSuccess", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		reported <- args
+	})
+	batch.On("Close").Return(nil)
+
+	reporter := &mockReporter{}
+	reporter.On("StartBatch", mock.Anything, mock.Anything).Return(batch)
+
+	listersFromConfig = func(config *Config, logger *zap.Logger) []SoftwarePackageLister {
+		return []SoftwarePackageLister{lister}
+	}
+	initialCollectionDelay = 1 * time.Millisecond
+	config := &Config{
+		Interval:   Interval(1 * time.Hour),
+		Root:       newOsInfoRoot(t, "b08dfa6083e7567a1921a715000001fb"),
+		ReportMode: ReportFull,
+		OsTags:     true,
+	}
+	CollectWithConfigs(ctx, []*Config{config}, reporter, nil, zap.NewNop())
+
+	select {
+	case args := <-reported:
+		// the distribution also qualifies the package URLs
+		assert.Equal(t, []SoftwarePackage{
+			{Name: "musl", Version: "1.1.24-r0", Arch: "x86_64",
+				Purl: "pkg:apk/ubuntu/musl@1.1.24-r0?arch=x86_64&distro=ubuntu-18.04"},
+		}, args.Get(1))
+	case <-time.After(1 * time.Second):
+		t.Fail()
+		return
+	}
+
+	reporter.AssertCalled(t, "StartBatch", mock.Anything, map[string]string{"os_id": "ubuntu", "os_version": "18.04"})
+	batch.AssertCalled(t, "ReportOsInfo", OsInfo{
+		Distro: &OsRelease{
+			ID:              "ubuntu",
+			VersionID:       "18.04",
+			VersionCodename: "bionic",
+			PrettyName:      "Ubuntu 18.04.3 LTS",
+		},
+		MachineId: "b08dfa6083e7567a1921a715000001fb",
+	})
+}
@@ -28,8 +28,45 @@ import (
 
 const (
 	DefaultInterval = Interval(1 * time.Hour)
+	DefaultTimeout  = Interval(5 * time.Minute)
+	// DefaultWatchDebounce is how long the package databases must be unchanged before a
+	// watched change triggers a collection
+	DefaultWatchDebounce = Interval(5 * time.Second)
 )
 
+// ErrorPolicy determines if the collection of the remaining package systems continues after
+// one fails
+type ErrorPolicy string
+
+const (
+	// ContinueOnError collects all of the package systems and aggregates their failures
+	ContinueOnError ErrorPolicy = "continue"
+	// AbortOnError stops the collection at the first package system that fails
+	AbortOnError ErrorPolicy = "abort"
+)
+
+// ParseErrorPolicy validates the given policy, where an empty value is ContinueOnError
+func ParseErrorPolicy(value string) (ErrorPolicy, error) {
+	switch ErrorPolicy(value) {
+	case "", ContinueOnError:
+		return ContinueOnError, nil
+	case AbortOnError:
+		return AbortOnError, nil
+	default:
+		return "", fmt.Errorf("unknown error policy %q, expected %s or %s", value, ContinueOnError, AbortOnError)
+	}
+}
+
+// UnmarshalText allows for the policy to be validated when decoded from a config file
+func (p *ErrorPolicy) UnmarshalText(text []byte) error {
+	policy, err := ParseErrorPolicy(string(text))
+	if err != nil {
+		return err
+	}
+	*p = policy
+	return nil
+}
+
 // Go doesn't have builtin JSON unmarshalling of time.Duration, so declare our own type and unmarshaller
 type Interval time.Duration
 
@@ -49,10 +86,38 @@ func (i *Interval) UnmarshalJSON(b []byte) error {
 }
 
 type Config struct {
-	Interval             Interval `json:"interval"`
-	IncludeRpm           bool     `json:"include-rpm"`
-	IncludeDebian        bool     `json:"include-debian"`
-	FailWhenNotSupported bool     `json:"fail-when-not-supported"`
+	// Name identifies the config by its file name, without the extension
+	Name                 string      `json:"-"`
+	Interval             Interval    `json:"interval"`
+	Root                 string      `json:"root"`
+	IncludeRpm           bool        `json:"include-rpm"`
+	IncludeDebian        bool        `json:"include-debian"`
+	IncludeApk           bool        `json:"include-apk"`
+	IncludePacman        bool        `json:"include-pacman"`
+	IncludePython        bool        `json:"include-python"`
+	PythonPaths          []string    `json:"python-paths"`
+	IncludeNpm           bool        `json:"include-npm"`
+	NpmPaths             []string    `json:"npm-paths"`
+	IncludeGomod         bool        `json:"include-gomod"`
+	GomodPaths           []string    `json:"gomod-paths"`
+	IncludeSnap          bool        `json:"include-snap"`
+	IncludeFlatpak       bool        `json:"include-flatpak"`
+	FailWhenNotSupported bool        `json:"fail-when-not-supported"`
+	OnError              ErrorPolicy `json:"on-error"`
+	// Timeout bounds the listing of each package system
+	Timeout    Interval   `json:"timeout"`
+	ReportMode ReportMode `json:"report-mode"`
+	// Watch triggers a collection, in addition to the interval, when a package database changes
+	Watch         bool     `json:"watch"`
+	WatchDebounce Interval `json:"watch-debounce"`
+	// Extended reports the extended metadata of the packages, such as license and vendor
+	Extended bool `json:"extended"`
+	// SkipUnchanged skips the listing of a package system when its package database is unchanged
+	SkipUnchanged bool `json:"skip-unchanged"`
+	// OsTags adds tags identifying the distribution to each reported measurement
+	OsTags bool `json:"os-tags"`
+	// OsvDatabase is the path of an OSV database export that the packages are matched against
+	OsvDatabase string `json:"osv-database"`
 }
 
 func LoadConfigs(configsDir string) ([]*Config, error) {
@@ -99,9 +164,22 @@ func loadConfigFile(configsDir string, name string) (*Config, error) {
 		return nil, fmt.Errorf("failed to decode config file %s: %w", name, err)
 	}
 
+	config.Name = strings.TrimSuffix(name, filepath.Ext(name))
 	if config.Interval == 0 {
 		config.Interval = DefaultInterval
 	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.WatchDebounce == 0 {
+		config.WatchDebounce = DefaultWatchDebounce
+	}
+	if config.ReportMode == "" {
+		config.ReportMode = ReportFull
+	}
+	if config.OnError == "" {
+		config.OnError = ContinueOnError
+	}
 
 	return &config, nil
 }
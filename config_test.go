@@ -17,6 +17,7 @@
 package packagesagent
 
 import (
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"path/filepath"
@@ -28,7 +29,7 @@ func TestLoadConfigs_success(t *testing.T) {
 	configs, err := LoadConfigs(filepath.Join("testdata", "configs"))
 	require.NoError(t, err)
 
-	assert.Len(t, configs, 2)
+	assert.Len(t, configs, 3)
 
 	// since the file ordering is not deterministic the assertion logic is a little messy
 	for i := 0; i < len(configs); i++ {
@@ -36,10 +37,30 @@ func TestLoadConfigs_success(t *testing.T) {
 			assert.False(t, configs[i].IncludeDebian)
 			// rpm file exercises the default interval scenario since one wasn't specified
 			assert.Equal(t, DefaultInterval, configs[i].Interval)
+			assert.Equal(t, DefaultTimeout, configs[i].Timeout)
+			assert.Equal(t, "rpm-monitor", configs[i].Name)
+			assert.Equal(t, ReportFull, configs[i].ReportMode)
+			assert.False(t, configs[i].Watch)
+			assert.Equal(t, DefaultWatchDebounce, configs[i].WatchDebounce)
+			assert.False(t, configs[i].Extended)
+			assert.False(t, configs[i].OsTags)
+			assert.Empty(t, configs[i].OsvDatabase)
 		} else if configs[i].IncludeDebian {
 			assert.False(t, configs[i].IncludeRpm)
 			assert.Equal(t, Interval(6*time.Hour), configs[i].Interval)
 			assert.True(t, configs[i].FailWhenNotSupported)
+			// the default policy
+			assert.Equal(t, ContinueOnError, configs[i].OnError)
+			assert.Equal(t, ReportBoth, configs[i].ReportMode)
+			assert.True(t, configs[i].Watch)
+			assert.Equal(t, Interval(10*time.Second), configs[i].WatchDebounce)
+			assert.True(t, configs[i].Extended)
+			assert.Equal(t, "/var/lib/osv/debian.zip", configs[i].OsvDatabase)
+		} else if configs[i].IncludeApk {
+			assert.Equal(t, Interval(30*time.Minute), configs[i].Interval)
+			assert.Equal(t, AbortOnError, configs[i].OnError)
+			assert.True(t, configs[i].SkipUnchanged)
+			assert.True(t, configs[i].OsTags)
 		} else {
 			t.Fail()
 		}
@@ -63,3 +84,13 @@ func TestLoadConfigs_badDecode(t *testing.T) {
 	assert.Error(t, err)
 	assert.EqualError(t, err, "failed to decode config file bad.json: invalid character 'N' looking for beginning of value")
 }
+
+func TestErrorPolicy_UnmarshalJSON(t *testing.T) {
+	var config Config
+	err := json.Unmarshal([]byte(`{"on-error": "abort"}`), &config)
+	require.NoError(t, err)
+	assert.Equal(t, AbortOnError, config.OnError)
+
+	err = json.Unmarshal([]byte(`{"on-error": "retry"}`), &config)
+	assert.EqualError(t, err, `unknown error policy "retry", expected continue or abort`)
+}
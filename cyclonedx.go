@@ -0,0 +1,299 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	CycloneDxSpecVersion = "1.5"
+	cycloneDxXmlns       = "http://cyclonedx.org/schema/bom/1.5"
+
+	// cycloneDxPropertyPrefix namespaces the properties added to CycloneDX documents
+	cycloneDxPropertyPrefix = ToolName + ":"
+)
+
+// CycloneDxEncoding selects the encoding of CycloneDX documents
+type CycloneDxEncoding int
+
+const (
+	CycloneDxJson CycloneDxEncoding = iota
+	CycloneDxXml
+)
+
+// cdxBom is a CycloneDX document where the field tags provide both the JSON and XML encodings
+type cdxBom struct {
+	XMLName      xml.Name       `json:"-" xml:"bom"`
+	Xmlns        string         `json:"-" xml:"xmlns,attr"`
+	BomFormat    string         `json:"bomFormat" xml:"-"`
+	SpecVersion  string         `json:"specVersion" xml:"-"`
+	SerialNumber string         `json:"serialNumber" xml:"serialNumber,attr"`
+	Version      int            `json:"version" xml:"version,attr"`
+	Metadata     cdxMetadata    `json:"metadata" xml:"metadata"`
+	Components   []cdxComponent `json:"components" xml:"components>component"`
+}
+
+type cdxMetadata struct {
+	Timestamp  time.Time     `json:"timestamp" xml:"timestamp"`
+	Tools      cdxTools      `json:"tools" xml:"tools"`
+	Component  cdxComponent  `json:"component" xml:"component"`
+	Properties cdxProperties `json:"properties,omitempty" xml:"properties,omitempty"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components" xml:"components>component"`
+}
+
+type cdxComponent struct {
+	Type        string             `json:"type" xml:"type,attr"`
+	BomRef      string             `json:"bom-ref,omitempty" xml:"bom-ref,attr,omitempty"`
+	Publisher   string             `json:"publisher,omitempty" xml:"publisher,omitempty"`
+	Name        string             `json:"name" xml:"name"`
+	Version     string             `json:"version,omitempty" xml:"version,omitempty"`
+	Description string             `json:"description,omitempty" xml:"description,omitempty"`
+	Licenses    []cdxLicenseChoice `json:"licenses,omitempty" xml:"licenses,omitempty"`
+	Purl        string             `json:"purl,omitempty" xml:"purl,omitempty"`
+	Properties  cdxProperties      `json:"properties,omitempty" xml:"properties,omitempty"`
+}
+
+type cdxLicenseChoice struct {
+	License cdxLicense `json:"license" xml:"license"`
+}
+
+type cdxLicense struct {
+	// Name is used rather than an SPDX id since package systems declare licenses in their
+	// own terms
+	Name string `json:"name" xml:"name"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name" xml:"name,attr"`
+	Value string `json:"value" xml:",chardata"`
+}
+
+// cdxProperties is encoded as a properties element of property elements, which unlike a
+// parent>child field tag is omitted when empty
+type cdxProperties []cdxProperty
+
+func (p cdxProperties) MarshalXML(encoder *xml.Encoder, start xml.StartElement) error {
+	return encoder.EncodeElement(struct {
+		Property []cdxProperty `xml:"property"`
+	}{p}, start)
+}
+
+// cycloneDxReporter writes each batch as a CycloneDX SBOM, with a component per package, once
+// the batch is closed
+type cycloneDxReporter struct {
+	// mu serializes the writing of the batches of concurrent configs
+	mu          *sync.Mutex
+	out         io.Writer
+	encoding    CycloneDxEncoding
+	hostname    string
+	toolVersion string
+	logger      *zap.Logger
+	// newUuid generates the unique serial number of each document
+	newUuid func() string
+}
+
+// NewCycloneDxReporter creates a reporter that writes each batch to out as a CycloneDX SBOM
+// describing the host. The toolVersion, if known, is the version of the agent recorded as the
+// tool that created the SBOM.
+func NewCycloneDxReporter(out io.Writer, encoding CycloneDxEncoding, hostname string, toolVersion string,
+	logger *zap.Logger) PackagesReporter {
+	return &cycloneDxReporter{
+		mu:          &sync.Mutex{},
+		out:         out,
+		encoding:    encoding,
+		hostname:    hostname,
+		toolVersion: toolVersion,
+		logger:      logger,
+		newUuid:     newUuid,
+	}
+}
+
+func (c *cycloneDxReporter) StartBatch(timestamp time.Time, tags map[string]string) PackagesReporterBatch {
+	bom := cdxBom{
+		Xmlns:        cycloneDxXmlns,
+		BomFormat:    "CycloneDX",
+		SpecVersion:  CycloneDxSpecVersion,
+		SerialNumber: "urn:uuid:" + c.newUuid(),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: timestamp,
+			Tools: cdxTools{Components: []cdxComponent{
+				{Type: "application", Name: ToolName, Version: c.toolVersion},
+			}},
+			Component: cdxComponent{Type: "device", BomRef: "host", Name: c.hostname},
+		},
+		Components: []cdxComponent{},
+	}
+	for _, key := range sortedKeys(tags) {
+		bom.Metadata.Properties = append(bom.Metadata.Properties,
+			cdxProperty{Name: cycloneDxPropertyPrefix + "tag:" + key, Value: tags[key]})
+	}
+
+	return &cycloneDxReporterBatch{
+		reporter: c,
+		bom:      bom,
+		bomRefs:  make(map[string]struct{}),
+	}
+}
+
+type cycloneDxReporterBatch struct {
+	reporter *cycloneDxReporter
+	bom      cdxBom
+	// bomRefs tracks the references in use since the same package can be installed in more
+	// than one location
+	bomRefs map[string]struct{}
+}
+
+func (c *cycloneDxReporterBatch) ReportSuccess(system string, packages []SoftwarePackage) {
+	for _, pkg := range packages {
+		c.bom.Components = append(c.bom.Components, c.component(system, pkg))
+	}
+}
+
+func (c *cycloneDxReporterBatch) component(system string, pkg SoftwarePackage) cdxComponent {
+	component := cdxComponent{
+		Type:        "library",
+		Publisher:   pkg.Vendor,
+		Name:        pkg.Name,
+		Version:     pkg.Version,
+		Description: pkg.Summary,
+		Purl:        packagePurl(system, pkg),
+		Properties: cdxProperties{
+			{Name: cycloneDxPropertyPrefix + "system", Value: system},
+		},
+	}
+	switch system {
+	case "snap", "flatpak":
+		component.Type = "application"
+	}
+	if pkg.License != "" {
+		component.Licenses = []cdxLicenseChoice{{License: cdxLicense{Name: pkg.License}}}
+	}
+	if pkg.Arch != "" {
+		component.Properties = append(component.Properties,
+			cdxProperty{Name: cycloneDxPropertyPrefix + "arch", Value: pkg.Arch})
+	}
+	if pkg.Location != "" {
+		component.Properties = append(component.Properties,
+			cdxProperty{Name: cycloneDxPropertyPrefix + "location", Value: pkg.Location})
+	}
+
+	bomRef := component.Purl
+	if bomRef == "" {
+		bomRef = fmt.Sprintf("%s:%s@%s", system, pkg.Name, pkg.Version)
+	}
+	component.BomRef = bomRef
+	for i := 2; ; i++ {
+		if _, exists := c.bomRefs[component.BomRef]; !exists {
+			break
+		}
+		component.BomRef = bomRef + "#" + strconv.Itoa(i)
+	}
+	c.bomRefs[component.BomRef] = struct{}{}
+
+	return component
+}
+
+func (c *cycloneDxReporterBatch) ReportChanges(system string, changes []PackageChange) {
+	// an SBOM only describes the current inventory
+}
+
+// ReportFailure records the package system in the metadata properties since the SBOM will be
+// missing its packages
+func (c *cycloneDxReporterBatch) ReportFailure(system string, err error) {
+	c.reporter.logger.Warn("SBOM will be missing the packages of a failed package system",
+		zap.String("system", system), zap.Error(err))
+	c.bom.Metadata.Properties = append(c.bom.Metadata.Properties,
+		cdxProperty{Name: cycloneDxPropertyPrefix + "failed-system", Value: system})
+}
+
+// RequiresExtended is true since the license, vendor, and summary are part of each component
+func (c *cycloneDxReporterBatch) RequiresExtended() bool {
+	return true
+}
+
+func (c *cycloneDxReporterBatch) ReportCollection(system string, summary CollectionSummary) {
+	// not applicable to an SBOM
+}
+
+func (c *cycloneDxReporterBatch) ReportVulnerabilities(system string, vulnerabilities []PackageVulnerability) {
+	// the SBOM is limited to the inventory, leaving its consumers to match vulnerabilities
+}
+
+// ReportOsInfo adds the distribution as an operating-system component and describes the host
+// in the properties of the metadata component
+func (c *cycloneDxReporterBatch) ReportOsInfo(info OsInfo) {
+	if info.Distro != nil && info.Distro.ID != "" {
+		c.bom.Components = append(c.bom.Components, cdxComponent{
+			Type:        "operating-system",
+			BomRef:      "os",
+			Name:        info.Distro.ID,
+			Version:     info.Distro.VersionID,
+			Description: info.Distro.PrettyName,
+		})
+	}
+
+	host := &c.bom.Metadata.Component
+	for _, property := range []cdxProperty{
+		{Name: cycloneDxPropertyPrefix + "kernel-release", Value: info.KernelRelease},
+		{Name: cycloneDxPropertyPrefix + "arch", Value: info.Arch},
+		{Name: cycloneDxPropertyPrefix + "machine-id", Value: info.MachineId},
+	} {
+		if property.Value != "" {
+			host.Properties = append(host.Properties, property)
+		}
+	}
+}
+
+func (c *cycloneDxReporterBatch) Close() error {
+	c.reporter.mu.Lock()
+	defer c.reporter.mu.Unlock()
+
+	var err error
+	switch c.reporter.encoding {
+	case CycloneDxXml:
+		_, err = io.WriteString(c.reporter.out, xml.Header)
+		if err == nil {
+			encoder := xml.NewEncoder(c.reporter.out)
+			encoder.Indent("", "  ")
+			err = encoder.Encode(c.bom)
+		}
+		if err == nil {
+			_, err = io.WriteString(c.reporter.out, "\n")
+		}
+	default:
+		encoder := json.NewEncoder(c.reporter.out)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(c.bom)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write CycloneDX document: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func reportCycloneDx(t *testing.T, encoding CycloneDxEncoding) string {
+	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	reporter := NewCycloneDxReporter(&out, encoding, "web-1", "1.2.0", zap.NewNop())
+	reporter.(*cycloneDxReporter).newUuid = func() string {
+		return "3e671687-395b-41f5-a30f-a58921a69b79"
+	}
+	batch := reporter.StartBatch(timestamp, map[string]string{"image": "ubi8"})
+	require.True(t, requiresExtended(batch))
+
+	batch.ReportOsInfo(OsInfo{
+		Distro:        &OsRelease{ID: "rhel", VersionID: "8.1", PrettyName: "Red Hat Enterprise Linux 8.1 (Ootpa)"},
+		KernelRelease: "4.18.0-147.el8.x86_64",
+		Arch:          "x86_64",
+	})
+	batch.ReportSuccess("rpm", []SoftwarePackage{
+		{Name: "tzdata", Version: "2019a-1.el8", Arch: "noarch"},
+		{Name: "dbus-common", Version: "1:1.12.8-7.el8", Arch: "noarch", Epoch: "1",
+			Vendor: "Red Hat, Inc.", License: "(GPLv2+ or AFL) and GPLv2+", Summary: "D-BUS message bus configuration"},
+	})
+	batch.ReportSuccess("python", []SoftwarePackage{
+		{Name: "six", Version: "1.16.0", Location: "/usr/lib/python3/site-packages"},
+		{Name: "six", Version: "1.16.0", Location: "/srv/venv/lib/python3.9/site-packages"},
+	})
+	batch.ReportFailure("npm", errors.New("failed to read manifest"))
+	require.NoError(t, batch.Close())
+
+	return out.String()
+}
+
+func TestCycloneDxReporter_json(t *testing.T) {
+	assert.JSONEq(t, `{
+  "bomFormat": "CycloneDX",
+  "specVersion": "1.5",
+  "serialNumber": "urn:uuid:3e671687-395b-41f5-a30f-a58921a69b79",
+  "version": 1,
+  "metadata": {
+    "timestamp": "2006-01-02T15:04:05Z",
+    "tools": {"components": [{"type": "application", "name": "salus-packages-agent", "version": "1.2.0"}]},
+    "component": {
+      "type": "device",
+      "bom-ref": "host",
+      "name": "web-1",
+      "properties": [
+        {"name": "salus-packages-agent:kernel-release", "value": "4.18.0-147.el8.x86_64"},
+        {"name": "salus-packages-agent:arch", "value": "x86_64"}
+      ]
+    },
+    "properties": [
+      {"name": "salus-packages-agent:tag:image", "value": "ubi8"},
+      {"name": "salus-packages-agent:failed-system", "value": "npm"}
+    ]
+  },
+  "components": [
+    {
+      "type": "operating-system",
+      "bom-ref": "os",
+      "name": "rhel",
+      "version": "8.1",
+      "description": "Red Hat Enterprise Linux 8.1 (Ootpa)"
+    },
+    {
+      "type": "library",
+      "bom-ref": "pkg:rpm/tzdata@2019a-1.el8?arch=noarch",
+      "name": "tzdata",
+      "version": "2019a-1.el8",
+      "purl": "pkg:rpm/tzdata@2019a-1.el8?arch=noarch",
+      "properties": [
+        {"name": "salus-packages-agent:system", "value": "rpm"},
+        {"name": "salus-packages-agent:arch", "value": "noarch"}
+      ]
+    },
+    {
+      "type": "library",
+      "bom-ref": "pkg:rpm/dbus-common@1.12.8-7.el8?arch=noarch&epoch=1",
+      "publisher": "Red Hat, Inc.",
+      "name": "dbus-common",
+      "version": "1:1.12.8-7.el8",
+      "description": "D-BUS message bus configuration",
+      "licenses": [{"license": {"name": "(GPLv2+ or AFL) and GPLv2+"}}],
+      "purl": "pkg:rpm/dbus-common@1.12.8-7.el8?arch=noarch&epoch=1",
+      "properties": [
+        {"name": "salus-packages-agent:system", "value": "rpm"},
+        {"name": "salus-packages-agent:arch", "value": "noarch"}
+      ]
+    },
+    {
+      "type": "library",
+      "bom-ref": "pkg:pypi/six@1.16.0",
+      "name": "six",
+      "version": "1.16.0",
+      "purl": "pkg:pypi/six@1.16.0",
+      "properties": [
+        {"name": "salus-packages-agent:system", "value": "python"},
+        {"name": "salus-packages-agent:location", "value": "/usr/lib/python3/site-packages"}
+      ]
+    },
+    {
+      "type": "library",
+      "bom-ref": "pkg:pypi/six@1.16.0#2",
+      "name": "six",
+      "version": "1.16.0",
+      "purl": "pkg:pypi/six@1.16.0",
+      "properties": [
+        {"name": "salus-packages-agent:system", "value": "python"},
+        {"name": "salus-packages-agent:location", "value": "/srv/venv/lib/python3.9/site-packages"}
+      ]
+    }
+  ]
+}`, reportCycloneDx(t, CycloneDxJson))
+}
+
+func TestCycloneDxReporter_xml(t *testing.T) {
+	assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>
+<bom xmlns="http://cyclonedx.org/schema/bom/1.5" serialNumber="urn:uuid:3e671687-395b-41f5-a30f-a58921a69b79" version="1">
+  <metadata>
+    <timestamp>2006-01-02T15:04:05Z</timestamp>
+    <tools>
+      <components>
+        <component type="application">
+          <name>salus-packages-agent</name>
+          <version>1.2.0</version>
+        </component>
+      </components>
+    </tools>
+    <component type="device" bom-ref="host">
+      <name>web-1</name>
+      <properties>
+        <property name="salus-packages-agent:kernel-release">4.18.0-147.el8.x86_64</property>
+        <property name="salus-packages-agent:arch">x86_64</property>
+      </properties>
+    </component>
+    <properties>
+      <property name="salus-packages-agent:tag:image">ubi8</property>
+      <property name="salus-packages-agent:failed-system">npm</property>
+    </properties>
+  </metadata>
+  <components>
+    <component type="operating-system" bom-ref="os">
+      <name>rhel</name>
+      <version>8.1</version>
+      <description>Red Hat Enterprise Linux 8.1 (Ootpa)</description>
+    </component>
+    <component type="library" bom-ref="pkg:rpm/tzdata@2019a-1.el8?arch=noarch">
+      <name>tzdata</name>
+      <version>2019a-1.el8</version>
+      <purl>pkg:rpm/tzdata@2019a-1.el8?arch=noarch</purl>
+      <properties>
+        <property name="salus-packages-agent:system">rpm</property>
+        <property name="salus-packages-agent:arch">noarch</property>
+      </properties>
+    </component>
+    <component type="library" bom-ref="pkg:rpm/dbus-common@1.12.8-7.el8?arch=noarch&amp;epoch=1">
+      <publisher>Red Hat, Inc.</publisher>
+      <name>dbus-common</name>
+      <version>1:1.12.8-7.el8</version>
+      <description>D-BUS message bus configuration</description>
+      <licenses>
+        <license>
+          <name>(GPLv2+ or AFL) and GPLv2+</name>
+        </license>
+      </licenses>
+      <purl>pkg:rpm/dbus-common@1.12.8-7.el8?arch=noarch&amp;epoch=1</purl>
+      <properties>
+        <property name="salus-packages-agent:system">rpm</property>
+        <property name="salus-packages-agent:arch">noarch</property>
+      </properties>
+    </component>
+    <component type="library" bom-ref="pkg:pypi/six@1.16.0">
+      <name>six</name>
+      <version>1.16.0</version>
+      <purl>pkg:pypi/six@1.16.0</purl>
+      <properties>
+        <property name="salus-packages-agent:system">python</property>
+        <property name="salus-packages-agent:location">/usr/lib/python3/site-packages</property>
+      </properties>
+    </component>
+    <component type="library" bom-ref="pkg:pypi/six@1.16.0#2">
+      <name>six</name>
+      <version>1.16.0</version>
+      <purl>pkg:pypi/six@1.16.0</purl>
+      <properties>
+        <property name="salus-packages-agent:system">python</property>
+        <property name="salus-packages-agent:location">/srv/venv/lib/python3.9/site-packages</property>
+      </properties>
+    </component>
+  </components>
+</bom>
+`, reportCycloneDx(t, CycloneDxXml))
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	dpkgAdminDir      = "/var/lib/dpkg"
+	dpkgStatusPath    = "/var/lib/dpkg/status"
+	dpkgStatusOldPath = "/var/lib/dpkg/status-old"
+	dpkgDocDir        = "/usr/share/doc"
+
+	dpkgInstalledStatus = "install ok installed"
+
+	// dpkgInstalledSizeUnit is the unit of the Installed-Size field, which is in KiB
+	dpkgInstalledSizeUnit = 1024
+)
+
+// dpkgStatusLister reads the dpkg database status file directly, which allows for listing
+// packages in minimal images that retain the database but not the dpkg-query executable
+type dpkgStatusLister struct {
+	// statusPaths are tried in order and the first one that exists is used
+	statusPaths []string
+	// docDir, when set, contains the copyright file of each package, from which the license
+	// is determined
+	docDir string
+	logger *zap.Logger
+}
+
+// DpkgStatusLister creates a lister that parses the dpkg status file, of the filesystem at root,
+// rather than invoking dpkg-query
+func DpkgStatusLister(root string, logger *zap.Logger) SoftwarePackageLister {
+	return &dpkgStatusLister{
+		statusPaths: []string{rootedPath(root, dpkgStatusPath), rootedPath(root, dpkgStatusOldPath)},
+		docDir:      rootedPath(root, dpkgDocDir),
+		logger:      logger,
+	}
+}
+
+func (d *dpkgStatusLister) PackagingSystem() string {
+	return "debian"
+}
+
+func (d *dpkgStatusLister) IsSupported() bool {
+	return d.statusPath() != ""
+}
+
+func (d *dpkgStatusLister) WatchPaths() []string {
+	return d.statusPaths
+}
+
+func (d *dpkgStatusLister) Fingerprint() (string, error) {
+	return fingerprintPaths(d.WatchPaths())
+}
+
+func (d *dpkgStatusLister) statusPath() string {
+	for _, path := range d.statusPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func (d *dpkgStatusLister) ListPackages(ctx context.Context) ([]SoftwarePackage, error) {
+	path := d.statusPath()
+	if path == "" {
+		return nil, fmt.Errorf("none of the dpkg status files exist: %v", d.statusPaths)
+	}
+
+	d.logger.Debug("reading dpkg status file", zap.String("path", path))
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dpkg status file: %w", err)
+	}
+	defer file.Close()
+
+	pkgs, err := parseDpkgStatus(&contextReader{ctx: ctx, reader: file})
+	var malformed *MalformedRecordsError
+	if errors.As(err, &malformed) && len(pkgs) > 0 {
+		d.logger.Warn("ignoring malformed dpkg status stanzas",
+			zap.String("path", path), zap.Int("count", malformed.Count),
+			zap.String("example", malformed.Example))
+	} else if err != nil {
+		return nil, err
+	}
+	addDpkgInstallTimes(filepath.Join(filepath.Dir(path), "info"), pkgs)
+	if d.docDir != "" {
+		addDpkgLicenses(d.docDir, pkgs)
+	}
+	return pkgs, err
+}
+
+// addDpkgInstallTimes uses the modification time of each package's file list as its install
+// time, which is the same as dpkg-query's db-fsys:Last-Modified. The file list is named with
+// the architecture qualifier for Multi-Arch: same packages.
+func addDpkgInstallTimes(infoDir string, pkgs []SoftwarePackage) {
+	for i := range pkgs {
+		for _, name := range []string{pkgs[i].Name, pkgs[i].Name + ":" + pkgs[i].Arch} {
+			info, err := os.Stat(filepath.Join(infoDir, name+".list"))
+			if err == nil {
+				pkgs[i].InstallTime = info.ModTime().Unix()
+				break
+			}
+		}
+	}
+}
+
+// addDpkgLicenses determines the license of each package from its copyright file, which is
+// only possible for the machine-readable format since the license is otherwise free-form text.
+// A package whose copyright file is missing or not machine-readable has no license.
+func addDpkgLicenses(docDir string, pkgs []SoftwarePackage) {
+	for i := range pkgs {
+		file, err := os.Open(filepath.Join(docDir, pkgs[i].Name, "copyright"))
+		if err != nil {
+			continue
+		}
+		pkgs[i].License = parseDebianCopyrightLicense(file)
+		file.Close()
+	}
+}
+
+// parseDebianCopyrightLicense returns the licenses of the Files paragraphs of a copyright file
+// in the machine-readable format, https://www.debian.org/doc/packaging-manuals/copyright-format/1.0/,
+// joined by AND since each applies to some of the files. An empty string is returned for a
+// copyright file in any other format.
+func parseDebianCopyrightLicense(reader io.Reader) string {
+	var licenses []string
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	first := true
+	hasFiles := false
+	license := ""
+	flush := func() {
+		if hasFiles && license != "" && !seen[license] {
+			seen[license] = true
+			licenses = append(licenses, license)
+		}
+		hasFiles = false
+		license = ""
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		if first {
+			// the header paragraph of the machine-readable format declares it first
+			if !strings.HasPrefix(line, "Format:") {
+				return ""
+			}
+			first = false
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// continuation, such as the text of a license
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		switch parts[0] {
+		case "Files":
+			hasFiles = true
+		case "License":
+			// the first line is the short name, which is followed by the license text
+			license = strings.TrimSpace(parts[1])
+		}
+	}
+	flush()
+
+	return strings.Join(licenses, " AND ")
+}
+
+// parseDpkgStatus parses the RFC822-style stanzas of a dpkg status file and returns the
+// packages that are fully installed. Fields other than the name, version, architecture, and
+// status are retained in the Extra map of each package, where some are also the extended
+// metadata of the package. A stanza with a malformed line is skipped and the remaining
+// packages are returned along with a *MalformedRecordsError.
+func parseDpkgStatus(reader io.Reader) ([]SoftwarePackage, error) {
+	var pkgs []SoftwarePackage
+	var malformed *MalformedRecordsError
+
+	scanner := bufio.NewScanner(reader)
+	// some stanzas, such as ones with long Conffiles, have lines beyond the default limit
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	stanza := make(map[string]string)
+	lastKey := ""
+	lineNumber := 0
+	// stanzaErr is the first malformed line of the current stanza
+	stanzaErr := ""
+
+	flush := func() {
+		if stanzaErr != "" {
+			if malformed == nil {
+				malformed = &MalformedRecordsError{Example: stanzaErr}
+			}
+			malformed.Count++
+		} else if len(stanza) > 0 {
+			if pkg, ok := dpkgStanzaToPackage(stanza); ok {
+				pkgs = append(pkgs, pkg)
+			}
+		}
+		stanza = make(map[string]string)
+		lastKey = ""
+		stanzaErr = ""
+	}
+
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		if stanzaErr != "" {
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			// continuation of a multi-line field
+			if lastKey == "" {
+				stanzaErr = fmt.Sprintf("dpkg status line %d is a continuation without a field", lineNumber)
+				continue
+			}
+			stanza[lastKey] += "\n" + strings.TrimSpace(line)
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) < 2 {
+			stanzaErr = fmt.Sprintf("dpkg status line %d was malformed: %s", lineNumber, line)
+			continue
+		}
+		lastKey = parts[0]
+		stanza[lastKey] = strings.TrimSpace(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read dpkg status: %w", err)
+	}
+	flush()
+
+	if malformed != nil {
+		return pkgs, malformed
+	}
+	return pkgs, nil
+}
+
+func dpkgStanzaToPackage(stanza map[string]string) (SoftwarePackage, bool) {
+	if stanza["Status"] != dpkgInstalledStatus || stanza["Package"] == "" {
+		return SoftwarePackage{}, false
+	}
+
+	pkg := SoftwarePackage{
+		Name:          stanza["Package"],
+		Version:       stanza["Version"],
+		Arch:          stanza["Architecture"],
+		Extra:         make(map[string]string),
+		Epoch:         versionEpoch(stanza["Version"]),
+		InstalledSize: parseOptionalInt(stanza["Installed-Size"]) * dpkgInstalledSizeUnit,
+		Vendor:        stanza["Maintainer"],
+		// the Source field is omitted when it is the same as the package name and otherwise
+		// is followed by the source version when it differs from the package version
+		SourcePackage: strings.Fields(stanza["Source"] + " " + stanza["Package"])[0],
+	}
+	// the first line of the description is the summary
+	pkg.Summary = strings.SplitN(stanza["Description"], "\n", 2)[0]
+
+	for key, value := range stanza {
+		switch key {
+		case "Package", "Version", "Architecture", "Status":
+		default:
+			pkg.Extra[key] = value
+		}
+	}
+	return pkg, true
+}
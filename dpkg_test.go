@@ -0,0 +1,185 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDpkgStatusLister_ListPackages(t *testing.T) {
+	lister := &dpkgStatusLister{
+		statusPaths: []string{filepath.Join("testdata", "dpkg", "status")},
+		logger:      zap.NewNop(),
+	}
+
+	assert.Equal(t, "debian", lister.PackagingSystem())
+	require.True(t, lister.IsSupported())
+
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	// vim-tiny is only config-files, so not included
+	require.Len(t, packages, 6)
+
+	assert.Equal(t, "adduser", packages[0].Name)
+	assert.Equal(t, "3.134", packages[0].Version)
+	assert.Equal(t, "all", packages[0].Arch)
+
+	zlib := packages[5]
+	assert.Equal(t, "zlib1g", zlib.Name)
+	assert.Equal(t, "1:1.2.13.dfsg-1", zlib.Version)
+	assert.Equal(t, "amd64", zlib.Arch)
+	assert.Equal(t, "zlib", zlib.Extra["Source"])
+	assert.Equal(t, "optional", zlib.Extra["Priority"])
+	assert.NotContains(t, zlib.Extra, "Status")
+	assert.NotContains(t, zlib.Extra, "Package")
+
+	// multi-line fields are retained with their continuation lines
+	assert.True(t, strings.HasPrefix(packages[0].Extra["Description"], "add and remove users and groups\n"))
+
+	// extended metadata
+	assert.Equal(t, "1", zlib.Epoch)
+	assert.Equal(t, int64(168*1024), zlib.InstalledSize)
+	assert.Equal(t, "Mark Brown <broonie@debian.org>", zlib.Vendor)
+	assert.Equal(t, "zlib", zlib.SourcePackage)
+	assert.Equal(t, "adduser", packages[0].SourcePackage)
+	assert.Equal(t, "add and remove users and groups", packages[0].Summary)
+	assert.Equal(t, "", packages[0].Epoch)
+	for _, pkg := range packages {
+		if pkg.Name == "bash" {
+			// the source version is not part of the name
+			assert.Equal(t, "bash", pkg.SourcePackage)
+		}
+	}
+}
+
+func TestDpkgStatusLister_installTime(t *testing.T) {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", "dpkg", "status"))
+	require.NoError(t, err)
+	adminDir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(adminDir, "status"), content, 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(adminDir, "info"), 0755))
+	installed := time.Date(2023, 6, 10, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{"adduser.list", "zlib1g:amd64.list"} {
+		path := filepath.Join(adminDir, "info", name)
+		require.NoError(t, ioutil.WriteFile(path, nil, 0644))
+		require.NoError(t, os.Chtimes(path, installed, installed))
+	}
+
+	lister := &dpkgStatusLister{
+		statusPaths: []string{filepath.Join(adminDir, "status")},
+		logger:      zap.NewNop(),
+	}
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	require.Len(t, packages, 6)
+
+	assert.Equal(t, installed.Unix(), packages[0].InstallTime)
+	// Multi-Arch: same packages qualify their file list with the architecture
+	assert.Equal(t, installed.Unix(), packages[5].InstallTime)
+	assert.Zero(t, packages[1].InstallTime)
+}
+
+func TestDpkgStatusLister_license(t *testing.T) {
+	lister := &dpkgStatusLister{
+		statusPaths: []string{filepath.Join("testdata", "dpkg", "status")},
+		docDir:      filepath.Join("testdata", "dpkg", "doc"),
+		logger:      zap.NewNop(),
+	}
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	require.Len(t, packages, 6)
+
+	// the adduser copyright file isn't machine-readable and the others are missing
+	assert.Equal(t, "", packages[0].License)
+	assert.Equal(t, "", packages[1].License)
+	assert.Equal(t, "Zlib AND BSL-1.0", packages[5].License)
+}
+
+func TestParseDebianCopyrightLicense(t *testing.T) {
+	assert.Equal(t, "GPL-2+", parseDebianCopyrightLicense(strings.NewReader(
+		"Format: https://www.debian.org/doc/packaging-manuals/copyright-format/1.0/\n"+
+			"License: MIT\n\n"+
+			"Files: *\nCopyright: 2020 Someone\nLicense: GPL-2+\n Some license text\n")))
+	assert.Equal(t, "", parseDebianCopyrightLicense(strings.NewReader("Files: *\nLicense: GPL-2+\n")))
+}
+
+func TestDpkgStatusLister_fallbackToStatusOld(t *testing.T) {
+	lister := &dpkgStatusLister{
+		statusPaths: []string{
+			filepath.Join("testdata", "dpkg-old", "status"),
+			filepath.Join("testdata", "dpkg-old", "status-old"),
+		},
+		logger: zap.NewNop(),
+	}
+
+	require.True(t, lister.IsSupported())
+
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	require.Len(t, packages, 1)
+	assert.Equal(t, "adduser", packages[0].Name)
+}
+
+func TestDpkgStatusLister_notSupported(t *testing.T) {
+	lister := &dpkgStatusLister{
+		statusPaths: []string{filepath.Join("testdata", "not-dpkg", "status")},
+		logger:      zap.NewNop(),
+	}
+
+	assert.False(t, lister.IsSupported())
+	_, err := lister.ListPackages(context.Background())
+	assert.Error(t, err)
+}
+
+func TestParseDpkgStatus_malformed(t *testing.T) {
+	_, err := parseDpkgStatus(strings.NewReader("Package: adduser\nnot a field\n"))
+	assert.EqualError(t, err,
+		`1 package manager output records were malformed, such as "dpkg status line 2 was malformed: not a field"`)
+}
+
+func TestParseDpkgStatus_skipsMalformedStanzas(t *testing.T) {
+	pkgs, err := parseDpkgStatus(strings.NewReader(`Package: adduser
+Status: install ok installed
+not a field
+Version: 3.118
+
+ continuation without a field
+Package: dash
+
+Package: bash
+Status: install ok installed
+Version: 5.0-4
+Architecture: amd64
+`))
+
+	var malformed *MalformedRecordsError
+	require.True(t, errors.As(err, &malformed))
+	assert.Equal(t, 2, malformed.Count)
+	assert.Equal(t, "dpkg status line 3 was malformed: not a field", malformed.Example)
+	require.Len(t, pkgs, 1)
+	assert.Equal(t, "bash", pkgs[0].Name)
+}
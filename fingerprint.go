@@ -0,0 +1,62 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Fingerprinter is optionally implemented by a SoftwarePackageLister that can cheaply
+// determine if its package database changed, without listing the packages. The fingerprint
+// is an opaque value that is different whenever the installed packages could be different.
+type Fingerprinter interface {
+	Fingerprint() (string, error)
+}
+
+// fingerprintPaths combines the size, modification time, and inode of each path, where a
+// path that doesn't exist is also part of the fingerprint since it could be created
+func fingerprintPaths(paths []string) (string, error) {
+	var b strings.Builder
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				fmt.Fprintf(&b, "%s:missing;", path)
+				continue
+			}
+			return "", fmt.Errorf("failed to fingerprint %s: %w", path, err)
+		}
+		fmt.Fprintf(&b, "%s:%d:%d:%d;", path, info.Size(), info.ModTime().UnixNano(), fileInode(info))
+	}
+	return b.String(), nil
+}
+
+// listerFingerprint returns the fingerprint of the lister or an empty string when it can't
+// be fingerprinted
+func listerFingerprint(lister SoftwarePackageLister) string {
+	fingerprinter, ok := lister.(Fingerprinter)
+	if !ok {
+		return ""
+	}
+	fingerprint, err := fingerprinter.Fingerprint()
+	if err != nil {
+		return ""
+	}
+	return fingerprint
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFingerprintPaths(t *testing.T) {
+	dir := t.TempDir()
+	statusPath := filepath.Join(dir, "status")
+	missingPath := filepath.Join(dir, "status-old")
+	require.NoError(t, ioutil.WriteFile(statusPath, []byte("Package: dpkg\n"), 0644))
+
+	original, err := fingerprintPaths([]string{statusPath, missingPath})
+	require.NoError(t, err)
+	unchanged, err := fingerprintPaths([]string{statusPath, missingPath})
+	require.NoError(t, err)
+	assert.Equal(t, original, unchanged)
+
+	// same size and modification time, but replaced by a rename
+	info, err := os.Stat(statusPath)
+	require.NoError(t, err)
+	newPath := filepath.Join(dir, "status-new")
+	require.NoError(t, ioutil.WriteFile(newPath, []byte("Package: dpkx\n"), 0644))
+	require.NoError(t, os.Chtimes(newPath, info.ModTime(), info.ModTime()))
+	require.NoError(t, os.Rename(newPath, statusPath))
+	replaced, err := fingerprintPaths([]string{statusPath, missingPath})
+	require.NoError(t, err)
+	assert.NotEqual(t, original, replaced)
+
+	require.NoError(t, ioutil.WriteFile(missingPath, nil, 0644))
+	created, err := fingerprintPaths([]string{statusPath, missingPath})
+	require.NoError(t, err)
+	assert.NotEqual(t, replaced, created)
+}
+
+func TestDebianLister_Fingerprint(t *testing.T) {
+	root := t.TempDir()
+	statusPath := rootedPath(root, dpkgStatusPath)
+	require.NoError(t, os.MkdirAll(filepath.Dir(statusPath), 0755))
+	require.NoError(t, ioutil.WriteFile(statusPath, []byte("Package: dpkg\n"), 0644))
+
+	lister := DebianLister(root, zap.NewNop())
+	fingerprinter, ok := lister.(Fingerprinter)
+	require.True(t, ok)
+
+	original, err := fingerprinter.Fingerprint()
+	require.NoError(t, err)
+
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(statusPath, later, later))
+	changed, err := fingerprinter.Fingerprint()
+	require.NoError(t, err)
+	assert.NotEqual(t, original, changed)
+}
+
+func TestRpmLister_Fingerprint_queryFallback(t *testing.T) {
+	// without a database to read, the rpm tool is used and the listing can't be skipped
+	lister := RpmLister(t.TempDir(), zap.NewNop())
+	fingerprinter, ok := lister.(Fingerprinter)
+	require.True(t, ok)
+
+	_, err := fingerprinter.Fingerprint()
+	assert.Error(t, err)
+	assert.Equal(t, "", listerFingerprint(lister))
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// flatpakInstallationPatterns are globbed to locate the system-wide and per-user flatpak
+// installations
+var flatpakInstallationPatterns = []string{
+	"/var/lib/flatpak",
+	"/root/.local/share/flatpak",
+	"/home/*/.local/share/flatpak",
+}
+
+// flatpakMetainfoPatterns are where an application's AppStream metadata is located, relative
+// to its deployed commit, where the release history provides the application's version
+var flatpakMetainfoPatterns = []string{
+	"files/share/metainfo/%s.metainfo.xml",
+	"files/share/metainfo/%s.appdata.xml",
+	"files/share/appdata/%s.appdata.xml",
+}
+
+type appStreamComponent struct {
+	Releases []struct {
+		Version string `xml:"version,attr"`
+	} `xml:"releases>release"`
+}
+
+// flatpakLister walks the app directory of each flatpak installation, where the current
+// symlink of each application points at the deployed arch/branch
+type flatpakLister struct {
+	root                 string
+	installationPatterns []string
+	logger               *zap.Logger
+}
+
+// FlatpakLister creates a lister for the applications installed by flatpak, both system-wide
+// and per-user, in the filesystem at root
+func FlatpakLister(root string, logger *zap.Logger) SoftwarePackageLister {
+	patterns := make([]string, 0, len(flatpakInstallationPatterns))
+	for _, pattern := range flatpakInstallationPatterns {
+		patterns = append(patterns, rootedPath(root, pattern))
+	}
+	return &flatpakLister{
+		root:                 root,
+		installationPatterns: patterns,
+		logger:               logger,
+	}
+}
+
+func (f *flatpakLister) PackagingSystem() string {
+	return "flatpak"
+}
+
+func (f *flatpakLister) IsSupported() bool {
+	return len(f.installations()) > 0
+}
+
+func (f *flatpakLister) installations() []string {
+	var installations []string
+	for _, pattern := range f.installationPatterns {
+		// the patterns are fixed, so the only possible error is ErrBadPattern
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			if info, err := os.Stat(filepath.Join(match, "app")); err == nil && info.IsDir() {
+				installations = append(installations, match)
+			}
+		}
+	}
+	return installations
+}
+
+// WatchPaths declares the app directory of each installation, which notices applications
+// being installed and uninstalled but not updated in place
+func (f *flatpakLister) WatchPaths() []string {
+	var paths []string
+	for _, installation := range f.installations() {
+		paths = append(paths, filepath.Join(installation, "app"))
+	}
+	return paths
+}
+
+func (f *flatpakLister) ListPackages(ctx context.Context) ([]SoftwarePackage, error) {
+	var pkgs []SoftwarePackage
+
+	for _, installation := range f.installations() {
+		appsDir := filepath.Join(installation, "app")
+		f.logger.Debug("reading flatpak applications", zap.String("path", appsDir))
+		entries, err := ioutil.ReadDir(appsDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read flatpak applications: %w", err)
+		}
+
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if !entry.IsDir() {
+				continue
+			}
+			pkg, ok := f.readApp(installation, filepath.Join(appsDir, entry.Name()), entry.Name())
+			if ok {
+				pkgs = append(pkgs, pkg)
+			}
+		}
+	}
+
+	return pkgs, nil
+}
+
+// readApp resolves the current deployment of an application and returns false if the
+// application has no current deployment
+func (f *flatpakLister) readApp(installation, appDir, appId string) (SoftwarePackage, bool) {
+	// current is a relative symlink such as x86_64/stable
+	current, err := os.Readlink(filepath.Join(appDir, "current"))
+	if err != nil {
+		f.logger.Debug("flatpak application has no current deployment", zap.String("path", appDir))
+		return SoftwarePackage{}, false
+	}
+	currentParts := strings.Split(filepath.ToSlash(current), "/")
+	if len(currentParts) != 2 {
+		f.logger.Warn("flatpak current deployment is malformed",
+			zap.String("path", appDir), zap.String("current", current))
+		return SoftwarePackage{}, false
+	}
+	arch, branch := currentParts[0], currentParts[1]
+
+	deployDir := filepath.Join(appDir, arch, branch)
+	commit, err := os.Readlink(filepath.Join(deployDir, "active"))
+	if err != nil {
+		f.logger.Debug("flatpak application has no active commit", zap.String("path", deployDir))
+		return SoftwarePackage{}, false
+	}
+
+	// not all applications provide a release history, so the branch is the best that can be done
+	version := readAppStreamVersion(filepath.Join(deployDir, commit), appId)
+	if version == "" {
+		version = branch
+	}
+
+	return SoftwarePackage{
+		Name:     appId,
+		Version:  version,
+		Arch:     arch,
+		Location: unrootedPath(f.root, deployDir),
+		Extra: map[string]string{
+			"branch":       branch,
+			"commit":       commit,
+			"installation": unrootedPath(f.root, installation),
+		},
+	}, true
+}
+
+// readAppStreamVersion returns the version of the most recent release declared in the
+// application's AppStream metadata, which lists the newest release first
+func readAppStreamVersion(commitDir, appId string) string {
+	for _, pattern := range flatpakMetainfoPatterns {
+		content, err := ioutil.ReadFile(filepath.Join(commitDir, fmt.Sprintf(pattern, appId)))
+		if err != nil {
+			continue
+		}
+
+		var component appStreamComponent
+		if err := xml.Unmarshal(content, &component); err != nil {
+			continue
+		}
+		if len(component.Releases) > 0 && component.Releases[0].Version != "" {
+			return component.Releases[0].Version
+		}
+	}
+	return ""
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"path/filepath"
+	"testing"
+)
+
+func TestFlatpakLister_ListPackages(t *testing.T) {
+	systemInstallation := filepath.Join("testdata", "flatpak", "system")
+	userInstallation := filepath.Join("testdata", "flatpak", "home", "alice", ".local", "share", "flatpak")
+
+	lister := &flatpakLister{
+		installationPatterns: []string{
+			systemInstallation,
+			filepath.Join("testdata", "flatpak", "home", "*", ".local", "share", "flatpak"),
+		},
+		logger: zap.NewNop(),
+	}
+
+	assert.Equal(t, "flatpak", lister.PackagingSystem())
+	require.True(t, lister.IsSupported())
+
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, []SoftwarePackage{
+		{
+			Name:     "org.gimp.GIMP",
+			Version:  "2.10.34",
+			Arch:     "x86_64",
+			Location: filepath.Join(systemInstallation, "app", "org.gimp.GIMP", "x86_64", "stable"),
+			Extra: map[string]string{
+				"branch":       "stable",
+				"commit":       "5a1e1b3c",
+				"installation": systemInstallation,
+			},
+		},
+		{
+			// no AppStream metadata, so the branch is used
+			Name:     "com.example.NoMeta",
+			Version:  "beta",
+			Arch:     "aarch64",
+			Location: filepath.Join(userInstallation, "app", "com.example.NoMeta", "aarch64", "beta"),
+			Extra: map[string]string{
+				"branch":       "beta",
+				"commit":       "0123abcd",
+				"installation": userInstallation,
+			},
+		},
+		{
+			Name:     "org.mozilla.firefox",
+			Version:  "119.0",
+			Arch:     "x86_64",
+			Location: filepath.Join(userInstallation, "app", "org.mozilla.firefox", "x86_64", "stable"),
+			Extra: map[string]string{
+				"branch":       "stable",
+				"commit":       "9f8e7d6c",
+				"installation": userInstallation,
+			},
+		},
+	}, packages)
+}
+
+func TestFlatpakLister_notSupported(t *testing.T) {
+	lister := &flatpakLister{
+		installationPatterns: []string{filepath.Join("testdata", "not-flatpak")},
+		logger:               zap.NewNop(),
+	}
+
+	assert.False(t, lister.IsSupported())
+}
@@ -1,13 +1,28 @@
 module github.com/racker/salus-packages-agent
 
-go 1.13
+go 1.18
 
 require (
+	github.com/fsnotify/fsnotify v1.8.0
 	github.com/influxdata/line-protocol v0.0.0-20190509173118-5712a8124a9a
 	github.com/itzg/go-flagsfiller v1.4.2
 	github.com/itzg/line-protocol-sender v0.1.1
 	github.com/itzg/zapconfigs v0.1.0
 	github.com/karrick/godirwalk v1.14.0
 	github.com/stretchr/testify v1.4.0
+	github.com/xeipuuv/gojsonschema v1.2.0
+	go.uber.org/multierr v1.3.0
 	go.uber.org/zap v1.13.0
+	golang.org/x/sys v0.13.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/iancoleman/strcase v0.0.0-20191112232945-16388991a334 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/objx v0.1.0 // indirect
+	github.com/xeipuuv/gojsonpointer v0.0.0-20180127040702-4e3ac2762d5f // indirect
+	github.com/xeipuuv/gojsonreference v0.0.0-20180127040603-bd5ef7bd5415 // indirect
+	go.uber.org/atomic v1.5.0 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"bytes"
+	"context"
+	"debug/buildinfo"
+	"fmt"
+	"github.com/karrick/godirwalk"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"runtime/debug"
+)
+
+var elfMagic = []byte("\x7fELF")
+
+// DefaultGoBinaryPaths are the search roots used when none are configured
+var DefaultGoBinaryPaths = []string{"/usr/local/bin", "/usr/local/sbin", "/usr/bin", "/usr/sbin", "/opt"}
+
+// goBinaryLister walks its search roots for ELF executables built by Go and reports the
+// dependency modules recorded in the build info embedded in each
+type goBinaryLister struct {
+	root        string
+	searchRoots []string
+	logger      *zap.Logger
+}
+
+// GoBinaryLister creates a lister for the Go modules compiled into executables. The search
+// roots are within the filesystem at root and the DefaultGoBinaryPaths are used when none
+// are given.
+func GoBinaryLister(root string, searchRoots []string, logger *zap.Logger) SoftwarePackageLister {
+	if len(searchRoots) == 0 {
+		searchRoots = DefaultGoBinaryPaths
+	}
+	rootedSearchRoots := make([]string, 0, len(searchRoots))
+	for _, searchRoot := range searchRoots {
+		rootedSearchRoots = append(rootedSearchRoots, rootedPath(root, searchRoot))
+	}
+	return &goBinaryLister{
+		root:        root,
+		searchRoots: rootedSearchRoots,
+		logger:      logger,
+	}
+}
+
+func (g *goBinaryLister) PackagingSystem() string {
+	return "gomod"
+}
+
+func (g *goBinaryLister) IsSupported() bool {
+	for _, root := range g.searchRoots {
+		if info, err := os.Stat(root); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *goBinaryLister) ListPackages(ctx context.Context) ([]SoftwarePackage, error) {
+	var pkgs []SoftwarePackage
+
+	for _, root := range g.searchRoots {
+		if _, err := os.Stat(root); os.IsNotExist(err) {
+			continue
+		}
+
+		g.logger.Debug("walking for go executables", zap.String("root", root))
+		err := godirwalk.Walk(root, &godirwalk.Options{
+			Callback: func(path string, dirent *godirwalk.Dirent) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				// symlinks are skipped so that each executable is only reported once
+				if !dirent.IsRegular() {
+					return nil
+				}
+				pkgs = append(pkgs, g.readBinary(path)...)
+				return nil
+			},
+			ErrorCallback: func(path string, err error) godirwalk.ErrorAction {
+				if ctx.Err() != nil {
+					return godirwalk.Halt
+				}
+				g.logger.Debug("skipping unreadable path", zap.String("path", path), zap.Error(err))
+				return godirwalk.SkipNode
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk go executable search root %s: %w", root, err)
+		}
+	}
+
+	return pkgs, nil
+}
+
+// readBinary returns the main and dependency modules of the executable at the given path or
+// nothing if it isn't an ELF executable built by Go with module support
+func (g *goBinaryLister) readBinary(path string) []SoftwarePackage {
+	if !isElfExecutable(path) {
+		return nil
+	}
+
+	info, err := buildinfo.ReadFile(path)
+	if err != nil {
+		// most commonly the executable was not built by Go
+		return nil
+	}
+
+	g.logger.Debug("read go build info", zap.String("path", path), zap.String("main", info.Main.Path))
+	return buildInfoPackages(info, unrootedPath(g.root, path))
+}
+
+// buildInfoPackages reports the main module as a package of its own, unless it was built from
+// a working tree, where its version is the meaningless "(devel)"
+func buildInfoPackages(info *debug.BuildInfo, location string) []SoftwarePackage {
+	pkgs := make([]SoftwarePackage, 0, len(info.Deps)+1)
+	if info.Main.Path != "" && info.Main.Version != "(devel)" {
+		pkgs = append(pkgs, SoftwarePackage{
+			Name:     info.Main.Path,
+			Version:  info.Main.Version,
+			Location: location,
+			Extra: map[string]string{
+				"go-version":  info.GoVersion,
+				"main-module": info.Main.Path,
+			},
+		})
+	}
+	for _, dep := range info.Deps {
+		extra := map[string]string{
+			"go-version":  info.GoVersion,
+			"main-module": info.Main.Path,
+		}
+		module := dep
+		if dep.Replace != nil {
+			// the replacement is what was actually compiled into the executable
+			module = dep.Replace
+			extra["replaces"] = dep.Path
+		}
+		pkgs = append(pkgs, SoftwarePackage{
+			Name:     module.Path,
+			Version:  module.Version,
+			Location: location,
+			Extra:    extra,
+		})
+	}
+	return pkgs
+}
+
+func isElfExecutable(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.Mode()&0111 == 0 {
+		return false
+	}
+
+	magic := make([]byte, len(elfMagic))
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, elfMagic)
+}
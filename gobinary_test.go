@@ -0,0 +1,117 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+func TestGoBinaryLister_ListPackages(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the test executable is only an ELF executable on linux")
+	}
+
+	// the test executable itself is a convenient Go executable with known dependencies
+	dir := t.TempDir()
+	binPath := filepath.Join(dir, "sub", "agent.test")
+	require.NoError(t, os.MkdirAll(filepath.Dir(binPath), 0755))
+	copyFile(t, os.Args[0], binPath, 0755)
+	// ...and non-executables and non-ELF files are skipped
+	copyFile(t, os.Args[0], filepath.Join(dir, "not-executable"), 0644)
+	copyFile(t, filepath.Join("testdata", "rpm.out"), filepath.Join(dir, "script"), 0755)
+
+	lister := GoBinaryLister("", []string{dir, filepath.Join(dir, "does-not-exist")}, zap.NewNop())
+
+	assert.Equal(t, "gomod", lister.PackagingSystem())
+	require.True(t, lister.IsSupported())
+
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	require.NotEmpty(t, packages)
+
+	var testify *SoftwarePackage
+	for i := range packages {
+		assert.Equal(t, binPath, packages[i].Location)
+		assert.Equal(t, runtime.Version(), packages[i].Extra["go-version"])
+		assert.Equal(t, "github.com/racker/salus-packages-agent", packages[i].Extra["main-module"])
+		if packages[i].Name == "github.com/stretchr/testify" {
+			testify = &packages[i]
+		}
+	}
+	require.NotNil(t, testify)
+	assert.Equal(t, "v1.4.0", testify.Version)
+}
+
+func TestBuildInfoPackages(t *testing.T) {
+	info := &debug.BuildInfo{
+		GoVersion: "go1.20.4",
+		Main:      debug.Module{Path: "github.com/example/tool", Version: "v1.2.3"},
+		Deps: []*debug.Module{
+			{Path: "github.com/pkg/errors", Version: "v0.9.1"},
+			{Path: "golang.org/x/sys", Version: "v0.8.0", Replace: &debug.Module{Path: "example.com/sys", Version: "v0.8.1"}},
+		},
+	}
+
+	assert.Equal(t, []SoftwarePackage{
+		{Name: "github.com/example/tool", Version: "v1.2.3", Location: "/usr/local/bin/tool",
+			Extra: map[string]string{"go-version": "go1.20.4", "main-module": "github.com/example/tool"}},
+		{Name: "github.com/pkg/errors", Version: "v0.9.1", Location: "/usr/local/bin/tool",
+			Extra: map[string]string{"go-version": "go1.20.4", "main-module": "github.com/example/tool"}},
+		{Name: "example.com/sys", Version: "v0.8.1", Location: "/usr/local/bin/tool",
+			Extra: map[string]string{"go-version": "go1.20.4", "main-module": "github.com/example/tool", "replaces": "golang.org/x/sys"}},
+	}, buildInfoPackages(info, "/usr/local/bin/tool"))
+}
+
+func TestBuildInfoPackages_develMain(t *testing.T) {
+	info := &debug.BuildInfo{
+		GoVersion: "go1.20.4",
+		Main:      debug.Module{Path: "github.com/example/tool", Version: "(devel)"},
+		Deps:      []*debug.Module{{Path: "github.com/pkg/errors", Version: "v0.9.1"}},
+	}
+
+	packages := buildInfoPackages(info, "/usr/local/bin/tool")
+	require.Len(t, packages, 1)
+	assert.Equal(t, "github.com/pkg/errors", packages[0].Name)
+}
+
+func TestGoBinaryLister_notSupported(t *testing.T) {
+	lister := GoBinaryLister("", []string{filepath.Join("testdata", "not-gomod")}, zap.NewNop())
+
+	assert.False(t, lister.IsSupported())
+}
+
+func copyFile(t *testing.T, src, dst string, mode os.FileMode) {
+	in, err := os.Open(src)
+	require.NoError(t, err)
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, mode)
+	require.NoError(t, err)
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	require.NoError(t, err)
+}
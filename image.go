@@ -0,0 +1,512 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	ociIndexName         = "index.json"
+	dockerManifestName   = "manifest.json"
+	ociIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+	dockerListMediaType  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+	containerdImageName  = "io.containerd.image.name"
+
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Image is the filesystem of a container image with its layers applied into a temporary
+// directory, which can be used as the root given to the listers
+type Image struct {
+	// Root is the directory containing the image's filesystem
+	Root string
+	// Digest identifies the image by its manifest digest, for OCI layouts, or config digest,
+	// for docker save tarballs, which is the image ID reported by docker
+	Digest string
+	// Tags are the references of the image declared by the layout or tarball, if any
+	Tags []string
+
+	tempDir string
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	Config ociDescriptor   `json:"config"`
+	Layers []ociDescriptor `json:"layers"`
+}
+
+type dockerManifestEntry struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// ExtractImage applies the layers of the OCI image layout directory, docker save tarball, or
+// tarball of an OCI image layout at imagePath into a temporary directory. No container
+// runtime is needed. The returned Image must be closed to remove the temporary directory.
+func ExtractImage(imagePath string, logger *zap.Logger) (*Image, error) {
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access image: %w", err)
+	}
+
+	tempDir, err := ioutil.TempDir("", "salus-packages-image-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image directory: %w", err)
+	}
+	image := &Image{
+		Root:    filepath.Join(tempDir, "rootfs"),
+		tempDir: tempDir,
+	}
+
+	layoutDir := imagePath
+	if !info.IsDir() {
+		layoutDir = filepath.Join(tempDir, "layout")
+		logger.Debug("unpacking image tarball", zap.String("path", imagePath), zap.String("dir", layoutDir))
+		err = unpackImageTarball(imagePath, layoutDir)
+		if err != nil {
+			image.Close()
+			return nil, err
+		}
+	}
+
+	layers, err := image.readLayout(layoutDir)
+	if err != nil {
+		image.Close()
+		return nil, err
+	}
+
+	err = os.Mkdir(image.Root, 0755)
+	if err != nil {
+		image.Close()
+		return nil, fmt.Errorf("failed to create image root: %w", err)
+	}
+	for _, layer := range layers {
+		logger.Debug("applying image layer", zap.String("path", layer))
+		err = applyLayerFile(layer, image.Root)
+		if err != nil {
+			image.Close()
+			return nil, fmt.Errorf("failed to apply image layer %s: %w", filepath.Base(layer), err)
+		}
+	}
+
+	if layoutDir != imagePath {
+		// the layer blobs are no longer needed, so release the disk space early
+		_ = os.RemoveAll(layoutDir)
+	}
+
+	return image, nil
+}
+
+// Close removes the image's temporary directory
+func (i *Image) Close() error {
+	return os.RemoveAll(i.tempDir)
+}
+
+// ReporterTags provides the tags that identify the image in each reported measurement
+func (i *Image) ReporterTags() map[string]string {
+	tags := map[string]string{
+		LpImageDigestTag: i.Digest,
+	}
+	if len(i.Tags) > 0 {
+		tags[LpImageTag] = i.Tags[0]
+	}
+	return tags
+}
+
+// readLayout determines the image's identity and returns the paths of its layers, bottom-most
+// first. The docker save manifest is preferred since newer docker versions also include
+// an OCI index, but only declare the repository tags in the former.
+func (i *Image) readLayout(layoutDir string) ([]string, error) {
+	if _, err := os.Stat(filepath.Join(layoutDir, dockerManifestName)); err == nil {
+		return i.readDockerManifest(layoutDir)
+	}
+	if _, err := os.Stat(filepath.Join(layoutDir, ociIndexName)); err == nil {
+		return i.readOciIndex(layoutDir)
+	}
+	return nil, errors.New("image is neither an OCI image layout nor a docker save tarball")
+}
+
+func (i *Image) readDockerManifest(layoutDir string) ([]string, error) {
+	var entries []dockerManifestEntry
+	err := readJsonFile(filepath.Join(layoutDir, dockerManifestName), &entries)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("docker manifest declares no images")
+	}
+	if len(entries) > 1 {
+		return nil, fmt.Errorf("docker tarball contains %d images, but only one is supported", len(entries))
+	}
+	entry := entries[0]
+
+	// the config is named by its digest, either as <hex>.json or, in newer versions, blobs/sha256/<hex>
+	configName := strings.TrimSuffix(path.Base(entry.Config), ".json")
+	if strings.Contains(entry.Config, "blobs/") {
+		configName = path.Base(path.Dir(entry.Config)) + ":" + configName
+	} else {
+		configName = "sha256:" + configName
+	}
+	i.Digest = configName
+	i.Tags = entry.RepoTags
+
+	layers := make([]string, 0, len(entry.Layers))
+	for _, layer := range entry.Layers {
+		layers = append(layers, filepath.Join(layoutDir, filepath.FromSlash(path.Clean("/"+layer))))
+	}
+	return layers, nil
+}
+
+func (i *Image) readOciIndex(layoutDir string) ([]string, error) {
+	var index ociIndex
+	err := readJsonFile(filepath.Join(layoutDir, ociIndexName), &index)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptor, err := selectOciManifest(index.Manifests)
+	if err != nil {
+		return nil, err
+	}
+	// a multi-platform image nests an index of the per-platform manifests
+	for descriptor.MediaType == ociIndexMediaType || descriptor.MediaType == dockerListMediaType {
+		var nested ociIndex
+		err = readJsonFile(ociBlobPath(layoutDir, descriptor.Digest), &nested)
+		if err != nil {
+			return nil, err
+		}
+		// the image references are annotated on the outer descriptor
+		annotations := descriptor.Annotations
+		descriptor, err = selectOciManifest(nested.Manifests)
+		if err != nil {
+			return nil, err
+		}
+		if descriptor.Annotations == nil {
+			descriptor.Annotations = annotations
+		}
+	}
+
+	var manifest ociManifest
+	err = readJsonFile(ociBlobPath(layoutDir, descriptor.Digest), &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	i.Digest = descriptor.Digest
+	if name := descriptor.Annotations[containerdImageName]; name != "" {
+		i.Tags = []string{name}
+	} else if name := descriptor.Annotations[ociRefNameAnnotation]; name != "" {
+		i.Tags = []string{name}
+	}
+
+	layers := make([]string, 0, len(manifest.Layers))
+	for _, layer := range manifest.Layers {
+		layers = append(layers, ociBlobPath(layoutDir, layer.Digest))
+	}
+	return layers, nil
+}
+
+// selectOciManifest picks the manifest for the platform of this agent, when the index declares
+// platforms, or otherwise the first manifest
+func selectOciManifest(manifests []ociDescriptor) (ociDescriptor, error) {
+	if len(manifests) == 0 {
+		return ociDescriptor{}, errors.New("image index declares no manifests")
+	}
+	for _, descriptor := range manifests {
+		if descriptor.Platform != nil &&
+			descriptor.Platform.OS == runtime.GOOS && descriptor.Platform.Architecture == runtime.GOARCH {
+			return descriptor, nil
+		}
+	}
+	return manifests[0], nil
+}
+
+func ociBlobPath(layoutDir, digest string) string {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 {
+		return filepath.Join(layoutDir, "blobs", path.Base(digest))
+	}
+	return filepath.Join(layoutDir, "blobs", path.Base(parts[0]), path.Base(parts[1]))
+}
+
+func readJsonFile(path string, v interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", filepath.Base(path), err)
+	}
+	err = json.Unmarshal(content, v)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// unpackImageTarball extracts the regular files of an image tarball, which are the manifests
+// and layer blobs, so that they can be randomly accessed. Links are extracted as hard links to
+// the files they refer to, such as the <id>/layer.tar -> ../<other>/layer.tar of legacy docker
+// save tarballs that share a layer.
+func unpackImageTarball(tarballPath, destDir string) error {
+	file, err := os.Open(tarballPath)
+	if err != nil {
+		return fmt.Errorf("failed to open image tarball: %w", err)
+	}
+	defer file.Close()
+
+	reader, err := decompressedReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to read image tarball: %w", err)
+	}
+
+	// links maps the name of each link to the name it refers to, which is resolved once the
+	// whole tarball has been read since a link can precede its target
+	links := make(map[string]string)
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read image tarball: %w", err)
+		}
+
+		name := path.Clean("/" + header.Name)
+		switch header.Typeflag {
+		case tar.TypeReg:
+			target := filepath.Join(destDir, filepath.FromSlash(name))
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err != nil {
+				return fmt.Errorf("failed to unpack image tarball: %w", err)
+			}
+			err = writeFileFrom(target, tarReader, 0644)
+			if err != nil {
+				return fmt.Errorf("failed to unpack image tarball: %w", err)
+			}
+		case tar.TypeSymlink:
+			if path.IsAbs(header.Linkname) {
+				links[name] = path.Clean(header.Linkname)
+			} else {
+				// joining with the rooted name also confines the link to the tarball
+				links[name] = path.Join(path.Dir(name), header.Linkname)
+			}
+		case tar.TypeLink:
+			links[name] = path.Clean("/" + header.Linkname)
+		}
+	}
+
+	for name, linked := range links {
+		// follow links to links, where the bound stops a cycle
+		for i := 0; i < len(links); i++ {
+			next, ok := links[linked]
+			if !ok {
+				break
+			}
+			linked = next
+		}
+
+		source := filepath.Join(destDir, filepath.FromSlash(linked))
+		if info, err := os.Lstat(source); err != nil || !info.Mode().IsRegular() {
+			// only links to the manifests and layer blobs are needed
+			continue
+		}
+		target := filepath.Join(destDir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err == nil {
+			err = os.Link(source, target)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to unpack image tarball: %w", err)
+		}
+	}
+	return nil
+}
+
+// decompressedReader transparently handles the gzip compressed layers used by registries
+// and the uncompressed layers written by docker save
+func decompressedReader(reader io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(reader)
+	magic, err := buffered.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(magic, gzipMagic) {
+		return gzip.NewReader(buffered)
+	}
+	return buffered, nil
+}
+
+func applyLayerFile(layerPath, root string) error {
+	file, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := decompressedReader(file)
+	if err != nil {
+		return err
+	}
+	return applyLayer(tar.NewReader(reader), root)
+}
+
+// applyLayer writes the entries of a layer tarball into root, where whiteout entries remove
+// the files of the layers beneath. Parent directories are resolved within root, so that a
+// symlink of an earlier layer cannot direct the writes elsewhere. Ownership and device
+// nodes are not applied since they are not needed for reading package databases.
+func applyLayer(tarReader *tar.Reader, root string) error {
+	// an opaque whiteout only hides the content of lower layers, so track what this layer wrote
+	written := make(map[string]bool)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean("/" + header.Name)
+		if name == "/" {
+			continue
+		}
+		parent := rootedPath(root, path.Dir(name))
+		base := path.Base(name)
+
+		if base == whiteoutOpaque {
+			err = removeOpaqueContent(parent, written)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			err = os.RemoveAll(filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix)))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = os.MkdirAll(parent, 0755)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(parent, base)
+		written[target] = true
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+				if err := os.Remove(target); err != nil {
+					return err
+				}
+			}
+			err = os.MkdirAll(target, 0755)
+			if err == nil {
+				// the owner needs access to write the content of later layers
+				err = os.Chmod(target, os.FileMode(header.Mode).Perm()|0700)
+			}
+		case tar.TypeReg:
+			err = os.RemoveAll(target)
+			if err == nil {
+				err = writeFileFrom(target, tarReader, os.FileMode(header.Mode).Perm()|0600)
+			}
+		case tar.TypeSymlink:
+			err = os.RemoveAll(target)
+			if err == nil {
+				err = os.Symlink(header.Linkname, target)
+			}
+		case tar.TypeLink:
+			err = os.RemoveAll(target)
+			if err == nil {
+				err = os.Link(rootedPath(root, path.Clean("/"+header.Linkname)), target)
+			}
+		default:
+			// devices, fifos, and the like
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+}
+
+func removeOpaqueContent(dir string, written map[string]bool) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		child := filepath.Join(dir, entry.Name())
+		if !written[child] {
+			if err := os.RemoveAll(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeFileFrom(target string, reader io.Reader, mode os.FileMode) error {
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, reader)
+	closeErr := out.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
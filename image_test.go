@@ -0,0 +1,338 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// layerEntry declares a file of a layer tarball built by the tests, where a non-empty link
+// declares a symlink or, with hardLink, a hard link
+type layerEntry struct {
+	name     string
+	content  []byte
+	link     string
+	hardLink bool
+	dir      bool
+}
+
+func buildLayer(t *testing.T, entries []layerEntry, compress bool) []byte {
+	var buf bytes.Buffer
+	var gzipWriter *gzip.Writer
+	var tarWriter *tar.Writer
+	if compress {
+		gzipWriter = gzip.NewWriter(&buf)
+		tarWriter = tar.NewWriter(gzipWriter)
+	} else {
+		tarWriter = tar.NewWriter(&buf)
+	}
+
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.content))}
+		switch {
+		case entry.dir:
+			header.Typeflag = tar.TypeDir
+			header.Mode = 0755
+		case entry.link != "" && entry.hardLink:
+			header.Typeflag = tar.TypeLink
+			header.Linkname = entry.link
+		case entry.link != "":
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = entry.link
+		default:
+			header.Typeflag = tar.TypeReg
+		}
+		require.NoError(t, tarWriter.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := tarWriter.Write(entry.content)
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, tarWriter.Close())
+	if gzipWriter != nil {
+		require.NoError(t, gzipWriter.Close())
+	}
+	return buf.Bytes()
+}
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func mustJson(t *testing.T, v interface{}) []byte {
+	content, err := json.Marshal(v)
+	require.NoError(t, err)
+	return content
+}
+
+func readTestdata(t *testing.T, elem ...string) []byte {
+	content, err := ioutil.ReadFile(filepath.Join(append([]string{"testdata"}, elem...)...))
+	require.NoError(t, err)
+	return content
+}
+
+// writeTarball writes the given files, keyed by name, into an uncompressed tarball
+func writeTarball(t *testing.T, path string, names []string, files map[string][]byte) {
+	var entries []layerEntry
+	for _, name := range names {
+		entries = append(entries, layerEntry{name: name, content: files[name]})
+	}
+	require.NoError(t, ioutil.WriteFile(path, buildLayer(t, entries, false), 0644))
+}
+
+// buildDockerSave writes a tarball in the format of docker save and returns the config digest
+func buildDockerSave(t *testing.T, path string, repoTags []string, layers ...[]byte) string {
+	files := make(map[string][]byte)
+	var names []string
+
+	config := mustJson(t, map[string]string{"architecture": "amd64", "os": "linux"})
+	configName := sha256Hex(config) + ".json"
+	files[configName] = config
+	names = append(names, configName)
+
+	var layerNames []string
+	for _, layer := range layers {
+		layerName := sha256Hex(layer) + "/layer.tar"
+		files[layerName] = layer
+		names = append(names, layerName)
+		layerNames = append(layerNames, layerName)
+	}
+
+	files[dockerManifestName] = mustJson(t, []dockerManifestEntry{{
+		Config:   configName,
+		RepoTags: repoTags,
+		Layers:   layerNames,
+	}})
+	names = append(names, dockerManifestName)
+
+	writeTarball(t, path, names, files)
+	return "sha256:" + sha256Hex(config)
+}
+
+// buildOciLayout writes the blobs, index, and oci-layout of an OCI image layout into dir and
+// returns the manifest digest
+func buildOciLayout(t *testing.T, dir string, imageName string, layers ...[]byte) string {
+	blobsDir := filepath.Join(dir, "blobs", "sha256")
+	require.NoError(t, os.MkdirAll(blobsDir, 0755))
+	writeBlob := func(content []byte) string {
+		digest := sha256Hex(content)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(blobsDir, digest), content, 0644))
+		return "sha256:" + digest
+	}
+
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.oci.image.config.v1+json",
+			"digest":    writeBlob(mustJson(t, map[string]string{"architecture": "amd64", "os": "linux"})),
+		},
+	}
+	var layerDescriptors []map[string]interface{}
+	for _, layer := range layers {
+		layerDescriptors = append(layerDescriptors, map[string]interface{}{
+			"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
+			"digest":    writeBlob(layer),
+		})
+	}
+	manifest["layers"] = layerDescriptors
+	manifestDigest := writeBlob(mustJson(t, manifest))
+
+	index := map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []map[string]interface{}{{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest":    manifestDigest,
+			"annotations": map[string]string{
+				containerdImageName:  imageName,
+				ociRefNameAnnotation: "1.0",
+			},
+		}},
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ociIndexName), mustJson(t, index), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644))
+
+	return manifestDigest
+}
+
+func assertNotExists(t *testing.T, path string) {
+	_, err := os.Lstat(path)
+	assert.True(t, os.IsNotExist(err), "%s should not exist", path)
+}
+
+func TestExtractImage_dockerSaveDeb(t *testing.T) {
+	base := buildLayer(t, []layerEntry{
+		{name: "etc/", dir: true},
+		{name: "etc/removed.conf", content: []byte("removed")},
+		{name: "opt/cache/stale", content: []byte("stale")},
+		{name: "var/lib/dpkg/status", content: readTestdata(t, "dpkg", "status")},
+	}, false)
+	upper := buildLayer(t, []layerEntry{
+		{name: "etc/.wh.removed.conf"},
+		{name: "opt/cache/fresh", content: []byte("fresh")},
+		{name: "opt/cache/.wh..wh..opq"},
+	}, false)
+
+	tarballPath := filepath.Join(t.TempDir(), "image.tar")
+	configDigest := buildDockerSave(t, tarballPath, []string{"example/deb:1.0"}, base, upper)
+
+	image, err := ExtractImage(tarballPath, zap.NewNop())
+	require.NoError(t, err)
+	defer image.Close()
+
+	assert.Equal(t, configDigest, image.Digest)
+	assert.Equal(t, map[string]string{
+		LpImageDigestTag: configDigest,
+		LpImageTag:       "example/deb:1.0",
+	}, image.ReporterTags())
+
+	assertNotExists(t, filepath.Join(image.Root, "etc", "removed.conf"))
+	assertNotExists(t, filepath.Join(image.Root, "opt", "cache", "stale"))
+	// the opaque whiteout only hides the lower layers
+	assert.FileExists(t, filepath.Join(image.Root, "opt", "cache", "fresh"))
+
+	lister := DebianLister(image.Root, zap.NewNop())
+	require.True(t, lister.IsSupported())
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, packages, 6)
+
+	require.NoError(t, image.Close())
+	assertNotExists(t, image.Root)
+}
+
+func TestExtractImage_ociLayoutRpm(t *testing.T) {
+	base := buildLayer(t, []layerEntry{
+		{name: "usr/lib/sysimage/rpm/rpmdb.sqlite", content: readTestdata(t, "rpmdb-sqlite", "rpmdb.sqlite")},
+	}, true)
+	// the absolute symlink must resolve within the image rather than the host
+	upper := buildLayer(t, []layerEntry{
+		{name: "var/lib/", dir: true},
+		{name: "var/lib/rpm", link: "/usr/lib/sysimage/rpm"},
+	}, true)
+
+	layoutDir := t.TempDir()
+	manifestDigest := buildOciLayout(t, layoutDir, "registry.example.com/rpm:1.0", base, upper)
+
+	image, err := ExtractImage(layoutDir, zap.NewNop())
+	require.NoError(t, err)
+	defer image.Close()
+
+	assert.Equal(t, manifestDigest, image.Digest)
+	assert.Equal(t, []string{"registry.example.com/rpm:1.0"}, image.Tags)
+
+	lister := RpmdbLister(image.Root, zap.NewNop())
+	require.True(t, lister.IsSupported())
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, packages, 45)
+
+	// the layout directory given is left as is
+	assert.FileExists(t, filepath.Join(layoutDir, ociIndexName))
+}
+
+func TestExtractImage_ociTarballApk(t *testing.T) {
+	base := buildLayer(t, []layerEntry{
+		{name: "lib/apk/db/installed", content: readTestdata(t, "apk", "installed")},
+		{name: "etc", link: "/elsewhere"},
+	}, true)
+	// neither can be written outside of the image's root
+	upper := buildLayer(t, []layerEntry{
+		{name: "../../escaped", content: []byte("escaped")},
+		{name: "etc/hostname", content: []byte("apk")},
+	}, true)
+
+	layoutDir := t.TempDir()
+	manifestDigest := buildOciLayout(t, layoutDir, "example/apk:1.0", base, upper)
+
+	var names []string
+	files := make(map[string][]byte)
+	err := filepath.Walk(layoutDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(layoutDir, path)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		names = append(names, filepath.ToSlash(rel))
+		files[filepath.ToSlash(rel)] = content
+		return err
+	})
+	require.NoError(t, err)
+	tarballPath := filepath.Join(t.TempDir(), "image.tar")
+	writeTarball(t, tarballPath, names, files)
+
+	image, err := ExtractImage(tarballPath, zap.NewNop())
+	require.NoError(t, err)
+	defer image.Close()
+
+	assert.Equal(t, manifestDigest, image.Digest)
+	assert.FileExists(t, filepath.Join(image.Root, "escaped"))
+	assert.FileExists(t, filepath.Join(image.Root, "elsewhere", "hostname"))
+
+	lister := AlpineLister(image.Root, zap.NewNop())
+	require.True(t, lister.IsSupported())
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, packages, 3)
+}
+
+func TestUnpackImageTarball_links(t *testing.T) {
+	dir := t.TempDir()
+	tarballPath := filepath.Join(dir, "image.tar")
+	require.NoError(t, ioutil.WriteFile(tarballPath, buildLayer(t, []layerEntry{
+		// the link precedes its target, as seen in legacy docker save tarballs
+		{name: "bbb/layer.tar", link: "../aaa/layer.tar"},
+		{name: "aaa/layer.tar", content: []byte("shared layer")},
+		{name: "ccc/layer.tar", link: "aaa/layer.tar", hardLink: true},
+		{name: "ddd/layer.tar", link: "../bbb/layer.tar"},
+		{name: "escape", link: "../../../etc/hostname"},
+	}, false), 0644))
+
+	destDir := filepath.Join(dir, "unpacked")
+	require.NoError(t, unpackImageTarball(tarballPath, destDir))
+
+	for _, name := range []string{"aaa", "bbb", "ccc", "ddd"} {
+		content, err := ioutil.ReadFile(filepath.Join(destDir, name, "layer.tar"))
+		require.NoError(t, err, name)
+		assert.Equal(t, "shared layer", string(content), name)
+	}
+	// the link is confined to the tarball, where it refers to nothing
+	assertNotExists(t, filepath.Join(destDir, "escape"))
+}
+
+func TestExtractImage_notAnImage(t *testing.T) {
+	_, err := ExtractImage(filepath.Join("testdata", "apk"), zap.NewNop())
+	assert.EqualError(t, err, "image is neither an OCI image layout nor a docker save tarball")
+}
@@ -0,0 +1,367 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"sync"
+	"time"
+)
+
+// jsonFailure is the failure of a package system, including the details of a failed package
+// manager command or timeout, when available
+type jsonFailure struct {
+	Error    string `json:"error"`
+	TimedOut bool   `json:"timed-out,omitempty"`
+	Command  string `json:"command,omitempty"`
+	ExitCode *int   `json:"exit-code,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+}
+
+func newJsonFailure(err error) *jsonFailure {
+	failure := &jsonFailure{Error: err.Error()}
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		failure.TimedOut = true
+	}
+	var packageManagerErr *PackageManagerError
+	if errors.As(err, &packageManagerErr) {
+		failure.Command = packageManagerErr.Command
+		if packageManagerErr.ExitCode >= 0 {
+			exitCode := packageManagerErr.ExitCode
+			failure.ExitCode = &exitCode
+		}
+		failure.Stderr = packageManagerErr.Stderr
+	}
+	return failure
+}
+
+// jsonReporter writes each batch as a single JSON document, followed by a newline, once the
+// batch is closed
+type jsonReporter struct {
+	// mu serializes the writing of the batches of concurrent configs
+	mu       *sync.Mutex
+	out      io.Writer
+	hostname string
+	logger   *zap.Logger
+}
+
+// NewJsonReporter creates a reporter that writes each batch to out as a JSON document
+func NewJsonReporter(out io.Writer, hostname string, logger *zap.Logger) PackagesReporter {
+	return &jsonReporter{mu: &sync.Mutex{}, out: out, hostname: hostname, logger: logger}
+}
+
+type jsonBatchDocument struct {
+	Timestamp time.Time           `json:"timestamp"`
+	Hostname  string              `json:"hostname"`
+	Tags      map[string]string   `json:"tags,omitempty"`
+	OsInfo    *OsInfo             `json:"os-info,omitempty"`
+	Systems   []*jsonSystemResult `json:"systems"`
+}
+
+// jsonSystemResult combines everything reported for a package system within a batch
+type jsonSystemResult struct {
+	System           string                 `json:"system"`
+	Packages         []SoftwarePackage      `json:"packages,omitempty"`
+	Changes          []PackageChange        `json:"changes,omitempty"`
+	Failure          *jsonFailure           `json:"failure,omitempty"`
+	Skipped          bool                   `json:"skipped,omitempty"`
+	MalformedRecords int                    `json:"malformed-records,omitempty"`
+	Vulnerabilities  []PackageVulnerability `json:"vulnerabilities,omitempty"`
+}
+
+func (j *jsonReporter) StartBatch(timestamp time.Time, tags map[string]string) PackagesReporterBatch {
+	return &jsonReporterBatch{
+		reporter: j,
+		document: jsonBatchDocument{
+			Timestamp: timestamp,
+			Hostname:  j.hostname,
+			Tags:      tags,
+			Systems:   []*jsonSystemResult{},
+		},
+	}
+}
+
+type jsonReporterBatch struct {
+	reporter *jsonReporter
+	document jsonBatchDocument
+}
+
+// system returns the result of the package system, adding it in the order first reported
+func (j *jsonReporterBatch) system(system string) *jsonSystemResult {
+	for _, result := range j.document.Systems {
+		if result.System == system {
+			return result
+		}
+	}
+	result := &jsonSystemResult{System: system}
+	j.document.Systems = append(j.document.Systems, result)
+	return result
+}
+
+func (j *jsonReporterBatch) ReportSuccess(system string, packages []SoftwarePackage) {
+	// an empty inventory is still reported as an empty list
+	if packages == nil {
+		packages = []SoftwarePackage{}
+	}
+	j.system(system).Packages = packages
+}
+
+func (j *jsonReporterBatch) ReportChanges(system string, changes []PackageChange) {
+	j.system(system).Changes = changes
+}
+
+func (j *jsonReporterBatch) ReportFailure(system string, err error) {
+	j.system(system).Failure = newJsonFailure(err)
+}
+
+func (j *jsonReporterBatch) ReportCollection(system string, summary CollectionSummary) {
+	result := j.system(system)
+	result.Skipped = summary.Skipped
+	result.MalformedRecords = summary.MalformedRecords
+}
+
+func (j *jsonReporterBatch) ReportVulnerabilities(system string, vulnerabilities []PackageVulnerability) {
+	j.system(system).Vulnerabilities = vulnerabilities
+}
+
+func (j *jsonReporterBatch) ReportOsInfo(info OsInfo) {
+	j.document.OsInfo = &info
+}
+
+func (j *jsonReporterBatch) Close() error {
+	j.reporter.mu.Lock()
+	defer j.reporter.mu.Unlock()
+
+	encoder := json.NewEncoder(j.reporter.out)
+	// purls are more readable without escaping their ampersands
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(j.document)
+	if err != nil {
+		return fmt.Errorf("failed to write JSON document: %w", err)
+	}
+	return nil
+}
+
+// Types of the records written by the NDJSON reporter
+const (
+	NdjsonBatchStartRecord = "batch-start"
+	NdjsonPackageRecord    = "package"
+	NdjsonChangeRecord     = "change"
+	NdjsonFailureRecord    = "failure"
+	NdjsonCollectionRecord = "collection"
+	NdjsonOsInfoRecord     = "os-info"
+	NdjsonVulnerableRecord = "vulnerability"
+	NdjsonBatchEndRecord   = "batch-end"
+)
+
+// ndjsonReporter writes each batch as newline delimited JSON records, which are a header
+// record, a record for the operating system and per package, change, failure, or vulnerability,
+// and a footer record. Every record identifies its batch by timestamp and hostname so that it can be
+// consumed on its own.
+type ndjsonReporter struct {
+	// mu serializes the writing of records by concurrent configs
+	mu       *sync.Mutex
+	out      io.Writer
+	hostname string
+	logger   *zap.Logger
+}
+
+// NewNdjsonReporter creates a reporter that writes each batch to out as newline delimited
+// JSON records
+func NewNdjsonReporter(out io.Writer, hostname string, logger *zap.Logger) PackagesReporter {
+	return &ndjsonReporter{mu: &sync.Mutex{}, out: out, hostname: hostname, logger: logger}
+}
+
+type ndjsonRecordHeader struct {
+	Type      string            `json:"type"`
+	Timestamp time.Time         `json:"timestamp"`
+	Hostname  string            `json:"hostname"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+type ndjsonPackage struct {
+	ndjsonRecordHeader
+	System string `json:"system"`
+	SoftwarePackage
+}
+
+type ndjsonChange struct {
+	ndjsonRecordHeader
+	System string `json:"system"`
+	PackageChange
+}
+
+type ndjsonFailure struct {
+	ndjsonRecordHeader
+	System string `json:"system"`
+	*jsonFailure
+}
+
+type ndjsonCollection struct {
+	ndjsonRecordHeader
+	System           string `json:"system"`
+	Skipped          bool   `json:"skipped"`
+	MalformedRecords int    `json:"malformed-records,omitempty"`
+}
+
+type ndjsonOsInfo struct {
+	ndjsonRecordHeader
+	OsInfo OsInfo `json:"os-info"`
+}
+
+type ndjsonVulnerability struct {
+	ndjsonRecordHeader
+	System string `json:"system"`
+	PackageVulnerability
+}
+
+type ndjsonBatchEnd struct {
+	ndjsonRecordHeader
+	Packages int `json:"packages"`
+	Changes  int `json:"changes"`
+	Failures int `json:"failures"`
+	// Vulnerabilities is only counted when matching against a vulnerability database
+	Vulnerabilities int `json:"vulnerabilities,omitempty"`
+}
+
+func (n *ndjsonReporter) StartBatch(timestamp time.Time, tags map[string]string) PackagesReporterBatch {
+	batch := &ndjsonReporterBatch{reporter: n, timestamp: timestamp, tags: tags}
+	batch.write(batch.header(NdjsonBatchStartRecord))
+	return batch
+}
+
+type ndjsonReporterBatch struct {
+	reporter        *ndjsonReporter
+	timestamp       time.Time
+	tags            map[string]string
+	packages        int
+	changes         int
+	failures        int
+	vulnerabilities int
+	// err is the first failure to write a record
+	err error
+}
+
+func (n *ndjsonReporterBatch) header(recordType string) ndjsonRecordHeader {
+	return ndjsonRecordHeader{
+		Type:      recordType,
+		Timestamp: n.timestamp,
+		Hostname:  n.reporter.hostname,
+		Tags:      n.tags,
+	}
+}
+
+func (n *ndjsonReporterBatch) write(records ...interface{}) {
+	n.reporter.mu.Lock()
+	defer n.reporter.mu.Unlock()
+
+	encoder := json.NewEncoder(n.reporter.out)
+	encoder.SetEscapeHTML(false)
+	for _, record := range records {
+		err := encoder.Encode(record)
+		if err != nil {
+			n.reporter.logger.Error("failed to write NDJSON record", zap.Error(err))
+			if n.err == nil {
+				n.err = err
+			}
+			return
+		}
+	}
+}
+
+func (n *ndjsonReporterBatch) ReportSuccess(system string, packages []SoftwarePackage) {
+	records := make([]interface{}, 0, len(packages))
+	for _, pkg := range packages {
+		records = append(records, ndjsonPackage{
+			ndjsonRecordHeader: n.header(NdjsonPackageRecord),
+			System:             system,
+			SoftwarePackage:    pkg,
+		})
+	}
+	n.packages += len(packages)
+	n.write(records...)
+}
+
+func (n *ndjsonReporterBatch) ReportChanges(system string, changes []PackageChange) {
+	records := make([]interface{}, 0, len(changes))
+	for _, change := range changes {
+		records = append(records, ndjsonChange{
+			ndjsonRecordHeader: n.header(NdjsonChangeRecord),
+			System:             system,
+			PackageChange:      change,
+		})
+	}
+	n.changes += len(changes)
+	n.write(records...)
+}
+
+func (n *ndjsonReporterBatch) ReportFailure(system string, err error) {
+	n.failures++
+	n.write(ndjsonFailure{
+		ndjsonRecordHeader: n.header(NdjsonFailureRecord),
+		System:             system,
+		jsonFailure:        newJsonFailure(err),
+	})
+}
+
+func (n *ndjsonReporterBatch) ReportCollection(system string, summary CollectionSummary) {
+	n.write(ndjsonCollection{
+		ndjsonRecordHeader: n.header(NdjsonCollectionRecord),
+		System:             system,
+		Skipped:            summary.Skipped,
+		MalformedRecords:   summary.MalformedRecords,
+	})
+}
+
+func (n *ndjsonReporterBatch) ReportVulnerabilities(system string, vulnerabilities []PackageVulnerability) {
+	records := make([]interface{}, 0, len(vulnerabilities))
+	for _, vulnerability := range vulnerabilities {
+		records = append(records, ndjsonVulnerability{
+			ndjsonRecordHeader:   n.header(NdjsonVulnerableRecord),
+			System:               system,
+			PackageVulnerability: vulnerability,
+		})
+	}
+	n.vulnerabilities += len(vulnerabilities)
+	n.write(records...)
+}
+
+func (n *ndjsonReporterBatch) ReportOsInfo(info OsInfo) {
+	n.write(ndjsonOsInfo{
+		ndjsonRecordHeader: n.header(NdjsonOsInfoRecord),
+		OsInfo:             info,
+	})
+}
+
+func (n *ndjsonReporterBatch) Close() error {
+	n.write(ndjsonBatchEnd{
+		ndjsonRecordHeader: n.header(NdjsonBatchEndRecord),
+		Packages:           n.packages,
+		Changes:            n.changes,
+		Failures:           n.failures,
+		Vulnerabilities:    n.vulnerabilities,
+	})
+	if n.err != nil {
+		return fmt.Errorf("failed to write NDJSON records: %w", n.err)
+	}
+	return nil
+}
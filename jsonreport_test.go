@@ -0,0 +1,128 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestJsonReporter(t *testing.T) {
+	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	reporter := NewJsonReporter(&out, "web-1", zap.NewNop())
+	batch := reporter.StartBatch(timestamp, map[string]string{"image": "alpine:3.18"})
+
+	batch.ReportOsInfo(OsInfo{
+		Distro: &OsRelease{ID: "alpine", VersionID: "3.18.4", PrettyName: "Alpine Linux v3.18"},
+		Arch:   "x86_64",
+	})
+	batch.ReportSuccess("rpm", []SoftwarePackage{
+		{Name: "tzdata", Version: "2019a-1.el8", Arch: "noarch", License: "Public Domain"},
+	})
+	batch.ReportVulnerabilities("rpm", []PackageVulnerability{
+		{Name: "tzdata", Version: "2019a-1.el8", Arch: "noarch", Id: "RLSA-2019:1234", FixedVersion: "2019c-1.el8"},
+	})
+	batch.ReportChanges("rpm", []PackageChange{
+		{Change: PackageUpgraded, Name: "tzdata", Arch: "noarch", OldVersion: "2018i-1.el8", NewVersion: "2019a-1.el8"},
+	})
+	batch.ReportFailure("debian", fmt.Errorf("failed to run package manager: %w", &PackageManagerError{
+		Command:  "dpkg-query --show",
+		ExitCode: 2,
+		Stderr:   "dpkg-query: error: parsing file",
+		Err:      errors.New("exit status 2"),
+	}))
+	batch.ReportCollection("apk", CollectionSummary{Skipped: true})
+
+	// nothing is written until the document is complete
+	assert.Empty(t, out.String())
+	require.NoError(t, batch.Close())
+
+	assert.JSONEq(t, `{
+  "timestamp": "2006-01-02T15:04:05Z",
+  "hostname": "web-1",
+  "tags": {"image": "alpine:3.18"},
+  "os-info": {
+    "distro": {"id": "alpine", "version-id": "3.18.4", "pretty-name": "Alpine Linux v3.18"},
+    "arch": "x86_64"
+  },
+  "systems": [
+    {
+      "system": "rpm",
+      "packages": [{"name": "tzdata", "version": "2019a-1.el8", "arch": "noarch", "license": "Public Domain"}],
+      "changes": [{"change": "upgraded", "name": "tzdata", "arch": "noarch", "old-version": "2018i-1.el8", "new-version": "2019a-1.el8"}],
+      "vulnerabilities": [{"name": "tzdata", "version": "2019a-1.el8", "arch": "noarch", "id": "RLSA-2019:1234", "fixed-version": "2019c-1.el8"}]
+    },
+    {
+      "system": "debian",
+      "failure": {
+        "error": "failed to run package manager: exit status 2",
+        "command": "dpkg-query --show",
+        "exit-code": 2,
+        "stderr": "dpkg-query: error: parsing file"
+      }
+    },
+    {"system": "apk", "skipped": true}
+  ]
+}`, out.String())
+}
+
+func TestNdjsonReporter(t *testing.T) {
+	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	reporter := NewNdjsonReporter(&out, "web-1", zap.NewNop())
+	batch := reporter.StartBatch(timestamp, nil)
+
+	batch.ReportOsInfo(OsInfo{
+		Distro:   &OsRelease{ID: "rocky", VersionID: "8.9"},
+		Hostname: "web-1.example.com",
+	})
+	batch.ReportSuccess("rpm", []SoftwarePackage{
+		{Name: "tzdata", Version: "2019a-1.el8", Arch: "noarch"},
+		{Name: "dbus-common", Version: "1:1.12.8-7.el8", Arch: "noarch", Epoch: "1",
+			Purl: "pkg:rpm/dbus-common@1.12.8-7.el8?arch=noarch&epoch=1"},
+	})
+	batch.ReportVulnerabilities("rpm", []PackageVulnerability{
+		{Name: "dbus-common", Version: "1:1.12.8-7.el8", Arch: "noarch", Id: "RLSA-2023:3106",
+			Aliases: []string{"CVE-2023-34969"}, Severity: "moderate", FixedVersion: "1:1.12.8-24.el8_8.1"},
+	})
+	batch.ReportChanges("rpm", []PackageChange{
+		{Change: PackageRemoved, Name: "curl", Arch: "x86_64", OldVersion: "7.61.1-8.el8"},
+	})
+	batch.ReportFailure("debian", &TimeoutError{System: "debian", Timeout: time.Minute})
+	require.NoError(t, batch.Close())
+
+	assert.Equal(t, `{"type":"batch-start","timestamp":"2006-01-02T15:04:05Z","hostname":"web-1"}
+{"type":"os-info","timestamp":"2006-01-02T15:04:05Z","hostname":"web-1","os-info":{"distro":{"id":"rocky","version-id":"8.9"},"hostname":"web-1.example.com"}}
+{"type":"package","timestamp":"2006-01-02T15:04:05Z","hostname":"web-1","system":"rpm","name":"tzdata","version":"2019a-1.el8","arch":"noarch"}
+{"type":"package","timestamp":"2006-01-02T15:04:05Z","hostname":"web-1","system":"rpm","name":"dbus-common","version":"1:1.12.8-7.el8","arch":"noarch","purl":"pkg:rpm/dbus-common@1.12.8-7.el8?arch=noarch&epoch=1","epoch":"1"}
+{"type":"vulnerability","timestamp":"2006-01-02T15:04:05Z","hostname":"web-1","system":"rpm","name":"dbus-common","version":"1:1.12.8-7.el8","arch":"noarch","id":"RLSA-2023:3106","aliases":["CVE-2023-34969"],"severity":"moderate","fixed-version":"1:1.12.8-24.el8_8.1"}
+{"type":"change","timestamp":"2006-01-02T15:04:05Z","hostname":"web-1","system":"rpm","change":"removed","name":"curl","arch":"x86_64","old-version":"7.61.1-8.el8"}
+{"type":"failure","timestamp":"2006-01-02T15:04:05Z","hostname":"web-1","system":"debian","error":"listing debian packages timed out after 1m0s","timed-out":true}
+{"type":"batch-end","timestamp":"2006-01-02T15:04:05Z","hostname":"web-1","packages":2,"changes":1,"failures":1,"vulnerabilities":1}
+`, out.String())
+}
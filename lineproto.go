@@ -19,22 +19,60 @@ package packagesagent
 import (
 	"bytes"
 	"context"
+	"errors"
 	protocol "github.com/influxdata/line-protocol"
 	lpsender "github.com/itzg/line-protocol-sender"
 	"go.uber.org/zap"
 	"io"
 	"os"
+	"strings"
 	"time"
 )
 
 const (
-	LpMeasurementName        = "packages"
-	LpMeasurementFailureName = "packages_failed"
-	LpSystemTag              = "system"
-	LpPackageTag             = "package"
-	LpArchTag                = "arch"
-	LpVersionField           = "version"
-	LpErrorField             = "error"
+	LpMeasurementName           = "packages"
+	LpMeasurementFailureName    = "packages_failed"
+	LpMeasurementChangesName    = "packages_changes"
+	LpMeasurementCollectionName = "packages_collection"
+	LpMeasurementOsInfoName     = "os_info"
+	LpMeasurementVulnerableName = "packages_vulnerable"
+	LpSystemTag                 = "system"
+	LpPackageTag                = "package"
+	LpArchTag                   = "arch"
+	LpLocationTag               = "location"
+	LpChangeTag                 = "change"
+	LpAdvisoryTag               = "advisory"
+	LpImageTag                  = "image"
+	LpImageDigestTag            = "image_digest"
+	LpVersionField              = "version"
+	LpErrorField                = "error"
+	LpTimedOutField             = "timed_out"
+	LpOldVersionField           = "old_version"
+	LpNewVersionField           = "new_version"
+	LpSkippedField              = "skipped"
+	LpMalformedRecordsField     = "malformed_records"
+	LpExitCodeField             = "exit_code"
+	LpStderrField               = "stderr"
+	LpCommandField              = "command"
+	LpEpochField                = "epoch"
+	LpInstallTimeField          = "install_time"
+	LpInstalledSizeField        = "installed_size"
+	LpVendorField               = "vendor"
+	LpSourcePackageField        = "source_package"
+	LpLicenseField              = "license"
+	LpSummaryField              = "summary"
+	LpPurlField                 = "purl"
+	LpOsIdField                 = "os_id"
+	LpOsVersionField            = "os_version"
+	LpOsCodenameField           = "os_codename"
+	LpOsPrettyNameField         = "os_pretty_name"
+	LpKernelReleaseField        = "kernel_release"
+	LpOsArchField               = "arch"
+	LpHostnameField             = "hostname"
+	LpMachineIdField            = "machine_id"
+	LpSeverityField             = "severity"
+	LpFixedVersionField         = "fixed_version"
+	LpAliasesField              = "aliases"
 
 	// Follow the pattern of telegraf's --test option and use their same prefix
 	// It allows Envoy to differentiate metric lines from logs, etc in consuming of stdout
@@ -52,12 +90,13 @@ type lineProtocolConsoleReporter struct {
 	logger *zap.Logger
 }
 
-func (l *lineProtocolConsoleReporter) StartBatch(timestamp time.Time) PackagesReporterBatch {
-	return &lineProtocolConsoleBatch{timestamp: timestamp, out: l.out, logger: l.logger}
+func (l *lineProtocolConsoleReporter) StartBatch(timestamp time.Time, tags map[string]string) PackagesReporterBatch {
+	return &lineProtocolConsoleBatch{timestamp: timestamp, tags: tags, out: l.out, logger: l.logger}
 }
 
 type lineProtocolConsoleBatch struct {
 	timestamp time.Time
+	tags      map[string]string
 	logger    *zap.Logger
 	out       io.Writer
 }
@@ -68,7 +107,7 @@ func (l *lineProtocolConsoleBatch) Close() error {
 }
 
 func (l *lineProtocolConsoleBatch) ReportSuccess(system string, packages []SoftwarePackage) {
-	metrics := buildLineProtocolMetrics(l.timestamp, system, packages)
+	metrics := buildLineProtocolMetrics(l.timestamp, l.tags, system, packages)
 
 	var buf bytes.Buffer
 
@@ -93,13 +132,52 @@ func (l *lineProtocolConsoleBatch) writeMetric(buf *bytes.Buffer, metric *lpsend
 	}
 }
 
+func (l *lineProtocolConsoleBatch) ReportChanges(system string, changes []PackageChange) {
+	metrics := buildLineProtocolChangeMetrics(l.timestamp, l.tags, system, changes)
+
+	var buf bytes.Buffer
+
+	for _, metric := range metrics {
+		buf.Reset()
+		l.writeMetric(&buf, metric)
+	}
+}
+
 func (l *lineProtocolConsoleBatch) ReportFailure(system string, err error) {
-	metric := buildLineProtocolFailureMetric(l.timestamp, system, err)
+	metric := buildLineProtocolFailureMetric(l.timestamp, l.tags, system, err)
+
+	var buf bytes.Buffer
+	l.writeMetric(&buf, metric)
+}
+
+func (l *lineProtocolConsoleBatch) ReportCollection(system string, summary CollectionSummary) {
+	metric := buildLineProtocolCollectionMetric(l.timestamp, l.tags, system, summary)
+
+	var buf bytes.Buffer
+	l.writeMetric(&buf, metric)
+}
+
+func (l *lineProtocolConsoleBatch) ReportOsInfo(info OsInfo) {
+	metric := buildLineProtocolOsInfoMetric(l.timestamp, l.tags, info)
+	if metric == nil {
+		return
+	}
 
 	var buf bytes.Buffer
 	l.writeMetric(&buf, metric)
 }
 
+func (l *lineProtocolConsoleBatch) ReportVulnerabilities(system string, vulnerabilities []PackageVulnerability) {
+	metrics := buildLineProtocolVulnerabilityMetrics(l.timestamp, l.tags, system, vulnerabilities)
+
+	var buf bytes.Buffer
+
+	for _, metric := range metrics {
+		buf.Reset()
+		l.writeMetric(&buf, metric)
+	}
+}
+
 type lineProtocolSocketReporter struct {
 	logger *zap.Logger
 	client lpsender.Client
@@ -125,15 +203,17 @@ func NewLineProtocolSocketReporter(ctx context.Context, endpoint string, logger
 	}, nil
 }
 
-func (l *lineProtocolSocketReporter) StartBatch(timestamp time.Time) PackagesReporterBatch {
+func (l *lineProtocolSocketReporter) StartBatch(timestamp time.Time, tags map[string]string) PackagesReporterBatch {
 	return &lineProtocolSocketBatch{
 		timestamp: timestamp,
+		tags:      tags,
 		client:    l.client,
 	}
 }
 
 type lineProtocolSocketBatch struct {
 	timestamp time.Time
+	tags      map[string]string
 	client    lpsender.Client
 }
 
@@ -143,18 +223,44 @@ func (l *lineProtocolSocketBatch) Close() error {
 }
 
 func (l *lineProtocolSocketBatch) ReportSuccess(system string, packages []SoftwarePackage) {
-	metrics := buildLineProtocolMetrics(l.timestamp, system, packages)
+	metrics := buildLineProtocolMetrics(l.timestamp, l.tags, system, packages)
+	for _, metric := range metrics {
+		l.client.Send(metric)
+	}
+}
+
+func (l *lineProtocolSocketBatch) ReportChanges(system string, changes []PackageChange) {
+	metrics := buildLineProtocolChangeMetrics(l.timestamp, l.tags, system, changes)
 	for _, metric := range metrics {
 		l.client.Send(metric)
 	}
 }
 
 func (l *lineProtocolSocketBatch) ReportFailure(system string, err error) {
-	metric := buildLineProtocolFailureMetric(l.timestamp, system, err)
+	metric := buildLineProtocolFailureMetric(l.timestamp, l.tags, system, err)
+	l.client.Send(metric)
+}
+
+func (l *lineProtocolSocketBatch) ReportCollection(system string, summary CollectionSummary) {
+	metric := buildLineProtocolCollectionMetric(l.timestamp, l.tags, system, summary)
 	l.client.Send(metric)
 }
 
-func buildLineProtocolMetrics(timestamp time.Time, system string, packages []SoftwarePackage) []*lpsender.SimpleMetric {
+func (l *lineProtocolSocketBatch) ReportOsInfo(info OsInfo) {
+	metric := buildLineProtocolOsInfoMetric(l.timestamp, l.tags, info)
+	if metric != nil {
+		l.client.Send(metric)
+	}
+}
+
+func (l *lineProtocolSocketBatch) ReportVulnerabilities(system string, vulnerabilities []PackageVulnerability) {
+	metrics := buildLineProtocolVulnerabilityMetrics(l.timestamp, l.tags, system, vulnerabilities)
+	for _, metric := range metrics {
+		l.client.Send(metric)
+	}
+}
+
+func buildLineProtocolMetrics(timestamp time.Time, tags map[string]string, system string, packages []SoftwarePackage) []*lpsender.SimpleMetric {
 	metrics := make([]*lpsender.SimpleMetric, 0, len(packages))
 
 	for _, pkg := range packages {
@@ -163,7 +269,77 @@ func buildLineProtocolMetrics(timestamp time.Time, system string, packages []Sof
 		metric.AddTag(LpSystemTag, system)
 		metric.AddTag(LpPackageTag, pkg.Name)
 		metric.AddTag(LpArchTag, pkg.Arch)
+		if pkg.Location != "" {
+			metric.AddTag(LpLocationTag, pkg.Location)
+		}
+		addBatchTags(metric, tags)
 		metric.AddField(LpVersionField, pkg.Version)
+		if pkg.Purl != "" {
+			metric.AddField(LpPurlField, pkg.Purl)
+		}
+		addExtendedFields(metric, pkg)
+
+		metrics = append(metrics, metric)
+	}
+
+	return metrics
+}
+
+func buildLineProtocolChangeMetrics(timestamp time.Time, tags map[string]string, system string, changes []PackageChange) []*lpsender.SimpleMetric {
+	metrics := make([]*lpsender.SimpleMetric, 0, len(changes))
+
+	for _, change := range changes {
+		metric := lpsender.NewSimpleMetric(LpMeasurementChangesName)
+		metric.SetTime(timestamp)
+		metric.AddTag(LpSystemTag, system)
+		metric.AddTag(LpPackageTag, change.Name)
+		metric.AddTag(LpArchTag, change.Arch)
+		if change.Location != "" {
+			metric.AddTag(LpLocationTag, change.Location)
+		}
+		metric.AddTag(LpChangeTag, string(change.Change))
+		addBatchTags(metric, tags)
+		// the versions are added by the type of change, rather than whether they're empty,
+		// so that a measurement always has at least one field
+		if change.Change != PackageInstalled {
+			metric.AddField(LpOldVersionField, change.OldVersion)
+		}
+		if change.Change != PackageRemoved {
+			metric.AddField(LpNewVersionField, change.NewVersion)
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	return metrics
+}
+
+// buildLineProtocolVulnerabilityMetrics tags each measurement with the advisory since a
+// package can be affected by several
+func buildLineProtocolVulnerabilityMetrics(timestamp time.Time, tags map[string]string, system string, vulnerabilities []PackageVulnerability) []*lpsender.SimpleMetric {
+	metrics := make([]*lpsender.SimpleMetric, 0, len(vulnerabilities))
+
+	for _, vulnerability := range vulnerabilities {
+		metric := lpsender.NewSimpleMetric(LpMeasurementVulnerableName)
+		metric.SetTime(timestamp)
+		metric.AddTag(LpSystemTag, system)
+		metric.AddTag(LpPackageTag, vulnerability.Name)
+		metric.AddTag(LpArchTag, vulnerability.Arch)
+		if vulnerability.Location != "" {
+			metric.AddTag(LpLocationTag, vulnerability.Location)
+		}
+		metric.AddTag(LpAdvisoryTag, vulnerability.Id)
+		addBatchTags(metric, tags)
+		metric.AddField(LpVersionField, vulnerability.Version)
+		if vulnerability.Severity != "" {
+			metric.AddField(LpSeverityField, vulnerability.Severity)
+		}
+		if vulnerability.FixedVersion != "" {
+			metric.AddField(LpFixedVersionField, vulnerability.FixedVersion)
+		}
+		if len(vulnerability.Aliases) > 0 {
+			metric.AddField(LpAliasesField, strings.Join(vulnerability.Aliases, ","))
+		}
 
 		metrics = append(metrics, metric)
 	}
@@ -171,10 +347,104 @@ func buildLineProtocolMetrics(timestamp time.Time, system string, packages []Sof
 	return metrics
 }
 
-func buildLineProtocolFailureMetric(timestamp time.Time, system string, err error) *lpsender.SimpleMetric {
+func buildLineProtocolFailureMetric(timestamp time.Time, tags map[string]string, system string, err error) *lpsender.SimpleMetric {
 	metric := lpsender.NewSimpleMetric(LpMeasurementFailureName)
 	metric.SetTime(timestamp)
 	metric.AddTag(LpSystemTag, system)
+	addBatchTags(metric, tags)
 	metric.AddField(LpErrorField, err.Error())
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		metric.AddField(LpTimedOutField, true)
+	}
+	var packageManagerErr *PackageManagerError
+	if errors.As(err, &packageManagerErr) {
+		metric.AddField(LpCommandField, packageManagerErr.Command)
+		if packageManagerErr.ExitCode >= 0 {
+			metric.AddField(LpExitCodeField, packageManagerErr.ExitCode)
+		}
+		if packageManagerErr.Stderr != "" {
+			metric.AddField(LpStderrField, packageManagerErr.Stderr)
+		}
+	}
+	return metric
+}
+
+// addExtendedFields adds the extended metadata that is present, which is only the case when
+// enabled by the config
+func addExtendedFields(metric *lpsender.SimpleMetric, pkg SoftwarePackage) {
+	if pkg.Epoch != "" {
+		metric.AddField(LpEpochField, pkg.Epoch)
+	}
+	if pkg.InstallTime != 0 {
+		metric.AddField(LpInstallTimeField, pkg.InstallTime)
+	}
+	if pkg.InstalledSize != 0 {
+		metric.AddField(LpInstalledSizeField, pkg.InstalledSize)
+	}
+	if pkg.Vendor != "" {
+		metric.AddField(LpVendorField, pkg.Vendor)
+	}
+	if pkg.SourcePackage != "" {
+		metric.AddField(LpSourcePackageField, pkg.SourcePackage)
+	}
+	if pkg.License != "" {
+		metric.AddField(LpLicenseField, pkg.License)
+	}
+	if pkg.Summary != "" {
+		metric.AddField(LpSummaryField, pkg.Summary)
+	}
+}
+
+// buildLineProtocolCollectionMetric builds the lightweight measurement that is reported for
+// each collected package system, even when its listing was skipped, or as a warning when
+// some of the package manager output was malformed
+func buildLineProtocolCollectionMetric(timestamp time.Time, tags map[string]string, system string, summary CollectionSummary) *lpsender.SimpleMetric {
+	metric := lpsender.NewSimpleMetric(LpMeasurementCollectionName)
+	metric.SetTime(timestamp)
+	metric.AddTag(LpSystemTag, system)
+	addBatchTags(metric, tags)
+	metric.AddField(LpSkippedField, summary.Skipped)
+	if summary.MalformedRecords > 0 {
+		metric.AddField(LpMalformedRecordsField, summary.MalformedRecords)
+	}
 	return metric
 }
+
+// buildLineProtocolOsInfoMetric returns nil when nothing is known about the operating system
+// since a measurement requires at least one field
+func buildLineProtocolOsInfoMetric(timestamp time.Time, tags map[string]string, info OsInfo) *lpsender.SimpleMetric {
+	metric := lpsender.NewSimpleMetric(LpMeasurementOsInfoName)
+	metric.SetTime(timestamp)
+	addBatchTags(metric, tags)
+
+	fields := 0
+	addField := func(name, value string) {
+		if value != "" {
+			metric.AddField(name, value)
+			fields++
+		}
+	}
+	if info.Distro != nil {
+		addField(LpOsIdField, info.Distro.ID)
+		addField(LpOsVersionField, info.Distro.VersionID)
+		addField(LpOsCodenameField, info.Distro.VersionCodename)
+		addField(LpOsPrettyNameField, info.Distro.PrettyName)
+	}
+	addField(LpKernelReleaseField, info.KernelRelease)
+	addField(LpOsArchField, info.Arch)
+	addField(LpHostnameField, info.Hostname)
+	addField(LpMachineIdField, info.MachineId)
+
+	if fields == 0 {
+		return nil
+	}
+	return metric
+}
+
+// addBatchTags adds the tags given when the batch was started, in a consistent order
+func addBatchTags(metric *lpsender.SimpleMetric, tags map[string]string) {
+	for _, key := range sortedKeys(tags) {
+		metric.AddTag(key, tags[key])
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -35,7 +36,7 @@ func TestLineProtocolConsoleBatch_ReportSuccess(t *testing.T) {
 
 	var out bytes.Buffer
 	reporter := &lineProtocolConsoleReporter{out: &out, logger: zap.NewNop()}
-	batch := reporter.StartBatch(timestamp)
+	batch := reporter.StartBatch(timestamp, nil)
 	require.NotNil(t, batch)
 
 	batch.ReportSuccess("rpm", []SoftwarePackage{
@@ -48,13 +49,98 @@ func TestLineProtocolConsoleBatch_ReportSuccess(t *testing.T) {
 `, out.String())
 }
 
+func TestLineProtocolConsoleBatch_ReportSuccess_location(t *testing.T) {
+	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	reporter := &lineProtocolConsoleReporter{out: &out, logger: zap.NewNop()}
+	batch := reporter.StartBatch(timestamp, nil)
+	require.NotNil(t, batch)
+
+	batch.ReportSuccess("python", []SoftwarePackage{
+		{Name: "requests", Version: "2.28.1", Location: "/usr/lib/python3/dist-packages"},
+	})
+
+	assert.Equal(t, `> packages,system=python,package=requests,location=/usr/lib/python3/dist-packages version="2.28.1" 1136214245000000000
+`, out.String())
+}
+
+func TestLineProtocolConsoleBatch_ReportSuccess_purl(t *testing.T) {
+	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	reporter := &lineProtocolConsoleReporter{out: &out, logger: zap.NewNop()}
+	batch := reporter.StartBatch(timestamp, nil)
+	require.NotNil(t, batch)
+
+	batch.ReportSuccess("debian", []SoftwarePackage{
+		{Name: "tar", Version: "1.29b-2ubuntu0.1", Arch: "amd64",
+			Purl: "pkg:deb/ubuntu/tar@1.29b-2ubuntu0.1?arch=amd64&distro=ubuntu-18.04"},
+	})
+
+	assert.Equal(t, `> packages,system=debian,package=tar,arch=amd64 version="1.29b-2ubuntu0.1",purl="pkg:deb/ubuntu/tar@1.29b-2ubuntu0.1?arch=amd64&distro=ubuntu-18.04" 1136214245000000000
+`, out.String())
+}
+
+func TestLineProtocolConsoleBatch_ReportSuccess_extended(t *testing.T) {
+	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	reporter := &lineProtocolConsoleReporter{out: &out, logger: zap.NewNop()}
+	batch := reporter.StartBatch(timestamp, nil)
+	require.NotNil(t, batch)
+
+	batch.ReportSuccess("rpm", []SoftwarePackage{
+		{
+			Name:          "dbus-common",
+			Version:       "1:1.12.8-7.el8",
+			Arch:          "noarch",
+			Epoch:         "1",
+			InstallTime:   1571326382,
+			InstalledSize: 11327,
+			Vendor:        "Red Hat, Inc.",
+			SourcePackage: "dbus",
+			License:       "(GPLv2+ or AFL) and GPLv2+",
+			Summary:       "D-BUS message bus configuration",
+		},
+	})
+
+	assert.Equal(t, `> packages,system=rpm,package=dbus-common,arch=noarch version="1:1.12.8-7.el8",epoch="1",install_time=1571326382i,installed_size=11327i,vendor="Red Hat, Inc.",source_package="dbus",license="(GPLv2+ or AFL) and GPLv2+",summary="D-BUS message bus configuration" 1136214245000000000
+`, out.String())
+}
+
+func TestLineProtocolConsoleBatch_ReportSuccess_batchTags(t *testing.T) {
+	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	reporter := &lineProtocolConsoleReporter{out: &out, logger: zap.NewNop()}
+	batch := reporter.StartBatch(timestamp, map[string]string{
+		LpImageTag:       "example/app:1.0",
+		LpImageDigestTag: "sha256:abc123",
+	})
+	require.NotNil(t, batch)
+
+	batch.ReportSuccess("apk", []SoftwarePackage{
+		{Name: "musl", Version: "1.2.4-r2", Arch: "x86_64"},
+	})
+	batch.ReportFailure("rpm", errors.New("this is just a test"))
+
+	assert.Equal(t, `> packages,system=apk,package=musl,arch=x86_64,image=example/app:1.0,image_digest=sha256:abc123 version="1.2.4-r2" 1136214245000000000
+> packages_failed,system=rpm,image=example/app:1.0,image_digest=sha256:abc123 error="this is just a test" 1136214245000000000
+`, out.String())
+}
+
 func TestLineProtocolConsoleBatch_ReportFailure(t *testing.T) {
 	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
 	require.NoError(t, err)
 
 	var out bytes.Buffer
 	reporter := &lineProtocolConsoleReporter{out: &out, logger: zap.NewNop()}
-	batch := reporter.StartBatch(timestamp)
+	batch := reporter.StartBatch(timestamp, nil)
 	require.NotNil(t, batch)
 
 	batch.ReportFailure("rpm", errors.New("this is just a test"))
@@ -63,6 +149,153 @@ func TestLineProtocolConsoleBatch_ReportFailure(t *testing.T) {
 `, out.String())
 }
 
+func TestLineProtocolConsoleBatch_ReportFailure_timeout(t *testing.T) {
+	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	reporter := &lineProtocolConsoleReporter{out: &out, logger: zap.NewNop()}
+	batch := reporter.StartBatch(timestamp, nil)
+	require.NotNil(t, batch)
+
+	batch.ReportFailure("rpm", &TimeoutError{System: "rpm", Timeout: 5 * time.Minute})
+
+	assert.Equal(t, `> packages_failed,system=rpm error="listing rpm packages timed out after 5m0s",timed_out=true 1136214245000000000
+`, out.String())
+}
+
+func TestLineProtocolConsoleBatch_ReportFailure_packageManager(t *testing.T) {
+	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	reporter := &lineProtocolConsoleReporter{out: &out, logger: zap.NewNop()}
+	batch := reporter.StartBatch(timestamp, nil)
+	require.NotNil(t, batch)
+
+	batch.ReportFailure("rpm", fmt.Errorf("failed to run package manager: %w", &PackageManagerError{
+		Command:  "rpm --query --all",
+		ExitCode: 1,
+		Stderr:   "error: rpmdb: BDB0113 Thread/process 1234 failed\n",
+		Err:      errors.New("exit status 1"),
+	}))
+
+	assert.Equal(t, `> packages_failed,system=rpm error="failed to run package manager: exit status 1",command="rpm --query --all",exit_code=1i,stderr="error: rpmdb: BDB0113 Thread/process 1234 failed\n" 1136214245000000000
+`, out.String())
+}
+
+func TestLineProtocolConsoleBatch_ReportChanges(t *testing.T) {
+	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	reporter := &lineProtocolConsoleReporter{out: &out, logger: zap.NewNop()}
+	batch := reporter.StartBatch(timestamp, nil)
+	require.NotNil(t, batch)
+
+	batch.ReportChanges("rpm", []PackageChange{
+		{Change: PackageInstalled, Name: "curl", Arch: "x86_64", NewVersion: "7.61.1-8.el8"},
+		{Change: PackageUpgraded, Name: "dbus", Arch: "x86_64", OldVersion: "1:1.12.8-7.el8", NewVersion: "1:1.12.8-9.el8"},
+		{Change: PackageRemoved, Name: "tzdata", Arch: "noarch", OldVersion: "2019a-1.el8"},
+	})
+
+	assert.Equal(t, `> packages_changes,system=rpm,package=curl,arch=x86_64,change=installed new_version="7.61.1-8.el8" 1136214245000000000
+> packages_changes,system=rpm,package=dbus,arch=x86_64,change=upgraded old_version="1:1.12.8-7.el8",new_version="1:1.12.8-9.el8" 1136214245000000000
+> packages_changes,system=rpm,package=tzdata,arch=noarch,change=removed old_version="2019a-1.el8" 1136214245000000000
+`, out.String())
+}
+
+func TestLineProtocolConsoleBatch_ReportChanges_emptyVersion(t *testing.T) {
+	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	reporter := &lineProtocolConsoleReporter{out: &out, logger: zap.NewNop()}
+	batch := reporter.StartBatch(timestamp, nil)
+	require.NotNil(t, batch)
+
+	batch.ReportChanges("gomod", []PackageChange{
+		{Change: PackageInstalled, Name: "example.com/tool", Location: "/usr/local/bin/tool"},
+		{Change: PackageRemoved, Name: "example.com/lib", Location: "/usr/local/bin/tool"},
+	})
+
+	assert.Equal(t, `> packages_changes,system=gomod,package=example.com/tool,location=/usr/local/bin/tool,change=installed new_version="" 1136214245000000000
+> packages_changes,system=gomod,package=example.com/lib,location=/usr/local/bin/tool,change=removed old_version="" 1136214245000000000
+`, out.String())
+}
+
+func TestLineProtocolConsoleBatch_ReportCollection(t *testing.T) {
+	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	reporter := &lineProtocolConsoleReporter{out: &out, logger: zap.NewNop()}
+	batch := reporter.StartBatch(timestamp, nil)
+	require.NotNil(t, batch)
+
+	batch.ReportCollection("rpm", CollectionSummary{Skipped: true})
+	batch.ReportCollection("debian", CollectionSummary{})
+	batch.ReportCollection("apk", CollectionSummary{MalformedRecords: 2})
+
+	assert.Equal(t, `> packages_collection,system=rpm skipped=true 1136214245000000000
+> packages_collection,system=debian skipped=false 1136214245000000000
+> packages_collection,system=apk skipped=false,malformed_records=2i 1136214245000000000
+`, out.String())
+}
+
+func TestLineProtocolConsoleBatch_ReportOsInfo(t *testing.T) {
+	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	reporter := &lineProtocolConsoleReporter{out: &out, logger: zap.NewNop()}
+	batch := reporter.StartBatch(timestamp, map[string]string{"os_id": "ubuntu"})
+	require.NotNil(t, batch)
+
+	batch.ReportOsInfo(OsInfo{
+		Distro: &OsRelease{
+			ID:              "ubuntu",
+			VersionID:       "18.04",
+			VersionCodename: "bionic",
+			PrettyName:      "Ubuntu 18.04.3 LTS",
+		},
+		KernelRelease: "4.15.0-72-generic",
+		Arch:          "x86_64",
+		Hostname:      "web-1",
+		MachineId:     "b08dfa6083e7567a1921a715000001fb",
+	})
+	// nothing was detected, such as for a scratch container image
+	batch.ReportOsInfo(OsInfo{})
+
+	assert.Equal(t, `> os_info,os_id=ubuntu os_id="ubuntu",os_version="18.04",os_codename="bionic",os_pretty_name="Ubuntu 18.04.3 LTS",kernel_release="4.15.0-72-generic",arch="x86_64",hostname="web-1",machine_id="b08dfa6083e7567a1921a715000001fb" 1136214245000000000
+`, out.String())
+}
+
+func TestLineProtocolConsoleBatch_ReportVulnerabilities(t *testing.T) {
+	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	reporter := &lineProtocolConsoleReporter{out: &out, logger: zap.NewNop()}
+	batch := reporter.StartBatch(timestamp, nil)
+	require.NotNil(t, batch)
+
+	batch.ReportVulnerabilities("debian", []PackageVulnerability{
+		{Name: "curl", Version: "7.64.0-4", Arch: "amd64", Id: "DSA-4633-1",
+			Aliases: []string{"CVE-2019-5436", "CVE-2019-5481"}, FixedVersion: "7.64.0-4+deb10u1"},
+		{Name: "libc6", Version: "2.28-10", Arch: "amd64", Id: "DEBIAN-CVE-2021-3326", Severity: "low"},
+	})
+	batch.ReportVulnerabilities("npm", []PackageVulnerability{
+		{Name: "debug", Version: "4.1.1", Location: "/srv/app/node_modules/debug", Id: "GHSA-gxpj-cx7g-858c",
+			Severity: "low", FixedVersion: "4.3.1"},
+	})
+
+	assert.Equal(t, `> packages_vulnerable,system=debian,package=curl,arch=amd64,advisory=DSA-4633-1 version="7.64.0-4",fixed_version="7.64.0-4+deb10u1",aliases="CVE-2019-5436,CVE-2019-5481" 1136214245000000000
+> packages_vulnerable,system=debian,package=libc6,arch=amd64,advisory=DEBIAN-CVE-2021-3326 version="2.28-10",severity="low" 1136214245000000000
+> packages_vulnerable,system=npm,package=debug,location=/srv/app/node_modules/debug,advisory=GHSA-gxpj-cx7g-858c version="4.1.1",severity="low",fixed_version="4.3.1" 1136214245000000000
+`, out.String())
+}
+
 func TestLineProtocolSocketBatch_ReportSuccess(t *testing.T) {
 	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
 	require.NoError(t, err)
@@ -82,7 +315,7 @@ func TestLineProtocolSocketBatch_ReportSuccess(t *testing.T) {
 	reporter, err := NewLineProtocolSocketReporter(ctx, listener.Addr().String(), zap.NewNop())
 	require.NoError(t, err)
 
-	batch := reporter.StartBatch(timestamp)
+	batch := reporter.StartBatch(timestamp, nil)
 
 	batch.ReportSuccess("rpm", []SoftwarePackage{
 		{Name: "tzdata", Version: "2019a-1.el8", Arch: "noarch"},
@@ -115,7 +348,7 @@ func TestLineProtocolSocketBatch_ReportFailure(t *testing.T) {
 	reporter, err := NewLineProtocolSocketReporter(ctx, listener.Addr().String(), zap.NewNop())
 	require.NoError(t, err)
 
-	batch := reporter.StartBatch(timestamp)
+	batch := reporter.StartBatch(timestamp, nil)
 
 	batch.ReportFailure("rpm", errors.New("this is just a test"))
 
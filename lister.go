@@ -17,42 +17,107 @@
 package packagesagent
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
+	"io"
 	"os/exec"
+	"strconv"
 	"strings"
 )
 
 type SoftwarePackage struct {
-	Name    string
-	Version string
-	Arch    string
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch,omitempty"`
+	// Location is the path where the package is installed, for packaging systems that allow
+	// for more than one installation of the same package
+	Location string `json:"location,omitempty"`
+	// Extra holds any additional, system specific fields provided by the lister
+	Extra map[string]string `json:"extra,omitempty"`
+	// Purl is the package URL of the package, which is populated by the collection for
+	// packaging systems that have a package URL type
+	Purl string `json:"purl,omitempty"`
+
+	// The remaining fields are the extended metadata, which is only provided by some
+	// packaging systems and is only reported when enabled
+
+	// Epoch is the epoch prefix of the Version, if any
+	Epoch string `json:"epoch,omitempty"`
+	// InstallTime is when the package was installed, in seconds since the Unix epoch
+	InstallTime int64 `json:"install-time,omitempty"`
+	// InstalledSize is the disk space used by the package, in bytes
+	InstalledSize int64 `json:"installed-size,omitempty"`
+	// Vendor is the vendor of the package or, when not declared, its maintainer
+	Vendor string `json:"vendor,omitempty"`
+	// SourcePackage is the name of the source package that the package was built from
+	SourcePackage string `json:"source-package,omitempty"`
+	License       string `json:"license,omitempty"`
+	Summary       string `json:"summary,omitempty"`
+}
+
+// withoutExtended returns a copy of the package without its extended metadata
+func (p SoftwarePackage) withoutExtended() SoftwarePackage {
+	return SoftwarePackage{
+		Name:     p.Name,
+		Version:  p.Version,
+		Arch:     p.Arch,
+		Location: p.Location,
+		Extra:    p.Extra,
+		Purl:     p.Purl,
+	}
 }
 
 type SoftwarePackageLister interface {
 	PackagingSystem() string
 	IsSupported() bool
-	ListPackages() ([]SoftwarePackage, error)
+	// ListPackages lists the installed packages, where the listing is abandoned when the
+	// context is done. When only some of the package manager output could be parsed, the
+	// parsed packages are returned along with a *MalformedRecordsError.
+	ListPackages(ctx context.Context) ([]SoftwarePackage, error)
 }
 
-// commandBuilder matches the exec.Command signature and provides a mocking point
-type commandBuilder func(commandName string, arg ...string) *exec.Cmd
+// MalformedRecordsError indicates the number of records of the package manager output that
+// could not be parsed
+type MalformedRecordsError struct {
+	Count int
+	// Example is the first of the malformed records
+	Example string
+}
 
-// threeColumnPackageLister is able to generically use any package manager query command where
-// the arguments declare an output format consisting of the space separated fields
-// package name, version, and CPU architecture
-type threeColumnPackageLister struct {
+func (e *MalformedRecordsError) Error() string {
+	return fmt.Sprintf("%d package manager output records were malformed, such as %q", e.Count, e.Example)
+}
+
+// commandBuilder matches the exec.CommandContext signature and provides a mocking point
+type commandBuilder func(ctx context.Context, commandName string, arg ...string) *exec.Cmd
+
+// The delimiters of the package manager output are the ASCII unit and record separators,
+// which won't appear in the metadata of a package, unlike spaces or even newlines
+const (
+	queryFieldSeparator  = "\x1f"
+	queryRecordSeparator = "\x1e"
+)
+
+// queryPackageLister is able to generically use any package manager query command where
+// the arguments declare an output format of a record per package that is terminated by
+// queryRecordSeparator and consists of fields separated by queryFieldSeparator
+type queryPackageLister struct {
 	packagingSystem string
 	commandBuilder  commandBuilder
 	commandName     string
 	commandArgs     []string
-	logger          *zap.Logger
+	// fieldCount is the number of fields declared by the output format
+	fieldCount int
+	// parseFields converts the fields of an output record into a package
+	parseFields func(fields []string) SoftwarePackage
+	logger      *zap.Logger
 }
 
-func (t *threeColumnPackageLister) IsSupported() bool {
-	_, err := exec.LookPath(t.commandName)
+func (q *queryPackageLister) IsSupported() bool {
+	_, err := exec.LookPath(q.commandName)
 	if err != nil {
 		return false
 	} else {
@@ -60,54 +125,359 @@ func (t *threeColumnPackageLister) IsSupported() bool {
 	}
 }
 
-func (t *threeColumnPackageLister) PackagingSystem() string {
-	return t.packagingSystem
+func (q *queryPackageLister) PackagingSystem() string {
+	return q.packagingSystem
 }
 
-func (t *threeColumnPackageLister) ListPackages() ([]SoftwarePackage, error) {
-	cmd := t.commandBuilder(t.commandName, t.commandArgs...)
-	t.logger.Debug("calling packaging tool",
-		zap.String("name", t.commandName), zap.Strings("args", t.commandArgs))
-	output, err := cmd.Output()
+func (q *queryPackageLister) ListPackages(ctx context.Context) ([]SoftwarePackage, error) {
+	cmd := q.commandBuilder(ctx, q.commandName, q.commandArgs...)
+	q.logger.Debug("calling packaging tool",
+		zap.String("name", q.commandName), zap.Strings("args", q.commandArgs))
+	output, err := runCommand(ctx, cmd)
 	if err != nil {
 		return nil, fmt.Errorf("failed to run package manager: %w", err)
 	}
 
-	buffer := bytes.NewBuffer(output)
-	scanner := bufio.NewScanner(buffer)
 	var pkgs []SoftwarePackage
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, " ", 3)
-		if len(parts) < 3 {
-			return nil, fmt.Errorf("package manager output line was malformed: %s", line)
+	var malformed *MalformedRecordsError
+	for _, record := range strings.Split(string(output), queryRecordSeparator) {
+		// a newline after the terminator, such as from a wrapper script, is ignored
+		record = strings.TrimLeft(record, "\r\n")
+		if record == "" {
+			continue
+		}
+		fields := strings.Split(record, queryFieldSeparator)
+		if len(fields) != q.fieldCount {
+			if malformed == nil {
+				malformed = &MalformedRecordsError{Example: record}
+			}
+			malformed.Count++
+			continue
 		}
-		pkgs = append(pkgs, SoftwarePackage{
-			Name:    parts[0],
-			Version: parts[1],
-			Arch:    parts[2],
-		})
+		pkgs = append(pkgs, q.parseFields(fields))
 	}
 
+	if malformed != nil {
+		if len(pkgs) == 0 {
+			return nil, malformed
+		}
+		q.logger.Warn("ignoring malformed package manager output",
+			zap.String("system", q.packagingSystem), zap.Int("count", malformed.Count),
+			zap.String("example", malformed.Example))
+		return pkgs, malformed
+	}
 	return pkgs, nil
 }
 
-func RpmLister(logger *zap.Logger) SoftwarePackageLister {
-	return &threeColumnPackageLister{
+// fallbackPackageLister delegates to the first of its listers that is supported, which allows
+// for preferring a native database reader while still falling back to the package manager tool
+type fallbackPackageLister struct {
+	packagingSystem string
+	listers         []SoftwarePackageLister
+}
+
+func (f *fallbackPackageLister) PackagingSystem() string {
+	return f.packagingSystem
+}
+
+func (f *fallbackPackageLister) IsSupported() bool {
+	return f.supported() != nil
+}
+
+func (f *fallbackPackageLister) supported() SoftwarePackageLister {
+	for _, lister := range f.listers {
+		if lister.IsSupported() {
+			return lister
+		}
+	}
+	return nil
+}
+
+func (f *fallbackPackageLister) ListPackages(ctx context.Context) ([]SoftwarePackage, error) {
+	lister := f.supported()
+	if lister == nil {
+		return nil, fmt.Errorf("package system %s is not supported", f.packagingSystem)
+	}
+	return lister.ListPackages(ctx)
+}
+
+// WatchPaths combines the watch paths of each of the listers, since the package manager tool
+// reads the same database as the native reader
+func (f *fallbackPackageLister) WatchPaths() []string {
+	var paths []string
+	for _, lister := range f.listers {
+		if provider, ok := lister.(WatchPathsProvider); ok {
+			paths = append(paths, provider.WatchPaths()...)
+		}
+	}
+	return paths
+}
+
+// Fingerprint is that of the supported lister, if it can be fingerprinted, since the other
+// listers could be reading a database that doesn't exist
+func (f *fallbackPackageLister) Fingerprint() (string, error) {
+	fingerprinter, ok := f.supported().(Fingerprinter)
+	if !ok {
+		return "", fmt.Errorf("package system %s cannot be fingerprinted", f.packagingSystem)
+	}
+	return fingerprinter.Fingerprint()
+}
+
+// maxStderrSize bounds how much of the package manager's stderr is retained for its failure
+const maxStderrSize = 4096
+
+// PackageManagerError is the failure of a package manager command along with the details
+// needed to diagnose it
+type PackageManagerError struct {
+	// Command is the command line that was run
+	Command string
+	// ExitCode is the exit code of the command or -1 if it didn't exit normally
+	ExitCode int
+	// Stderr is the beginning of what the command wrote to stderr, which is reported in its
+	// own field rather than as part of the error message
+	Stderr string
+	Err    error
+}
+
+func (e *PackageManagerError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PackageManagerError) Unwrap() error {
+	return e.Err
+}
+
+// contextReader abandons the reading of a file, such as a large package database on a slow
+// mount, once the context is done, which allows the parsers to remain unaware of the context
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
+
+// contextReaderAt is the io.ReaderAt equivalent of contextReader for the database readers
+type contextReaderAt struct {
+	ctx    context.Context
+	reader io.ReaderAt
+}
+
+func (c *contextReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.reader.ReadAt(p, off)
+}
+
+// boundedBuffer retains the first max bytes written to it and discards the remainder, where
+// writes always succeed so that the command is not disrupted
+type boundedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	remaining := b.max - b.buf.Len()
+	if len(p) > remaining {
+		b.buf.Write(p[:remaining])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (b *boundedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "..."
+	}
+	return b.buf.String()
+}
+
+// formatCommandLine joins the arguments of a command, quoting those that wouldn't otherwise
+// be readable, such as the query formats with their control character delimiters
+func formatCommandLine(args []string) string {
+	formatted := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "" || strings.IndexFunc(arg, func(r rune) bool {
+			return r <= ' ' || r == '"' || r == '\\' || r == 0x7f
+		}) >= 0 {
+			arg = strconv.Quote(arg)
+		}
+		formatted = append(formatted, arg)
+	}
+	return strings.Join(formatted, " ")
+}
+
+// runCommand runs the command in its own process group and returns its stdout. When the
+// context is done, the whole group is killed since package managers, such as rpm, can spawn
+// helpers that would otherwise keep running and hold the output pipe open. A failure of the
+// command is returned as a *PackageManagerError.
+func runCommand(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	var stdout bytes.Buffer
+	stderr := &boundedBuffer{max: maxStderrSize}
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+
+	err := cmd.Start()
+	if err != nil {
+		return nil, &PackageManagerError{Command: formatCommandLine(cmd.Args), ExitCode: -1, Err: err}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if err != nil {
+		exitCode := -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+		return nil, &PackageManagerError{
+			Command:  formatCommandLine(cmd.Args),
+			ExitCode: exitCode,
+			Stderr:   stderr.String(),
+			Err:      err,
+		}
+	}
+	return stdout.Bytes(), nil
+}
+
+// RpmLister reads the RPM database directly, when present, and otherwise falls back to rpm.
+// The packages installed in the filesystem at root are listed, where an empty root is the host.
+func RpmLister(root string, logger *zap.Logger) SoftwarePackageLister {
+	return &fallbackPackageLister{
 		packagingSystem: "rpm",
-		commandBuilder:  exec.Command,
+		listers: []SoftwarePackageLister{
+			RpmdbLister(root, logger),
+			rpmQueryLister(root, logger),
+		},
+	}
+}
+
+func rpmQueryLister(root string, logger *zap.Logger) SoftwarePackageLister {
+	var args []string
+	if !isHostRoot(root) {
+		// the database path is relative to the root, so the default one is used
+		args = append(args, "--root", root)
+	}
+	return &queryPackageLister{
+		packagingSystem: "rpm",
+		commandBuilder:  exec.CommandContext,
 		commandName:     "rpm",
-		commandArgs:     []string{"--query", "--all", "--queryformat", "%{name} %{evr} %{arch}\\n"},
+		commandArgs:     append(args, "--query", "--all", "--queryformat", rpmQueryFormat),
+		fieldCount:      rpmQueryFieldCount,
+		parseFields:     parseRpmQueryFields,
 		logger:          logger,
 	}
 }
 
-func DebianLister(logger *zap.Logger) SoftwarePackageLister {
-	return &threeColumnPackageLister{
+// rpmQueryFormat declares the fields parsed by parseRpmQueryFields, where the conditionals
+// avoid rpm's "(none)" for tags that are not set
+var rpmQueryFormat = strings.Join([]string{
+	"%{name}", "%{evr}", "%{arch}", "%{installtime}", "%{size}",
+	"%|vendor?{%{vendor}}:{}|", "%|sourcerpm?{%{sourcerpm}}:{}|", "%{license}", "%{summary}",
+}, queryFieldSeparator) + queryRecordSeparator
+
+const rpmQueryFieldCount = 9
+
+func parseRpmQueryFields(fields []string) SoftwarePackage {
+	// rpm reports tags that aren't set, such as the arch of gpg-pubkey entries, as (none)
+	for i, field := range fields {
+		if field == "(none)" {
+			fields[i] = ""
+		}
+	}
+	return SoftwarePackage{
+		Name:          fields[0],
+		Version:       fields[1],
+		Arch:          fields[2],
+		Epoch:         versionEpoch(fields[1]),
+		InstallTime:   parseOptionalInt(fields[3]),
+		InstalledSize: parseOptionalInt(fields[4]),
+		Vendor:        fields[5],
+		SourcePackage: rpmSourcePackageName(fields[6]),
+		License:       fields[7],
+		Summary:       fields[8],
+	}
+}
+
+// DebianLister reads the dpkg status file directly, when present, and otherwise falls back to dpkg-query.
+// The packages installed in the filesystem at root are listed, where an empty root is the host.
+func DebianLister(root string, logger *zap.Logger) SoftwarePackageLister {
+	return &fallbackPackageLister{
+		packagingSystem: "debian",
+		listers: []SoftwarePackageLister{
+			DpkgStatusLister(root, logger),
+			dpkgQueryLister(root, logger),
+		},
+	}
+}
+
+func dpkgQueryLister(root string, logger *zap.Logger) SoftwarePackageLister {
+	var args []string
+	if !isHostRoot(root) {
+		// --admindir is used rather than --root since the latter requires dpkg 1.21
+		args = append(args, "--admindir", rootedPath(root, dpkgAdminDir))
+	}
+	return &queryPackageLister{
 		packagingSystem: "debian",
-		commandBuilder:  exec.Command,
+		commandBuilder:  exec.CommandContext,
 		commandName:     "dpkg-query",
-		commandArgs:     []string{"--show", "--showformat", "${Package} ${Version} ${Architecture}\\n"},
+		commandArgs:     append(args, "--show", "--showformat", dpkgQueryFormat),
+		fieldCount:      dpkgQueryFieldCount,
+		parseFields:     parseDpkgQueryFields,
 		logger:          logger,
 	}
 }
+
+// dpkgQueryFormat declares the fields parsed by parseDpkgQueryFields, where the install time
+// is only provided by dpkg 1.19.3 and newer
+var dpkgQueryFormat = strings.Join([]string{
+	"${Package}", "${Version}", "${Architecture}", "${db-fsys:Last-Modified}",
+	"${Installed-Size}", "${Maintainer}", "${source:Package}", "${binary:Summary}",
+}, queryFieldSeparator) + queryRecordSeparator
+
+const dpkgQueryFieldCount = 8
+
+func parseDpkgQueryFields(fields []string) SoftwarePackage {
+	return SoftwarePackage{
+		Name:          fields[0],
+		Version:       fields[1],
+		Arch:          fields[2],
+		Epoch:         versionEpoch(fields[1]),
+		InstallTime:   parseOptionalInt(fields[3]),
+		InstalledSize: parseOptionalInt(fields[4]) * dpkgInstalledSizeUnit,
+		Vendor:        fields[5],
+		SourcePackage: fields[6],
+		Summary:       fields[7],
+	}
+}
+
+// parseOptionalInt parses a numeric field of the package manager output, where an empty or
+// otherwise unparseable value is zero
+func parseOptionalInt(value string) int64 {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -18,6 +18,8 @@ package packagesagent
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -25,19 +27,21 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 // mockCommandBuilder works in conjunction with TestMockCommandHelper to mock the package manager
 // executables in the same way that Go's exec package does their unit testing.
-func mockCommandBuilder(commandName string, arg ...string) *exec.Cmd {
+func mockCommandBuilder(ctx context.Context, commandName string, arg ...string) *exec.Cmd {
 	cs := []string{"-test.run=TestMockCommandHelper", "--"}
 	// add the original bits
 	cs = append(cs, commandName)
 	cs = append(cs, arg...)
 
 	// re-exec the current executable whichi was built by go test
-	cmd := exec.Command(os.Args[0], cs...)
+	cmd := exec.CommandContext(ctx, os.Args[0], cs...)
 	cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1")
 
 	return cmd
@@ -63,6 +67,19 @@ func TestMockCommandHelper(*testing.T) {
 		args = args[1:]
 	}
 
+	if args[0] == "hang" {
+		// simulates a package manager stuck on a lock along with a helper it spawned, where
+		// the helper holds the output pipe open
+		helper := exec.Command("sleep", "60")
+		helper.Stdout = os.Stdout
+		if err := helper.Start(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		time.Sleep(60 * time.Second)
+		os.Exit(0)
+	}
+
 	file, err := os.Open(filepath.Join("testdata", fmt.Sprintf("%s.out", args[0])))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -78,62 +95,227 @@ func TestMockCommandHelper(*testing.T) {
 	os.Exit(0)
 }
 
-func TestThreeColumnPackageLister_ListPackages(t *testing.T) {
-	lister := threeColumnPackageLister{
+func TestQueryPackageLister_ListPackages(t *testing.T) {
+	lister := queryPackageLister{
 		commandBuilder: mockCommandBuilder,
 		commandName:    "rpm",
+		fieldCount:     rpmQueryFieldCount,
+		parseFields:    parseRpmQueryFields,
 		logger:         zap.NewNop(),
 	}
 
-	packages, err := lister.ListPackages()
+	packages, err := lister.ListPackages(context.Background())
 	require.NoError(t, err)
 	assert.Len(t, packages, 174)
-	// and spot check one
-	assert.Equal(t, "tzdata", packages[0].Name)
-	assert.Equal(t, "2019a-1.el8", packages[0].Version)
-	assert.Equal(t, "noarch", packages[0].Arch)
+	// and spot check some
+	assert.Equal(t, SoftwarePackage{
+		Name:          "tzdata",
+		Version:       "2019a-1.el8",
+		Arch:          "noarch",
+		InstallTime:   1571326382,
+		InstalledSize: 1885402,
+		Vendor:        "Red Hat, Inc.",
+		SourcePackage: "tzdata",
+		License:       "Public Domain",
+		Summary:       "Timezone data",
+	}, packages[0])
+	assert.Equal(t, SoftwarePackage{Name: "dbus-common", Version: "1:1.12.8-7.el8", Arch: "noarch", Epoch: "1"},
+		packages[3])
 }
 
-func TestThreeColumnPackageLister_ListPackages_errorFromCommand(t *testing.T) {
-	lister := threeColumnPackageLister{
+func TestQueryPackageLister_ListPackages_dpkgQuery(t *testing.T) {
+	lister := queryPackageLister{
+		commandBuilder: mockCommandBuilder,
+		commandName:    "dpkg-query",
+		fieldCount:     dpkgQueryFieldCount,
+		parseFields:    parseDpkgQueryFields,
+		logger:         zap.NewNop(),
+	}
+
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	require.NotEmpty(t, packages)
+	assert.Equal(t, SoftwarePackage{
+		Name:          "adduser",
+		Version:       "3.118",
+		Arch:          "all",
+		InstallTime:   1571326382,
+		InstalledSize: 849 * 1024,
+		Vendor:        "Debian Adduser Developers <adduser@packages.debian.org>",
+		SourcePackage: "adduser",
+		Summary:       "add and remove users and groups",
+	}, packages[0])
+}
+
+func TestQueryPackageLister_ListPackages_errorFromCommand(t *testing.T) {
+	lister := queryPackageLister{
 		commandBuilder: mockCommandBuilder,
 		commandName:    "does_not_exist",
 		logger:         zap.NewNop(),
 	}
 
-	_, err := lister.ListPackages()
+	_, err := lister.ListPackages(context.Background())
 	assert.Error(t, err)
-	assert.EqualError(t, err, "failed to run package manager: exit status 1")
+	assert.EqualError(t, err,
+		"failed to run package manager: exit status 1")
+
+	var packageManagerErr *PackageManagerError
+	require.True(t, errors.As(err, &packageManagerErr))
+	assert.Equal(t, 1, packageManagerErr.ExitCode)
+	assert.Equal(t, "open testdata/does_not_exist.out: no such file or directory\n", packageManagerErr.Stderr)
+	assert.True(t, strings.HasSuffix(packageManagerErr.Command, " -- does_not_exist"), packageManagerErr.Command)
+}
+
+func TestBoundedBuffer(t *testing.T) {
+	buffer := &boundedBuffer{max: 8}
+	n, err := buffer.Write([]byte("error: "))
+	require.NoError(t, err)
+	assert.Equal(t, 7, n)
+	n, err = buffer.Write([]byte("rpmdb open failed"))
+	require.NoError(t, err)
+	// the whole write is accepted so that the command isn't disrupted
+	assert.Equal(t, 17, n)
+	assert.Equal(t, "error: r...", buffer.String())
 }
 
-func TestThreeColumnPackageLister_ListPackages_malformed(t *testing.T) {
-	lister := threeColumnPackageLister{
+func TestFormatCommandLine(t *testing.T) {
+	assert.Equal(t, `rpm --query --all --queryformat "%{name}\x1f%{evr}\x1e"`,
+		formatCommandLine([]string{"rpm", "--query", "--all", "--queryformat", "%{name}\x1f%{evr}\x1e"}))
+	assert.Equal(t, `dpkg-query --admindir "/mnt/my image/var/lib/dpkg"`,
+		formatCommandLine([]string{"dpkg-query", "--admindir", "/mnt/my image/var/lib/dpkg"}))
+}
+
+func TestQueryPackageLister_ListPackages_malformed(t *testing.T) {
+	lister := queryPackageLister{
 		commandBuilder: mockCommandBuilder,
 		commandName:    "malformed",
+		fieldCount:     rpmQueryFieldCount,
+		parseFields:    parseRpmQueryFields,
 		logger:         zap.NewNop(),
 	}
 
-	_, err := lister.ListPackages()
-	assert.Error(t, err)
-	assert.EqualError(t, err, "package manager output line was malformed: tzdata 2019a-1.el8")
+	packages, err := lister.ListPackages(context.Background())
+	assert.EqualError(t, err, `1 package manager output records were malformed, such as "tzdata\x1f2019a-1.el8"`)
+	assert.Nil(t, packages)
+}
+
+func TestQueryPackageLister_ListPackages_partiallyMalformed(t *testing.T) {
+	lister := queryPackageLister{
+		commandBuilder: mockCommandBuilder,
+		commandName:    "rpm-partial",
+		fieldCount:     rpmQueryFieldCount,
+		parseFields:    parseRpmQueryFields,
+		logger:         zap.NewNop(),
+	}
+
+	packages, err := lister.ListPackages(context.Background())
+	var malformed *MalformedRecordsError
+	require.True(t, errors.As(err, &malformed))
+	assert.Equal(t, 1, malformed.Count)
+	assert.Equal(t, "bash 4.4.19-7.el8 x86_64", malformed.Example)
+
+	require.Len(t, packages, 3)
+	assert.Equal(t, "tzdata", packages[0].Name)
+	// rpm's (none) is an empty field
+	assert.Equal(t, "gpg-pubkey", packages[1].Name)
+	assert.Equal(t, "", packages[1].Arch)
+	assert.Equal(t, "gpg(CentOS-8 Key (CentOS 8 Official Signing Key) <security@centos.org>)", packages[1].Summary)
+	// newlines within a field don't split the record
+	assert.Equal(t, "vim-minimal", packages[2].Name)
+	assert.Equal(t, "A minimal version of the VIM editor\nwith a second summary line", packages[2].Summary)
+}
+
+func TestQueryPackageLister_ListPackages_killedWhenDone(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("requires sleep")
+	}
+
+	lister := queryPackageLister{
+		commandBuilder: mockCommandBuilder,
+		commandName:    "hang",
+		logger:         zap.NewNop(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := lister.ListPackages(ctx)
+	assert.EqualError(t, err, "failed to run package manager: context deadline exceeded")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	// the spawned helper would otherwise have held the output open for a minute
+	assert.Less(t, int64(time.Since(start)), int64(10*time.Second))
 }
 
 func TestDebianLister(t *testing.T) {
 	logger := zap.NewNop()
-	lister := DebianLister(logger)
-	require.IsType(t, &threeColumnPackageLister{}, lister)
-	casted := lister.(*threeColumnPackageLister)
+	lister := DebianLister("", logger)
+	require.IsType(t, &fallbackPackageLister{}, lister)
+	casted := lister.(*fallbackPackageLister)
 
-	assert.Equal(t, "dpkg-query", casted.commandName)
-	assert.NotEmpty(t, casted.commandArgs)
+	assert.Equal(t, "debian", casted.PackagingSystem())
+	require.Len(t, casted.listers, 2)
+	assert.IsType(t, &dpkgStatusLister{}, casted.listers[0])
+	require.IsType(t, &queryPackageLister{}, casted.listers[1])
+	queryLister := casted.listers[1].(*queryPackageLister)
+	assert.Equal(t, "dpkg-query", queryLister.commandName)
+	assert.NotEmpty(t, queryLister.commandArgs)
+}
+
+func TestFallbackPackageLister(t *testing.T) {
+	unsupported := &mockPackageLister{}
+	unsupported.On("IsSupported").Return(false)
+
+	supported := &mockPackageLister{}
+	supported.On("IsSupported").Return(true)
+	packages := []SoftwarePackage{
+		{Name: "dpkg", Version: "1.19.7", Arch: "amd64"},
+	}
+	supported.On("ListPackages").Return(packages, nil)
+
+	lister := &fallbackPackageLister{
+		packagingSystem: "mock",
+		listers:         []SoftwarePackageLister{unsupported, supported},
+	}
+
+	assert.True(t, lister.IsSupported())
+	actual, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, packages, actual)
+
+	unsupported.AssertNotCalled(t, "ListPackages")
+	supported.AssertExpectations(t)
 }
 
 func TestRpmLister(t *testing.T) {
 	logger := zap.NewNop()
-	lister := RpmLister(logger)
-	require.IsType(t, &threeColumnPackageLister{}, lister)
-	casted := lister.(*threeColumnPackageLister)
+	lister := RpmLister("", logger)
+	require.IsType(t, &fallbackPackageLister{}, lister)
+	casted := lister.(*fallbackPackageLister)
+
+	assert.Equal(t, "rpm", casted.PackagingSystem())
+	require.Len(t, casted.listers, 2)
+	assert.IsType(t, &rpmdbLister{}, casted.listers[0])
+	require.IsType(t, &queryPackageLister{}, casted.listers[1])
+	queryLister := casted.listers[1].(*queryPackageLister)
+	assert.Equal(t, "rpm", queryLister.commandName)
+	assert.NotEmpty(t, queryLister.commandArgs)
+}
+
+func TestRpmLister_root(t *testing.T) {
+	lister := RpmLister("/mnt/image", zap.NewNop())
+	casted := lister.(*fallbackPackageLister)
+
+	require.IsType(t, &queryPackageLister{}, casted.listers[1])
+	queryLister := casted.listers[1].(*queryPackageLister)
+	assert.Equal(t, []string{"--root", "/mnt/image"}, queryLister.commandArgs[:2])
+}
+
+func TestDebianLister_rootAdmindir(t *testing.T) {
+	lister := DebianLister("/mnt/image", zap.NewNop())
+	casted := lister.(*fallbackPackageLister)
 
-	assert.Equal(t, "rpm", casted.commandName)
-	assert.NotEmpty(t, casted.commandArgs)
+	require.IsType(t, &queryPackageLister{}, casted.listers[1])
+	queryLister := casted.listers[1].(*queryPackageLister)
+	assert.Equal(t, []string{"--admindir", "/mnt/image/var/lib/dpkg"}, queryLister.commandArgs[:2])
 }
@@ -0,0 +1,215 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/karrick/godirwalk"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	npmModulesDirName = "node_modules"
+	npmPackageJson    = "package.json"
+)
+
+// DefaultNpmPaths are the search roots used when none are configured, which cover the
+// global installation prefixes of common node distributions
+var DefaultNpmPaths = []string{"/usr/lib", "/usr/local/lib"}
+
+// npmLister walks its search roots for node_modules directories and reports the packages
+// installed in each, including scoped packages and the nested dependencies of each package
+type npmLister struct {
+	root        string
+	searchRoots []string
+	logger      *zap.Logger
+}
+
+type npmPackageManifest struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// NpmLister creates a lister for node packages installed by npm, or compatible tools, without
+// requiring npm itself. The search roots are within the filesystem at root and the DefaultNpmPaths
+// are used when none are given.
+func NpmLister(root string, searchRoots []string, logger *zap.Logger) SoftwarePackageLister {
+	if len(searchRoots) == 0 {
+		searchRoots = DefaultNpmPaths
+	}
+	rootedSearchRoots := make([]string, 0, len(searchRoots))
+	for _, searchRoot := range searchRoots {
+		rootedSearchRoots = append(rootedSearchRoots, rootedPath(root, searchRoot))
+	}
+	return &npmLister{
+		root:        root,
+		searchRoots: rootedSearchRoots,
+		logger:      logger,
+	}
+}
+
+func (n *npmLister) PackagingSystem() string {
+	return "npm"
+}
+
+func (n *npmLister) IsSupported() bool {
+	for _, root := range n.searchRoots {
+		if info, err := os.Stat(root); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *npmLister) ListPackages(ctx context.Context) ([]SoftwarePackage, error) {
+	var pkgs []SoftwarePackage
+
+	for _, root := range n.searchRoots {
+		if _, err := os.Stat(root); os.IsNotExist(err) {
+			continue
+		}
+
+		n.logger.Debug("walking for node_modules", zap.String("root", root))
+		err := godirwalk.Walk(root, &godirwalk.Options{
+			Callback: func(path string, dirent *godirwalk.Dirent) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if !dirent.IsDir() || dirent.Name() != npmModulesDirName {
+					return nil
+				}
+				pkgs = append(pkgs, n.scanModulesDir(path)...)
+				// nested node_modules were already handled by the scan
+				return filepath.SkipDir
+			},
+			ErrorCallback: func(path string, err error) godirwalk.ErrorAction {
+				if ctx.Err() != nil {
+					return godirwalk.Halt
+				}
+				n.logger.Debug("skipping unreadable path", zap.String("path", path), zap.Error(err))
+				return godirwalk.SkipNode
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk npm search root %s: %w", root, err)
+		}
+	}
+
+	return pkgs, nil
+}
+
+// scanModulesDir reports the packages directly within a node_modules directory and, recursively,
+// those in the node_modules directories of each of those packages. An entry that can't be read,
+// such as a stray or truncated package.json, is logged and skipped rather than failing the
+// whole listing.
+func (n *npmLister) scanModulesDir(modulesDir string) []SoftwarePackage {
+	entries, err := ioutil.ReadDir(modulesDir)
+	if err != nil {
+		n.logger.Warn("failed to read node_modules directory", zap.String("path", modulesDir), zap.Error(err))
+		return nil
+	}
+
+	var pkgs []SoftwarePackage
+	for _, entry := range entries {
+		name := entry.Name()
+		// skips .bin, .package-lock.json, and the like
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		if strings.HasPrefix(name, "@") && entry.IsDir() {
+			scopeDir := filepath.Join(modulesDir, name)
+			scopedEntries, err := ioutil.ReadDir(scopeDir)
+			if err != nil {
+				n.logger.Warn("failed to read npm scope directory", zap.String("path", scopeDir), zap.Error(err))
+				continue
+			}
+			for _, scopedEntry := range scopedEntries {
+				pkgs = append(pkgs, n.scanPackageDir(filepath.Join(scopeDir, scopedEntry.Name()), scopedEntry)...)
+			}
+			continue
+		}
+
+		pkgs = append(pkgs, n.scanPackageDir(filepath.Join(modulesDir, name), entry)...)
+	}
+
+	return pkgs
+}
+
+func (n *npmLister) scanPackageDir(pkgDir string, entry os.FileInfo) []SoftwarePackage {
+	isLink := entry.Mode()&os.ModeSymlink != 0
+	if !entry.IsDir() && !isLink {
+		return nil
+	}
+
+	manifest, err := readNpmPackageManifest(filepath.Join(pkgDir, npmPackageJson))
+	if err != nil {
+		if os.IsNotExist(err) {
+			n.logger.Debug("skipping node_modules entry without package.json", zap.String("path", pkgDir))
+		} else {
+			n.logger.Warn("skipping node_modules entry with an unreadable package.json",
+				zap.String("path", pkgDir), zap.Error(err))
+		}
+		return nil
+	}
+
+	pkgs := []SoftwarePackage{{
+		Name:     manifest.Name,
+		Version:  manifest.Version,
+		Location: unrootedPath(n.root, pkgDir),
+	}}
+
+	// linked packages are reported, but not descended into, to avoid cycles
+	if isLink {
+		return pkgs
+	}
+
+	nestedDir := filepath.Join(pkgDir, npmModulesDirName)
+	if info, err := os.Stat(nestedDir); err == nil && info.IsDir() {
+		pkgs = append(pkgs, n.scanModulesDir(nestedDir)...)
+	}
+
+	return pkgs
+}
+
+func readNpmPackageManifest(path string) (*npmPackageManifest, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest npmPackageManifest
+	err = json.Unmarshal(content, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	if manifest.Name == "" {
+		// the directory name is the package name when the manifest omits it
+		pkgDir := filepath.Dir(path)
+		manifest.Name = filepath.Base(pkgDir)
+		if scope := filepath.Base(filepath.Dir(pkgDir)); strings.HasPrefix(scope, "@") {
+			manifest.Name = scope + "/" + manifest.Name
+		}
+	}
+	return &manifest, nil
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"path/filepath"
+	"testing"
+)
+
+func TestNpmLister_ListPackages(t *testing.T) {
+	appModules := filepath.Join("testdata", "npm", "app", "node_modules")
+	globalModules := filepath.Join("testdata", "npm", "global", "lib", "node_modules")
+
+	// the truncated package.json among the app's modules is skipped
+	lister := NpmLister("", []string{
+		filepath.Join("testdata", "npm", "app"),
+		filepath.Join("testdata", "npm", "global"),
+		filepath.Join("testdata", "npm", "does-not-exist"),
+	}, zap.NewNop())
+
+	assert.Equal(t, "npm", lister.PackagingSystem())
+	require.True(t, lister.IsSupported())
+
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, []SoftwarePackage{
+		{Name: "@types/node", Version: "20.8.0", Location: filepath.Join(appModules, "@types", "node")},
+		{Name: "debug", Version: "4.3.4", Location: filepath.Join(appModules, "debug")},
+		{Name: "express", Version: "4.18.2", Location: filepath.Join(appModules, "express")},
+		{Name: "debug", Version: "2.6.9", Location: filepath.Join(appModules, "express", "node_modules", "debug")},
+		{Name: "npm", Version: "10.1.0", Location: filepath.Join(globalModules, "npm")},
+	}, packages)
+}
+
+func TestNpmLister_notSupported(t *testing.T) {
+	lister := NpmLister("", []string{filepath.Join("testdata", "not-npm")}, zap.NewNop())
+
+	assert.False(t, lister.IsSupported())
+}
+
+func TestNpmLister_defaultPaths(t *testing.T) {
+	lister := NpmLister("", nil, zap.NewNop())
+	require.IsType(t, &npmLister{}, lister)
+
+	assert.Equal(t, DefaultNpmPaths, lister.(*npmLister).searchRoots)
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// machineIdPaths are tried in order, where the latter is used by older distributions
+var machineIdPaths = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// Global tags that identify the distribution, when enabled
+const (
+	OsIdTag      = "os_id"
+	OsVersionTag = "os_version"
+)
+
+// OsInfo identifies the operating system that packages are collected from
+type OsInfo struct {
+	// Distro is nil when the distribution can't be determined
+	Distro *OsRelease `json:"distro,omitempty"`
+	// KernelRelease and Arch are as reported by uname and, like Hostname, are only known when
+	// collecting from the host rather than an alternate root
+	KernelRelease string `json:"kernel-release,omitempty"`
+	Arch          string `json:"arch,omitempty"`
+	Hostname      string `json:"hostname,omitempty"`
+	MachineId     string `json:"machine-id,omitempty"`
+}
+
+// DetectOsInfo identifies the operating system of the filesystem at root, leaving empty what
+// can't be determined
+func DetectOsInfo(root string, logger *zap.Logger) *OsInfo {
+	info := &OsInfo{
+		Distro:    DetectDistro(root, logger),
+		MachineId: readMachineId(root),
+	}
+
+	if isHostRoot(root) {
+		var err error
+		info.KernelRelease, info.Arch, err = uname()
+		if err != nil {
+			logger.Debug("unable to determine kernel release", zap.Error(err))
+		}
+		info.Hostname, err = os.Hostname()
+		if err != nil {
+			logger.Debug("unable to determine hostname", zap.Error(err))
+		}
+	}
+
+	return info
+}
+
+func readMachineId(root string) string {
+	for _, path := range machineIdPaths {
+		content, err := ioutil.ReadFile(rootedPath(root, path))
+		if err != nil {
+			continue
+		}
+		// images typically ship an empty machine-id that is populated on first boot
+		if machineId := strings.TrimSpace(string(content)); machineId != "" {
+			return machineId
+		}
+	}
+	return ""
+}
+
+// Tags returns the global tags that identify the distribution, if known
+func (o *OsInfo) Tags() map[string]string {
+	tags := make(map[string]string)
+	if o.Distro != nil {
+		if o.Distro.ID != "" {
+			tags[OsIdTag] = o.Distro.ID
+		}
+		if o.Distro.VersionID != "" {
+			tags[OsVersionTag] = o.Distro.VersionID
+		}
+	}
+	return tags
+}
+
+// MergeTags returns the union of the tags, where the latter take precedence
+func MergeTags(tags ...map[string]string) map[string]string {
+	var merged map[string]string
+	for _, t := range tags {
+		for key, value := range t {
+			if merged == nil {
+				merged = make(map[string]string)
+			}
+			merged[key] = value
+		}
+	}
+	return merged
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newOsInfoRoot creates a filesystem with the testdata os-release file and the given machine-id
+func newOsInfoRoot(t *testing.T, machineId string) string {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	content, err := os.ReadFile(filepath.Join("testdata", "os-release"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "etc", "os-release"), content, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "etc", "machine-id"), []byte(machineId), 0444))
+	return root
+}
+
+func TestDetectOsInfo_alternateRoot(t *testing.T) {
+	root := newOsInfoRoot(t, "b08dfa6083e7567a1921a715000001fb\n")
+
+	// the kernel and hostname are of the host rather than the alternate root
+	assert.Equal(t, &OsInfo{
+		Distro: &OsRelease{
+			ID:              "ubuntu",
+			VersionID:       "18.04",
+			VersionCodename: "bionic",
+			PrettyName:      "Ubuntu 18.04.3 LTS",
+		},
+		MachineId: "b08dfa6083e7567a1921a715000001fb",
+	}, DetectOsInfo(root, zap.NewNop()))
+}
+
+func TestDetectOsInfo_unknown(t *testing.T) {
+	// like an image that hasn't been booted, with an empty machine-id
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "etc", "machine-id"), nil, 0444))
+
+	assert.Equal(t, &OsInfo{}, DetectOsInfo(root, zap.NewNop()))
+}
+
+func TestOsInfo_Tags(t *testing.T) {
+	info := &OsInfo{Distro: &OsRelease{ID: "arch"}, Arch: "x86_64"}
+	assert.Equal(t, map[string]string{"os_id": "arch"}, info.Tags())
+
+	info = &OsInfo{Distro: &OsRelease{ID: "debian", VersionID: "10", VersionCodename: "buster"}}
+	assert.Equal(t, map[string]string{"os_id": "debian", "os_version": "10"}, info.Tags())
+
+	assert.Empty(t, (&OsInfo{}).Tags())
+}
+
+func TestMergeTags(t *testing.T) {
+	assert.Equal(t, map[string]string{"os_id": "debian", "image": "app:1.0"},
+		MergeTags(map[string]string{"os_id": "ubuntu"}, map[string]string{"os_id": "debian", "image": "app:1.0"}))
+	assert.Nil(t, MergeTags(nil, map[string]string{}))
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// uname returns the kernel release and machine hardware name of the host
+func uname() (string, string, error) {
+	var utsname unix.Utsname
+	err := unix.Uname(&utsname)
+	if err != nil {
+		return "", "", err
+	}
+	return unix.ByteSliceToString(utsname.Release[:]), unix.ByteSliceToString(utsname.Machine[:]), nil
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"bufio"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"strings"
+)
+
+// osReleasePaths are tried in order, as specified by os-release(5)
+var osReleasePaths = []string{"/etc/os-release", "/usr/lib/os-release"}
+
+// OsRelease identifies the distribution of a filesystem, as declared by its os-release file
+type OsRelease struct {
+	// ID is the lower-case identifier of the distribution, such as debian or rhel
+	ID string `json:"id"`
+	// VersionID is the version of the distribution, such as 10 or 8.9, and is absent for
+	// rolling releases
+	VersionID string `json:"version-id,omitempty"`
+	// VersionCodename is the release codename, such as bionic, for the distributions that
+	// declare one
+	VersionCodename string `json:"version-codename,omitempty"`
+	PrettyName      string `json:"pretty-name,omitempty"`
+}
+
+// ReadOsRelease reads the os-release file of the filesystem at root
+func ReadOsRelease(root string) (*OsRelease, error) {
+	for _, path := range osReleasePaths {
+		file, err := os.Open(rootedPath(root, path))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to open os-release file: %w", err)
+		}
+		defer file.Close()
+
+		fields, err := parseOsRelease(file)
+		if err != nil {
+			return nil, err
+		}
+		return &OsRelease{
+			ID:              fields["ID"],
+			VersionID:       fields["VERSION_ID"],
+			VersionCodename: fields["VERSION_CODENAME"],
+			PrettyName:      fields["PRETTY_NAME"],
+		}, nil
+	}
+	return nil, fmt.Errorf("none of the os-release files exist: %v", osReleasePaths)
+}
+
+// DetectDistro reads the os-release file of the filesystem at root, returning nil when the
+// distribution can't be determined, such as for a minimal image without one
+func DetectDistro(root string, logger *zap.Logger) *OsRelease {
+	osRelease, err := ReadOsRelease(root)
+	if err != nil {
+		logger.Debug("unable to determine distribution", zap.Error(err))
+		return nil
+	}
+	return osRelease
+}
+
+// parseOsRelease parses the shell-compatible variable assignments of an os-release file
+func parseOsRelease(reader io.Reader) (map[string]string, error) {
+	fields := make(map[string]string)
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) < 2 {
+			// ignored rather than failed, like the shells that source the file
+			continue
+		}
+		fields[parts[0]] = unquoteOsReleaseValue(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read os-release file: %w", err)
+	}
+
+	return fields, nil
+}
+
+// unquoteOsReleaseValue removes the quotes of a value, where double-quoted values may
+// also contain backslash escapes
+func unquoteOsReleaseValue(value string) string {
+	if len(value) < 2 {
+		return value
+	}
+	switch {
+	case value[0] == '\'' && value[len(value)-1] == '\'':
+		return value[1 : len(value)-1]
+	case value[0] == '"' && value[len(value)-1] == '"':
+		var sb strings.Builder
+		value = value[1 : len(value)-1]
+		for i := 0; i < len(value); i++ {
+			if value[i] == '\\' && i+1 < len(value) {
+				i++
+			}
+			sb.WriteByte(value[i])
+		}
+		return sb.String()
+	default:
+		return value
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadOsRelease(t *testing.T) {
+	root, err := os.MkdirTemp("", "osrelease")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	// like most distributions, /etc/os-release is a relative symlink to /usr/lib/os-release
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "usr", "lib"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	content, err := os.ReadFile(filepath.Join("testdata", "os-release"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "usr", "lib", "os-release"), content, 0644))
+	require.NoError(t, os.Symlink("../usr/lib/os-release", filepath.Join(root, "etc", "os-release")))
+
+	osRelease, err := ReadOsRelease(root)
+	require.NoError(t, err)
+	assert.Equal(t, &OsRelease{
+		ID:              "ubuntu",
+		VersionID:       "18.04",
+		VersionCodename: "bionic",
+		PrettyName:      "Ubuntu 18.04.3 LTS",
+	}, osRelease)
+}
+
+func TestReadOsRelease_missing(t *testing.T) {
+	root, err := os.MkdirTemp("", "osrelease")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	_, err = ReadOsRelease(root)
+	assert.Error(t, err)
+}
+
+func TestParseOsRelease(t *testing.T) {
+	file, err := os.Open(filepath.Join("testdata", "os-release"))
+	require.NoError(t, err)
+	defer file.Close()
+
+	fields, err := parseOsRelease(file)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"NAME":              "Ubuntu",
+		"VERSION":           "18.04.3 LTS (Bionic Beaver)",
+		"ID":                "ubuntu",
+		"ID_LIKE":           "debian",
+		"PRETTY_NAME":       "Ubuntu 18.04.3 LTS",
+		"VERSION_ID":        "18.04",
+		"HOME_URL":          "https://www.ubuntu.com/",
+		"VERSION_CODENAME":  "bionic",
+		"UBUNTU_CODENAME":   "bionic",
+		"SUPPORT_STATEMENT": "Say \"hello\" to 'bionic'",
+	}, fields)
+}
@@ -0,0 +1,469 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"github.com/karrick/godirwalk"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// osvEcosystemSystems maps the OSV ecosystems that are matched, without their release, to the
+// packaging system whose version ordering they use
+var osvEcosystemSystems = map[string]string{
+	"Debian":      "debian",
+	"Ubuntu":      "debian",
+	"Alpine":      "apk",
+	"Rocky Linux": "rpm",
+	"AlmaLinux":   "rpm",
+	"PyPI":        "python",
+	"npm":         "npm",
+}
+
+// PackageVulnerability is an advisory of a vulnerability database that affects an installed
+// package
+type PackageVulnerability struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Arch     string `json:"arch,omitempty"`
+	Location string `json:"location,omitempty"`
+	// Id identifies the advisory, such as DSA-4633-1 or GHSA-gxpj-cx7g-858c
+	Id string `json:"id"`
+	// Aliases are the other identifiers of the vulnerability, such as its CVE
+	Aliases []string `json:"aliases,omitempty"`
+	// Severity is the rating given by the database of the advisory, such as "high", or
+	// otherwise its CVSS vector, if any
+	Severity string `json:"severity,omitempty"`
+	// FixedVersion is the version that fixes the vulnerability or empty when there is no fix
+	FixedVersion string `json:"fixed-version,omitempty"`
+}
+
+// osvAdvisory is the subset of the OSV schema, https://ossf.github.io/osv-schema/, that is
+// needed for matching
+type osvAdvisory struct {
+	Id               string        `json:"id"`
+	Aliases          []string      `json:"aliases"`
+	Withdrawn        string        `json:"withdrawn"`
+	Severity         []osvSeverity `json:"severity"`
+	Affected         []osvAffected `json:"affected"`
+	DatabaseSpecific struct {
+		Severity string `json:"severity"`
+	} `json:"database_specific"`
+}
+
+type osvSeverity struct {
+	Type  string `json:"type"`
+	Score string `json:"score"`
+}
+
+type osvAffected struct {
+	Package struct {
+		Ecosystem string `json:"ecosystem"`
+		Name      string `json:"name"`
+	} `json:"package"`
+	Ranges            []osvRange `json:"ranges"`
+	Versions          []string   `json:"versions"`
+	EcosystemSpecific struct {
+		Severity string `json:"severity"`
+		// Urgency is how Debian rates the severity
+		Urgency string `json:"urgency"`
+	} `json:"ecosystem_specific"`
+}
+
+type osvRange struct {
+	Type   string     `json:"type"`
+	Events []osvEvent `json:"events"`
+}
+
+// osvEvent is one of introduced, fixed, or last_affected. The limit events are only used by
+// the git ranges, which aren't evaluated.
+type osvEvent struct {
+	Introduced   string `json:"introduced"`
+	Fixed        string `json:"fixed"`
+	LastAffected string `json:"last_affected"`
+}
+
+func (e osvEvent) version() string {
+	switch {
+	case e.Introduced != "":
+		return e.Introduced
+	case e.Fixed != "":
+		return e.Fixed
+	default:
+		return e.LastAffected
+	}
+}
+
+// osvEntry is an affected package of an advisory
+type osvEntry struct {
+	// ecosystem includes the release, such as Debian:10
+	ecosystem string
+	id        string
+	aliases   []string
+	severity  string
+	ranges    []osvRange
+	versions  []string
+}
+
+type osvPackageKey struct {
+	// ecosystem excludes the release, such as Debian rather than Debian:10
+	ecosystem string
+	name      string
+}
+
+// OsvDatabase indexes the advisories of an OSV database export by the packages they affect
+type OsvDatabase struct {
+	entries    map[osvPackageKey][]*osvEntry
+	advisories int
+	// malformed is the number of advisories that were skipped since they couldn't be decoded
+	malformed int
+}
+
+// LoadOsvDatabase loads an OSV database export, which is either a zip file, such as the
+// all.zip of each ecosystem published by osv.dev, or a directory of advisory JSON files. Only
+// the affected packages of the ecosystems that can be matched are retained. An advisory that
+// can't be decoded is logged and skipped, rather than failing the whole export.
+func LoadOsvDatabase(path string, logger *zap.Logger) (*OsvDatabase, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access OSV database: %w", err)
+	}
+
+	db := &OsvDatabase{entries: make(map[osvPackageKey][]*osvEntry)}
+	if info.IsDir() {
+		err = db.loadDir(path, logger)
+	} else {
+		err = db.loadZip(path, logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (d *OsvDatabase) loadDir(dir string, logger *zap.Logger) error {
+	err := godirwalk.Walk(dir, &godirwalk.Options{
+		Callback: func(path string, dirent *godirwalk.Dirent) error {
+			if dirent.IsDir() || !strings.HasSuffix(path, ".json") {
+				return nil
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				return fmt.Errorf("failed to open OSV advisory: %w", err)
+			}
+			defer file.Close()
+			d.add(path, file, logger)
+			return nil
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load OSV database directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+func (d *OsvDatabase) loadZip(path string, logger *zap.Logger) error {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("failed to open OSV database zip: %w", err)
+	}
+	defer reader.Close()
+
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() || !strings.HasSuffix(file.Name, ".json") {
+			continue
+		}
+		content, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open OSV advisory %s: %w", file.Name, err)
+		}
+		d.add(file.Name, content, logger)
+		content.Close()
+	}
+	return nil
+}
+
+func (d *OsvDatabase) add(name string, reader io.Reader, logger *zap.Logger) {
+	var advisory osvAdvisory
+	err := json.NewDecoder(reader).Decode(&advisory)
+	if err != nil {
+		logger.Warn("skipping malformed OSV advisory", zap.String("name", name), zap.Error(err))
+		d.malformed++
+		return
+	}
+	if advisory.Withdrawn != "" {
+		return
+	}
+
+	added := false
+	for i := range advisory.Affected {
+		affected := &advisory.Affected[i]
+		ecosystem := osvEcosystemName(affected.Package.Ecosystem)
+		if _, ok := osvEcosystemSystems[ecosystem]; !ok {
+			continue
+		}
+		key := osvPackageKey{ecosystem: ecosystem, name: osvNormalizedName(ecosystem, affected.Package.Name)}
+		d.entries[key] = append(d.entries[key], &osvEntry{
+			ecosystem: affected.Package.Ecosystem,
+			id:        advisory.Id,
+			aliases:   advisory.Aliases,
+			severity:  osvSeverityRating(&advisory, affected),
+			ranges:    affected.Ranges,
+			versions:  affected.Versions,
+		})
+		added = true
+	}
+	if added {
+		d.advisories++
+	}
+}
+
+// osvEcosystemName removes the release from an ecosystem, such as Ubuntu:18.04:LTS
+func osvEcosystemName(ecosystem string) string {
+	return strings.SplitN(ecosystem, ":", 2)[0]
+}
+
+// osvEcosystem returns the OSV ecosystem of the packages of a packaging system, including the
+// release for the packages of a distribution, or empty when there are no advisories for them
+func osvEcosystem(system string, distro *OsRelease) string {
+	switch system {
+	case "python":
+		return "PyPI"
+	case "npm":
+		return "npm"
+	}
+	if distro == nil || distro.VersionID == "" {
+		return ""
+	}
+
+	release := strings.SplitN(distro.VersionID, ".", 3)
+	switch system + "/" + distro.ID {
+	case "debian/debian":
+		return "Debian:" + release[0]
+	case "debian/ubuntu":
+		return "Ubuntu:" + distro.VersionID
+	case "apk/alpine":
+		if len(release) < 2 {
+			return ""
+		}
+		return "Alpine:v" + release[0] + "." + release[1]
+	case "rpm/rocky":
+		return "Rocky Linux:" + release[0]
+	case "rpm/almalinux":
+		return "AlmaLinux:" + release[0]
+	}
+	return ""
+}
+
+// osvEcosystemMatches allows for the qualified releases of an ecosystem, such as
+// Ubuntu:18.04:LTS for Ubuntu:18.04
+func osvEcosystemMatches(affected, ecosystem string) bool {
+	return affected == ecosystem || strings.HasPrefix(affected, ecosystem+":")
+}
+
+// osvPackageName returns the name that the advisories of the ecosystem use for the package,
+// which is the source package for the distributions that publish advisories by source
+func osvPackageName(ecosystem string, pkg SoftwarePackage) string {
+	name := pkg.Name
+	switch ecosystem {
+	case "Debian", "Ubuntu":
+		if pkg.SourcePackage != "" {
+			name = pkg.SourcePackage
+		}
+	case "Alpine":
+		if origin := pkg.Extra["origin"]; origin != "" {
+			name = origin
+		}
+	}
+	return osvNormalizedName(ecosystem, name)
+}
+
+// osvNormalizedName normalizes the python package names, which are case-insensitive and
+// treat runs of separators as equivalent
+func osvNormalizedName(ecosystem, name string) string {
+	if ecosystem == "PyPI" {
+		return pythonNameSeparators.ReplaceAllString(strings.ToLower(name), "-")
+	}
+	return name
+}
+
+// osvSeverityRating prefers the rating of the database that published the advisory, such as
+// Debian's urgency or the severity of GitHub and Ubuntu, over a CVSS vector
+func osvSeverityRating(advisory *osvAdvisory, affected *osvAffected) string {
+	for _, rating := range []string{
+		affected.EcosystemSpecific.Severity,
+		affected.EcosystemSpecific.Urgency,
+		advisory.DatabaseSpecific.Severity,
+	} {
+		if rating != "" {
+			return strings.ToLower(rating)
+		}
+	}
+	for _, severity := range advisory.Severity {
+		if severity.Type == "Ubuntu" {
+			return strings.ToLower(severity.Score)
+		}
+	}
+	if len(advisory.Severity) > 0 {
+		return advisory.Severity[0].Score
+	}
+	return ""
+}
+
+// Match returns the advisories affecting the packages of a packaging system, where the
+// distro selects the release of the distribution's advisories. The packages of a packaging
+// system, or distribution, without an OSV ecosystem are not matched.
+func (d *OsvDatabase) Match(system string, packages []SoftwarePackage, distro *OsRelease) []PackageVulnerability {
+	ecosystem := osvEcosystem(system, distro)
+	if ecosystem == "" {
+		return nil
+	}
+	ecosystemName := osvEcosystemName(ecosystem)
+
+	var vulnerabilities []PackageVulnerability
+	for _, pkg := range packages {
+		key := osvPackageKey{ecosystem: ecosystemName, name: osvPackageName(ecosystemName, pkg)}
+
+		var matched []PackageVulnerability
+		ids := make(map[string]struct{})
+		for _, entry := range d.entries[key] {
+			if _, exists := ids[entry.id]; exists || !osvEcosystemMatches(entry.ecosystem, ecosystem) {
+				continue
+			}
+			affected, fixedVersion := entry.affects(system, pkg.Version)
+			if !affected {
+				continue
+			}
+			ids[entry.id] = struct{}{}
+			matched = append(matched, PackageVulnerability{
+				Name:         pkg.Name,
+				Version:      pkg.Version,
+				Arch:         pkg.Arch,
+				Location:     pkg.Location,
+				Id:           entry.id,
+				Aliases:      entry.aliases,
+				Severity:     entry.severity,
+				FixedVersion: fixedVersion,
+			})
+		}
+		sort.Slice(matched, func(i, j int) bool {
+			return matched[i].Id < matched[j].Id
+		})
+		vulnerabilities = append(vulnerabilities, matched...)
+	}
+	return vulnerabilities
+}
+
+// affects evaluates the version against the ranges and the explicitly listed versions of the
+// entry, returning the version that fixes it, when known
+func (e *osvEntry) affects(system, version string) (bool, string) {
+	for _, r := range e.ranges {
+		// git ranges are of commits rather than versions
+		if r.Type != "ECOSYSTEM" && r.Type != "SEMVER" {
+			continue
+		}
+		if affected, fixedVersion := r.affects(system, version); affected {
+			return true, fixedVersion
+		}
+	}
+	for _, v := range e.versions {
+		if CompareVersions(system, version, v) == 0 {
+			return true, ""
+		}
+	}
+	return false, ""
+}
+
+// affects evaluates the events of the range in version order, where a version is affected
+// from an introduced event until a fixed event or through a last_affected event
+func (r osvRange) affects(system, version string) (bool, string) {
+	events := make([]osvEvent, len(r.Events))
+	copy(events, r.Events)
+	sort.SliceStable(events, func(i, j int) bool {
+		// an introduced version of 0 is before all versions
+		if events[j].Introduced == "0" {
+			return false
+		}
+		if events[i].Introduced == "0" {
+			return true
+		}
+		return CompareVersions(system, events[i].version(), events[j].version()) < 0
+	})
+
+	affected := false
+	for _, event := range events {
+		switch {
+		case event.Introduced != "":
+			if event.Introduced != "0" && CompareVersions(system, version, event.Introduced) < 0 {
+				return affected, ""
+			}
+			affected = true
+		case event.Fixed != "":
+			if CompareVersions(system, version, event.Fixed) < 0 {
+				if affected {
+					return true, event.Fixed
+				}
+				return false, ""
+			}
+			affected = false
+		case event.LastAffected != "":
+			if CompareVersions(system, version, event.LastAffected) <= 0 {
+				return affected, ""
+			}
+			affected = false
+		}
+	}
+	return affected, ""
+}
+
+// osvDatabaseLoader reloads an OSV database when its export is replaced, such as by a
+// periodic sync, and otherwise reuses the database that was previously loaded
+type osvDatabaseLoader struct {
+	path    string
+	modTime time.Time
+	db      *OsvDatabase
+}
+
+// load returns the current database and if it was reloaded. The previously loaded database,
+// if any, continues to be used when the export can't be loaded.
+func (l *osvDatabaseLoader) load(logger *zap.Logger) (*OsvDatabase, bool) {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		logger.Warn("failed to access OSV database", zap.String("path", l.path), zap.Error(err))
+		return l.db, false
+	}
+	if l.db != nil && info.ModTime().Equal(l.modTime) {
+		return l.db, false
+	}
+
+	db, err := LoadOsvDatabase(l.path, logger)
+	if err != nil {
+		logger.Warn("failed to load OSV database", zap.String("path", l.path), zap.Error(err))
+		return l.db, false
+	}
+	logger.Info("loaded OSV database", zap.String("path", l.path),
+		zap.Int("advisories", db.advisories), zap.Int("malformed", db.malformed))
+	l.db, l.modTime = db, info.ModTime()
+	return db, true
+}
@@ -0,0 +1,296 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"archive/zip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func loadTestOsvDatabase(t *testing.T) *OsvDatabase {
+	db, err := LoadOsvDatabase(filepath.Join("testdata", "osv"), zap.NewNop())
+	require.NoError(t, err)
+	return db
+}
+
+func TestLoadOsvDatabase_dir(t *testing.T) {
+	db := loadTestOsvDatabase(t)
+
+	// the withdrawn advisory and the one of the Go ecosystem are left out
+	assert.Equal(t, 9, db.advisories)
+	assert.NotContains(t, db.entries, osvPackageKey{ecosystem: "Go", name: "golang.org/x/net"})
+	assert.Len(t, db.entries[osvPackageKey{ecosystem: "npm", name: "debug"}], 3)
+	assert.Len(t, db.entries[osvPackageKey{ecosystem: "PyPI", name: "pyyaml"}], 1)
+}
+
+func TestLoadOsvDatabase_zip(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "all.zip")
+	zipFile, err := os.Create(zipPath)
+	require.NoError(t, err)
+	writer := zip.NewWriter(zipFile)
+	advisories, err := filepath.Glob(filepath.Join("testdata", "osv", "*.json"))
+	require.NoError(t, err)
+	for _, advisory := range advisories {
+		content, err := os.ReadFile(advisory)
+		require.NoError(t, err)
+		entry, err := writer.Create(filepath.Base(advisory))
+		require.NoError(t, err)
+		_, err = entry.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	require.NoError(t, zipFile.Close())
+
+	db, err := LoadOsvDatabase(zipPath, zap.NewNop())
+	require.NoError(t, err)
+
+	assert.Equal(t, loadTestOsvDatabase(t), db)
+}
+
+func TestLoadOsvDatabase_malformed(t *testing.T) {
+	dir := t.TempDir()
+	content, err := os.ReadFile(filepath.Join("testdata", "osv", "DSA-4633-1.json"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "DSA-4633-1.json"), content, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "GHSA-bad.json"), []byte(`{"id": `), 0644))
+
+	// the malformed advisory is skipped and the others are still loaded
+	db, err := LoadOsvDatabase(dir, zap.NewNop())
+	require.NoError(t, err)
+	assert.Equal(t, 1, db.advisories)
+	assert.Equal(t, 1, db.malformed)
+
+	_, err = LoadOsvDatabase(filepath.Join(dir, "missing.zip"), zap.NewNop())
+	assert.Error(t, err)
+}
+
+func TestOsvDatabase_Match_debian(t *testing.T) {
+	db := loadTestOsvDatabase(t)
+
+	vulnerabilities := db.Match("debian", []SoftwarePackage{
+		{Name: "curl", Version: "7.64.0-4", Arch: "amd64", SourcePackage: "curl"},
+		{Name: "libc6", Version: "2.28-10", Arch: "amd64", SourcePackage: "glibc"},
+		{Name: "libc-bin", Version: "2.28-10+deb10u1", Arch: "amd64", SourcePackage: "glibc"},
+		{Name: "tzdata", Version: "2019c-0+deb10u1", Arch: "all", SourcePackage: "tzdata"},
+	}, &OsRelease{ID: "debian", VersionID: "10"})
+
+	assert.Equal(t, []PackageVulnerability{
+		{Name: "curl", Version: "7.64.0-4", Arch: "amd64", Id: "DSA-4633-1",
+			Aliases:      []string{"CVE-2019-5436", "CVE-2019-5481", "CVE-2019-5482"},
+			FixedVersion: "7.64.0-4+deb10u1"},
+		{Name: "libc6", Version: "2.28-10", Arch: "amd64", Id: "DEBIAN-CVE-2021-3326",
+			Severity: "low", FixedVersion: "2.28-10+deb10u1"},
+	}, vulnerabilities)
+
+	// the advisories of another release don't apply
+	assert.Empty(t, db.Match("debian", []SoftwarePackage{
+		{Name: "libc6", Version: "2.28-10", Arch: "amd64", SourcePackage: "glibc"},
+	}, &OsRelease{ID: "debian", VersionID: "12"}))
+}
+
+func TestOsvDatabase_Match_ubuntu(t *testing.T) {
+	db := loadTestOsvDatabase(t)
+	packages := []SoftwarePackage{
+		{Name: "sudo", Version: "1.8.21p2-3ubuntu1.1", Arch: "amd64", SourcePackage: "sudo"},
+	}
+
+	assert.Equal(t, []PackageVulnerability{
+		{Name: "sudo", Version: "1.8.21p2-3ubuntu1.1", Arch: "amd64", Id: "UBUNTU-CVE-2019-18634",
+			Severity: "medium", FixedVersion: "1.8.21p2-3ubuntu1.2"},
+	}, db.Match("debian", packages, &OsRelease{ID: "ubuntu", VersionID: "18.04"}))
+
+	// only the Pro subscription has advisories for 16.04
+	assert.Empty(t, db.Match("debian", packages, &OsRelease{ID: "ubuntu", VersionID: "16.04"}))
+}
+
+func TestOsvDatabase_Match_alpine(t *testing.T) {
+	db := loadTestOsvDatabase(t)
+
+	vulnerabilities := db.Match("apk", []SoftwarePackage{
+		{Name: "musl", Version: "1.1.22-r2", Arch: "x86_64", Extra: map[string]string{"origin": "musl"}},
+		// advisories are by origin
+		{Name: "musl-utils", Version: "1.1.22-r2", Arch: "x86_64", Extra: map[string]string{"origin": "musl"}},
+		{Name: "busybox", Version: "1.30.1-r2", Arch: "x86_64", Extra: map[string]string{"origin": "busybox"}},
+	}, &OsRelease{ID: "alpine", VersionID: "3.10.2"})
+
+	assert.Equal(t, []PackageVulnerability{
+		{Name: "musl", Version: "1.1.22-r2", Arch: "x86_64", Id: "ALPINE-CVE-2019-14697", FixedVersion: "1.1.22-r3"},
+		{Name: "musl-utils", Version: "1.1.22-r2", Arch: "x86_64", Id: "ALPINE-CVE-2019-14697", FixedVersion: "1.1.22-r3"},
+	}, vulnerabilities)
+
+	assert.Empty(t, db.Match("apk", []SoftwarePackage{
+		{Name: "musl", Version: "1.1.22-r3", Arch: "x86_64", Extra: map[string]string{"origin": "musl"}},
+	}, &OsRelease{ID: "alpine", VersionID: "3.10.2"}))
+}
+
+func TestOsvDatabase_Match_rpm(t *testing.T) {
+	db := loadTestOsvDatabase(t)
+
+	assert.Equal(t, []PackageVulnerability{
+		{Name: "bind-libs", Version: "32:9.11.20-5.el8", Arch: "x86_64", Id: "RLSA-2021:1989",
+			Severity: "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:H", FixedVersion: "32:9.11.26-4.el8_4"},
+	}, db.Match("rpm", []SoftwarePackage{
+		{Name: "bind-libs", Version: "32:9.11.20-5.el8", Arch: "x86_64"},
+		{Name: "bind-utils", Version: "32:9.11.20-5.el8", Arch: "x86_64"},
+	}, &OsRelease{ID: "rocky", VersionID: "8.3"}))
+
+	assert.Equal(t, []PackageVulnerability{
+		{Name: "openssl-libs", Version: "1:3.0.7-16.el9_2", Arch: "x86_64", Id: "ALSA-2023:4327",
+			Aliases: []string{"CVE-2023-2650"}, FixedVersion: "1:3.0.7-18.el9_2"},
+	}, db.Match("rpm", []SoftwarePackage{
+		{Name: "openssl-libs", Version: "1:3.0.7-16.el9_2", Arch: "x86_64"},
+	}, &OsRelease{ID: "almalinux", VersionID: "9.2"}))
+
+	// there are no advisories for the distribution
+	assert.Nil(t, db.Match("rpm", []SoftwarePackage{
+		{Name: "bind-libs", Version: "32:9.11.20-5.el8", Arch: "x86_64"},
+	}, &OsRelease{ID: "fedora", VersionID: "33"}))
+	assert.Nil(t, db.Match("rpm", []SoftwarePackage{
+		{Name: "bind-libs", Version: "32:9.11.20-5.el8", Arch: "x86_64"},
+	}, nil))
+}
+
+func TestOsvDatabase_Match_python(t *testing.T) {
+	db := loadTestOsvDatabase(t)
+
+	vulnerabilities := db.Match("python", []SoftwarePackage{
+		{Name: "PyYAML", Version: "5.3.1", Location: "/usr/lib/python3/dist-packages"},
+		{Name: "urllib3", Version: "1.24.3", Location: "/usr/lib/python3/dist-packages"},
+		{Name: "urllib3", Version: "1.26.4", Location: "/srv/venv/lib/python3.8/site-packages"},
+		{Name: "urllib3", Version: "1.26.5", Location: "/opt/app/lib/python3.8/site-packages"},
+	}, nil)
+
+	assert.Equal(t, []PackageVulnerability{
+		{Name: "PyYAML", Version: "5.3.1", Location: "/usr/lib/python3/dist-packages", Id: "GHSA-8q59-q68h-6hv4",
+			Aliases: []string{"CVE-2020-14343", "PYSEC-2021-142"}, Severity: "critical", FixedVersion: "5.4"},
+		{Name: "urllib3", Version: "1.26.4", Location: "/srv/venv/lib/python3.8/site-packages", Id: "GHSA-q2q7-5pp4-w6pg",
+			Aliases: []string{"CVE-2021-33503", "PYSEC-2021-108"}, Severity: "high", FixedVersion: "1.26.5"},
+	}, vulnerabilities)
+}
+
+func TestOsvDatabase_Match_npm(t *testing.T) {
+	db := loadTestOsvDatabase(t)
+
+	vulnerabilities := db.Match("npm", []SoftwarePackage{
+		{Name: "debug", Version: "2.6.8", Location: "/srv/app/node_modules/send/node_modules/debug"},
+		{Name: "debug", Version: "3.1.0", Location: "/srv/app/node_modules/finalhandler/node_modules/debug"},
+		{Name: "debug", Version: "3.2.6", Location: "/srv/app/node_modules/mocha/node_modules/debug"},
+		{Name: "debug", Version: "4.1.1", Location: "/srv/app/node_modules/debug"},
+		{Name: "debug", Version: "4.3.4", Location: "/usr/lib/node_modules/npm/node_modules/debug"},
+	}, nil)
+
+	expected := func(version, location, fixedVersion string) PackageVulnerability {
+		return PackageVulnerability{Name: "debug", Version: version, Location: location, Id: "GHSA-gxpj-cx7g-858c",
+			Aliases: []string{"CVE-2017-16137"}, Severity: "low", FixedVersion: fixedVersion}
+	}
+	assert.Equal(t, []PackageVulnerability{
+		expected("2.6.8", "/srv/app/node_modules/send/node_modules/debug", "2.6.9"),
+		expected("3.2.6", "/srv/app/node_modules/mocha/node_modules/debug", "3.2.7"),
+		expected("4.1.1", "/srv/app/node_modules/debug", "4.3.1"),
+	}, vulnerabilities)
+}
+
+func TestOsvRange_affects(t *testing.T) {
+	tests := []struct {
+		name         string
+		events       []osvEvent
+		version      string
+		affected     bool
+		fixedVersion string
+	}{
+		{"fixed", []osvEvent{{Introduced: "0"}, {Fixed: "1.2"}}, "1.1", true, "1.2"},
+		{"at fixed", []osvEvent{{Introduced: "0"}, {Fixed: "1.2"}}, "1.2", false, ""},
+		{"before introduced", []osvEvent{{Introduced: "1.0"}, {Fixed: "1.2"}}, "0.9", false, ""},
+		{"not fixed", []osvEvent{{Introduced: "1.0"}}, "3.0", true, ""},
+		{"last affected", []osvEvent{{Introduced: "0"}, {LastAffected: "1.2"}}, "1.2", true, ""},
+		{"after last affected", []osvEvent{{Introduced: "0"}, {LastAffected: "1.2"}}, "1.2.1", false, ""},
+		{"reintroduced", []osvEvent{{Introduced: "0"}, {Fixed: "1.2"}, {Introduced: "2.0"}}, "2.1", true, ""},
+		{"between ranges", []osvEvent{{Introduced: "0"}, {Fixed: "1.2"}, {Introduced: "2.0"}}, "1.5", false, ""},
+		{"unsorted", []osvEvent{{Fixed: "2.1"}, {Fixed: "1.2"}, {Introduced: "2.0"}, {Introduced: "0"}}, "2.0.1", true, "2.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			affected, fixedVersion := osvRange{Type: "ECOSYSTEM", Events: test.events}.affects("python", test.version)
+			assert.Equal(t, test.affected, affected)
+			assert.Equal(t, test.fixedVersion, fixedVersion)
+		})
+	}
+}
+
+func TestOsvEcosystem(t *testing.T) {
+	assert.Equal(t, "Debian:10", osvEcosystem("debian", &OsRelease{ID: "debian", VersionID: "10"}))
+	assert.Equal(t, "Ubuntu:22.04", osvEcosystem("debian", &OsRelease{ID: "ubuntu", VersionID: "22.04"}))
+	assert.Equal(t, "Alpine:v3.18", osvEcosystem("apk", &OsRelease{ID: "alpine", VersionID: "3.18.4"}))
+	assert.Equal(t, "Rocky Linux:8", osvEcosystem("rpm", &OsRelease{ID: "rocky", VersionID: "8.9"}))
+	assert.Equal(t, "AlmaLinux:9", osvEcosystem("rpm", &OsRelease{ID: "almalinux", VersionID: "9.2"}))
+	assert.Equal(t, "PyPI", osvEcosystem("python", nil))
+	assert.Equal(t, "npm", osvEcosystem("npm", &OsRelease{ID: "alpine", VersionID: "3.18.4"}))
+
+	// the testing release of debian has no version
+	assert.Empty(t, osvEcosystem("debian", &OsRelease{ID: "debian"}))
+	assert.Empty(t, osvEcosystem("rpm", &OsRelease{ID: "rhel", VersionID: "8.1"}))
+	assert.Empty(t, osvEcosystem("pacman", &OsRelease{ID: "arch"}))
+}
+
+func TestOsvDatabaseLoader(t *testing.T) {
+	dir := t.TempDir()
+	content, err := os.ReadFile(filepath.Join("testdata", "osv", "DSA-4633-1.json"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "DSA-4633-1.json"), content, 0644))
+
+	loader := &osvDatabaseLoader{path: dir}
+	db, reloaded := loader.load(zap.NewNop())
+	require.NotNil(t, db)
+	assert.True(t, reloaded)
+	assert.Equal(t, 1, db.advisories)
+
+	again, reloaded := loader.load(zap.NewNop())
+	assert.False(t, reloaded)
+	assert.Same(t, db, again)
+
+	// a sync replaces the export
+	content, err = os.ReadFile(filepath.Join("testdata", "osv", "GHSA-gxpj-cx7g-858c.json"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "GHSA-gxpj-cx7g-858c.json"), content, 0644))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(dir, later, later))
+
+	db, reloaded = loader.load(zap.NewNop())
+	assert.True(t, reloaded)
+	assert.Equal(t, 2, db.advisories)
+
+	// a malformed advisory is skipped rather than the whole export
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "GHSA-bad.json"), []byte(`{`), 0644))
+	evenLater := later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(dir, evenLater, evenLater))
+	db, reloaded = loader.load(zap.NewNop())
+	assert.True(t, reloaded)
+	assert.Equal(t, 2, db.advisories)
+	assert.Equal(t, 1, db.malformed)
+
+	// the previous database continues to be used when the export is missing
+	require.NoError(t, os.RemoveAll(dir))
+	again, reloaded = loader.load(zap.NewNop())
+	assert.False(t, reloaded)
+	assert.Same(t, db, again)
+}
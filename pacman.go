@@ -0,0 +1,172 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	pacmanLocalPath = "/var/lib/pacman/local"
+	pacmanDescName  = "desc"
+)
+
+// pacmanExtraFields maps the section names of a pacman desc file to the names used in the
+// Extra fields of each package
+var pacmanExtraFields = map[string]string{
+	"INSTALLDATE": "install-date",
+	"PACKAGER":    "packager",
+}
+
+// pacmanLister reads the pacman local database, which is a directory per installed package
+// containing a desc file of %SECTION% headers each followed by value lines
+type pacmanLister struct {
+	localPath string
+	logger    *zap.Logger
+}
+
+// PacmanLister creates a lister for the packages installed by Arch Linux's pacman in the
+// filesystem at root
+func PacmanLister(root string, logger *zap.Logger) SoftwarePackageLister {
+	return &pacmanLister{
+		localPath: rootedPath(root, pacmanLocalPath),
+		logger:    logger,
+	}
+}
+
+func (p *pacmanLister) PackagingSystem() string {
+	return "pacman"
+}
+
+func (p *pacmanLister) IsSupported() bool {
+	info, err := os.Stat(p.localPath)
+	return err == nil && info.IsDir()
+}
+
+// WatchPaths declares the local database directory, where each package is a directory that
+// is created when it is installed and removed when it is uninstalled
+func (p *pacmanLister) WatchPaths() []string {
+	return []string{p.localPath}
+}
+
+func (p *pacmanLister) Fingerprint() (string, error) {
+	return fingerprintPaths(p.WatchPaths())
+}
+
+func (p *pacmanLister) ListPackages(ctx context.Context) ([]SoftwarePackage, error) {
+	p.logger.Debug("reading pacman local database", zap.String("path", p.localPath))
+	entries, err := ioutil.ReadDir(p.localPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pacman local database: %w", err)
+	}
+
+	var pkgs []SoftwarePackage
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !entry.IsDir() {
+			continue
+		}
+
+		descPath := filepath.Join(p.localPath, entry.Name(), pacmanDescName)
+		pkg, err := readPacmanDesc(descPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				p.logger.Warn("pacman package entry is missing its desc file", zap.String("path", descPath))
+				continue
+			}
+			return nil, err
+		}
+		pkgs = append(pkgs, pkg)
+	}
+
+	return pkgs, nil
+}
+
+func readPacmanDesc(path string) (SoftwarePackage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return SoftwarePackage{}, err
+	}
+	defer file.Close()
+
+	pkg, err := parsePacmanDesc(file)
+	if err != nil {
+		return SoftwarePackage{}, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return pkg, nil
+}
+
+func parsePacmanDesc(reader io.Reader) (SoftwarePackage, error) {
+	pkg := SoftwarePackage{Extra: make(map[string]string)}
+
+	scanner := bufio.NewScanner(reader)
+	section := ""
+	sectionLines := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			section = ""
+			continue
+		}
+		if section == "" {
+			if !strings.HasPrefix(line, "%") || !strings.HasSuffix(line, "%") || len(line) < 3 {
+				return SoftwarePackage{}, fmt.Errorf("expected a section header, but got: %s", line)
+			}
+			section = strings.Trim(line, "%")
+			sectionLines = 0
+			continue
+		}
+
+		// only the first value of multi-valued sections is relevant for the fields we use
+		sectionLines++
+		if sectionLines > 1 {
+			continue
+		}
+		switch section {
+		case "NAME":
+			pkg.Name = line
+		case "VERSION":
+			pkg.Version = line
+		case "ARCH":
+			pkg.Arch = line
+		default:
+			if name, ok := pacmanExtraFields[section]; ok {
+				pkg.Extra[name] = line
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return SoftwarePackage{}, err
+	}
+
+	if pkg.Name == "" {
+		return SoftwarePackage{}, errors.New("missing the %NAME% section")
+	}
+	return pkg, nil
+}
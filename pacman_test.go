@@ -0,0 +1,68 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPacmanLister_ListPackages(t *testing.T) {
+	lister := &pacmanLister{
+		localPath: filepath.Join("testdata", "pacman", "local"),
+		logger:    zap.NewNop(),
+	}
+
+	assert.Equal(t, "pacman", lister.PackagingSystem())
+	require.True(t, lister.IsSupported())
+
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	// broken-1.0-1 has no desc file and is skipped
+	require.Len(t, packages, 2)
+
+	assert.Equal(t, SoftwarePackage{
+		Name:    "bash",
+		Version: "5.2.015-1",
+		Arch:    "x86_64",
+		Extra: map[string]string{
+			"install-date": "1700000000",
+			"packager":     "Felix Yan <felixonmars@archlinux.org>",
+		},
+	}, packages[0])
+	assert.Equal(t, "glibc", packages[1].Name)
+	assert.Equal(t, "2.38-7", packages[1].Version)
+}
+
+func TestPacmanLister_notSupported(t *testing.T) {
+	lister := &pacmanLister{
+		localPath: filepath.Join("testdata", "not-pacman", "local"),
+		logger:    zap.NewNop(),
+	}
+
+	assert.False(t, lister.IsSupported())
+}
+
+func TestParsePacmanDesc_missingName(t *testing.T) {
+	_, err := parsePacmanDesc(strings.NewReader("%VERSION%\n1.0-1\n\n"))
+	assert.EqualError(t, err, "missing the %NAME% section")
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// purlTypes declares the package URL type of each packaging system that has one, as specified
+// by https://github.com/package-url/purl-spec
+var purlTypes = map[string]struct {
+	typ string
+	// namespace is used when the distribution of an operating system package is unknown
+	namespace string
+	// distro indicates an operating system package, which is namespaced and qualified by the
+	// distribution
+	distro bool
+	// lowerName indicates a name that is not case sensitive and is lower-cased
+	lowerName bool
+}{
+	"debian": {typ: "deb", namespace: "debian", distro: true, lowerName: true},
+	"rpm":    {typ: "rpm", distro: true},
+	"apk":    {typ: "apk", namespace: "alpine", distro: true, lowerName: true},
+	"pacman": {typ: "alpm", namespace: "arch", distro: true, lowerName: true},
+	"npm":    {typ: "npm", lowerName: true},
+	"python": {typ: "pypi", lowerName: true},
+	"gomod":  {typ: "golang"},
+}
+
+// Qualifiers of package URLs
+const (
+	PurlArchQualifier   = "arch"
+	PurlDistroQualifier = "distro"
+	PurlEpochQualifier  = "epoch"
+)
+
+// pythonNameSeparators are replaced to normalize python distribution names, as specified by PEP 503
+var pythonNameSeparators = regexp.MustCompile(`[-_.]+`)
+
+// PackageURL is the decomposed form of a package URL
+type PackageURL struct {
+	Type       string
+	Namespace  string
+	Name       string
+	Version    string
+	Qualifiers map[string]string
+	Subpath    string
+}
+
+// buildPackageURL returns the package URL of a package of the given packaging system, or nil
+// when the packaging system has no package URL type. The distro, when known, namespaces and
+// qualifies the package URLs of operating system packages.
+func buildPackageURL(system string, pkg SoftwarePackage, distro *OsRelease) *PackageURL {
+	purlType, ok := purlTypes[system]
+	if !ok || pkg.Name == "" {
+		return nil
+	}
+
+	purl := &PackageURL{
+		Type:       purlType.typ,
+		Namespace:  purlType.namespace,
+		Name:       pkg.Name,
+		Version:    pkg.Version,
+		Qualifiers: make(map[string]string),
+	}
+	if purlType.lowerName {
+		purl.Name = strings.ToLower(purl.Name)
+	}
+	if pkg.Arch != "" {
+		purl.Qualifiers[PurlArchQualifier] = pkg.Arch
+	}
+
+	switch purl.Type {
+	case "npm", "golang":
+		// scoped npm packages and go module paths carry their namespace in the name
+		if slash := strings.LastIndexByte(purl.Name, '/'); slash >= 0 {
+			purl.Namespace, purl.Name = purl.Name[:slash], purl.Name[slash+1:]
+		}
+	case "pypi":
+		purl.Name = pythonNameSeparators.ReplaceAllString(purl.Name, "-")
+	case "rpm":
+		// the epoch of an rpm is a qualifier rather than a prefix of the version
+		if epoch := versionEpoch(purl.Version); epoch != "" {
+			purl.Qualifiers[PurlEpochQualifier] = epoch
+			purl.Version = purl.Version[len(epoch)+1:]
+		}
+	}
+
+	if purlType.distro && distro != nil && distro.ID != "" {
+		purl.Namespace = strings.ToLower(distro.ID)
+		if distro.VersionID != "" {
+			purl.Qualifiers[PurlDistroQualifier] = purl.Namespace + "-" + distro.VersionID
+		}
+	}
+
+	return purl
+}
+
+// packagePurl returns the package URL of the package as populated by the collection or, when
+// not populated, as built without knowing the distribution
+func packagePurl(system string, pkg SoftwarePackage) string {
+	if pkg.Purl != "" {
+		return pkg.Purl
+	}
+	return buildPackageURL(system, pkg, nil).String()
+}
+
+// String formats the package URL in its canonical form, where the qualifiers are sorted by key.
+// A nil package URL formats as an empty string.
+func (p *PackageURL) String() string {
+	if p == nil {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("pkg:")
+	sb.WriteString(p.Type)
+	sb.WriteString("/")
+	if p.Namespace != "" {
+		for _, segment := range strings.Split(p.Namespace, "/") {
+			sb.WriteString(purlEscape(segment))
+			sb.WriteString("/")
+		}
+	}
+	sb.WriteString(purlEscape(p.Name))
+	if p.Version != "" {
+		sb.WriteString("@")
+		sb.WriteString(purlEscape(p.Version))
+	}
+
+	keys := make([]string, 0, len(p.Qualifiers))
+	for key, value := range p.Qualifiers {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		if i == 0 {
+			sb.WriteString("?")
+		} else {
+			sb.WriteString("&")
+		}
+		sb.WriteString(key)
+		sb.WriteString("=")
+		sb.WriteString(purlEscape(p.Qualifiers[key]))
+	}
+
+	if p.Subpath != "" {
+		sb.WriteString("#")
+		for i, segment := range strings.Split(p.Subpath, "/") {
+			if i > 0 {
+				sb.WriteString("/")
+			}
+			sb.WriteString(purlEscape(segment))
+		}
+	}
+	return sb.String()
+}
+
+// purlEscape percent-encodes a component of a package URL, leaving the characters that the
+// specification allows unencoded
+func purlEscape(s string) string {
+	const hex = "0123456789ABCDEF"
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '.', c == '-', c == '_', c == '~', c == ':':
+			sb.WriteByte(c)
+		default:
+			sb.WriteByte('%')
+			sb.WriteByte(hex[c>>4])
+			sb.WriteByte(hex[c&0xf])
+		}
+	}
+	return sb.String()
+}
+
+// parsePackageURL decomposes a package URL, following the parsing rules of the specification
+func parsePackageURL(s string) (*PackageURL, error) {
+	remainder := s
+	if len(remainder) < 4 || !strings.EqualFold(remainder[:4], "pkg:") {
+		return nil, fmt.Errorf("package URL %q does not have the pkg scheme", s)
+	}
+	remainder = strings.TrimLeft(remainder[4:], "/")
+
+	purl := &PackageURL{Qualifiers: make(map[string]string)}
+	var err error
+
+	if hash := strings.LastIndexByte(remainder, '#'); hash >= 0 {
+		var segments []string
+		for _, segment := range strings.Split(remainder[hash+1:], "/") {
+			if segment == "" || segment == "." || segment == ".." {
+				continue
+			}
+			segment, err = url.PathUnescape(segment)
+			if err != nil {
+				return nil, fmt.Errorf("package URL %q has an invalid subpath: %w", s, err)
+			}
+			segments = append(segments, segment)
+		}
+		purl.Subpath = strings.Join(segments, "/")
+		remainder = remainder[:hash]
+	}
+
+	if question := strings.LastIndexByte(remainder, '?'); question >= 0 {
+		for _, pair := range strings.Split(remainder[question+1:], "&") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) < 2 || parts[1] == "" {
+				continue
+			}
+			value, err := url.PathUnescape(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("package URL %q has an invalid qualifier: %w", s, err)
+			}
+			purl.Qualifiers[strings.ToLower(parts[0])] = value
+		}
+		remainder = remainder[:question]
+	}
+
+	remainder = strings.TrimRight(remainder, "/")
+	if at := strings.LastIndexByte(remainder, '@'); at >= 0 {
+		purl.Version, err = url.PathUnescape(remainder[at+1:])
+		if err != nil {
+			return nil, fmt.Errorf("package URL %q has an invalid version: %w", s, err)
+		}
+		remainder = remainder[:at]
+	}
+
+	segments := strings.Split(remainder, "/")
+	if len(segments) < 2 || segments[0] == "" {
+		return nil, fmt.Errorf("package URL %q is missing the type or name", s)
+	}
+	purl.Type = strings.ToLower(segments[0])
+	for i, segment := range segments[1:] {
+		segment, err = url.PathUnescape(segment)
+		if err != nil {
+			return nil, fmt.Errorf("package URL %q has an invalid name: %w", s, err)
+		}
+		if i == len(segments)-2 {
+			purl.Name = segment
+		} else if segment != "" {
+			if purl.Namespace != "" {
+				purl.Namespace += "/"
+			}
+			purl.Namespace += segment
+		}
+	}
+	if purl.Name == "" {
+		return nil, fmt.Errorf("package URL %q is missing the name", s)
+	}
+
+	return purl, nil
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestBuildPackageURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		system   string
+		pkg      SoftwarePackage
+		distro   *OsRelease
+		expected string
+	}{
+		{
+			name:     "debian",
+			system:   "debian",
+			pkg:      SoftwarePackage{Name: "libstdc++6", Version: "8.3.0-6", Arch: "amd64"},
+			distro:   &OsRelease{ID: "debian", VersionID: "10"},
+			expected: "pkg:deb/debian/libstdc%2B%2B6@8.3.0-6?arch=amd64&distro=debian-10",
+		},
+		{
+			name:     "ubuntu epoch in version",
+			system:   "debian",
+			pkg:      SoftwarePackage{Name: "zlib1g", Version: "1:1.2.11.dfsg-0ubuntu2", Arch: "amd64"},
+			distro:   &OsRelease{ID: "ubuntu", VersionID: "18.04"},
+			expected: "pkg:deb/ubuntu/zlib1g@1:1.2.11.dfsg-0ubuntu2?arch=amd64&distro=ubuntu-18.04",
+		},
+		{
+			name:     "debian unknown distro",
+			system:   "debian",
+			pkg:      SoftwarePackage{Name: "tzdata", Version: "2019c-0+deb10u1", Arch: "all"},
+			expected: "pkg:deb/debian/tzdata@2019c-0%2Bdeb10u1?arch=all",
+		},
+		{
+			name:     "rpm epoch qualifier",
+			system:   "rpm",
+			pkg:      SoftwarePackage{Name: "dbus-common", Version: "1:1.12.8-7.el8", Arch: "noarch"},
+			distro:   &OsRelease{ID: "rhel", VersionID: "8.1"},
+			expected: "pkg:rpm/rhel/dbus-common@1.12.8-7.el8?arch=noarch&distro=rhel-8.1&epoch=1",
+		},
+		{
+			name:     "rpm unknown distro",
+			system:   "rpm",
+			pkg:      SoftwarePackage{Name: "tzdata", Version: "2019a-1.el8", Arch: "noarch"},
+			expected: "pkg:rpm/tzdata@2019a-1.el8?arch=noarch",
+		},
+		{
+			name:     "apk",
+			system:   "apk",
+			pkg:      SoftwarePackage{Name: "musl", Version: "1.2.4-r2", Arch: "x86_64"},
+			distro:   &OsRelease{ID: "alpine", VersionID: "3.18.4"},
+			expected: "pkg:apk/alpine/musl@1.2.4-r2?arch=x86_64&distro=alpine-3.18.4",
+		},
+		{
+			name:     "pacman rolling release",
+			system:   "pacman",
+			pkg:      SoftwarePackage{Name: "glibc", Version: "2.38-7", Arch: "x86_64"},
+			distro:   &OsRelease{ID: "arch"},
+			expected: "pkg:alpm/arch/glibc@2.38-7?arch=x86_64",
+		},
+		{
+			name:     "scoped npm",
+			system:   "npm",
+			pkg:      SoftwarePackage{Name: "@babel/core", Version: "7.23.2", Location: "/srv/app/node_modules/@babel/core"},
+			distro:   &OsRelease{ID: "debian", VersionID: "10"},
+			expected: "pkg:npm/%40babel/core@7.23.2",
+		},
+		{
+			name:     "python normalized",
+			system:   "python",
+			pkg:      SoftwarePackage{Name: "Zope.Interface", Version: "6.1"},
+			expected: "pkg:pypi/zope-interface@6.1",
+		},
+		{
+			name:     "go module",
+			system:   "gomod",
+			pkg:      SoftwarePackage{Name: "github.com/stretchr/testify", Version: "v1.4.0"},
+			expected: "pkg:golang/github.com/stretchr/testify@v1.4.0",
+		},
+		{
+			name:   "no purl type",
+			system: "snap",
+			pkg:    SoftwarePackage{Name: "core20", Version: "20230801"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			purl := buildPackageURL(tt.system, tt.pkg, tt.distro)
+			assert.Equal(t, tt.expected, purl.String())
+
+			if tt.expected != "" {
+				parsed, err := parsePackageURL(tt.expected)
+				require.NoError(t, err)
+				assert.Equal(t, purl, parsed)
+			}
+		})
+	}
+}
+
+func TestParsePackageURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		purl      string
+		expected  *PackageURL
+		canonical string
+	}{
+		{
+			name: "qualifiers and subpath",
+			purl: "pkg:golang/google.golang.org/genproto@abcdedf#googleapis/api/annotations",
+			expected: &PackageURL{Type: "golang", Namespace: "google.golang.org", Name: "genproto",
+				Version: "abcdedf", Qualifiers: map[string]string{}, Subpath: "googleapis/api/annotations"},
+			canonical: "pkg:golang/google.golang.org/genproto@abcdedf#googleapis/api/annotations",
+		},
+		{
+			name: "unsorted qualifiers and uppercase type",
+			purl: "pkg:RPM/fedora/curl@7.50.3-1.fc25?epoch=1&Arch=i386&distro=",
+			expected: &PackageURL{Type: "rpm", Namespace: "fedora", Name: "curl", Version: "7.50.3-1.fc25",
+				Qualifiers: map[string]string{"arch": "i386", "epoch": "1"}},
+			canonical: "pkg:rpm/fedora/curl@7.50.3-1.fc25?arch=i386&epoch=1",
+		},
+		{
+			name: "slashes after scheme",
+			purl: "pkg://npm/%40angular/animation@12.3.1",
+			expected: &PackageURL{Type: "npm", Namespace: "@angular", Name: "animation", Version: "12.3.1",
+				Qualifiers: map[string]string{}},
+			canonical: "pkg:npm/%40angular/animation@12.3.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := parsePackageURL(tt.purl)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, parsed)
+			assert.Equal(t, tt.canonical, parsed.String())
+		})
+	}
+}
+
+func TestParsePackageURL_invalid(t *testing.T) {
+	for _, purl := range []string{"", "deb/debian/curl@7.50.3-1", "pkg:deb", "pkg:deb/debian/@1.0"} {
+		_, err := parsePackageURL(purl)
+		assert.Error(t, err, purl)
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultPythonPaths are the search roots used when none are configured, which cover the
+// system and locally installed interpreters of common distributions
+var DefaultPythonPaths = []string{"/usr/lib", "/usr/lib64", "/usr/local/lib", "/usr/local/lib64"}
+
+// pythonPackageDirPatterns are matched against each search root to locate the directories
+// where distributions are installed. The latter pattern covers a virtualenv as a search root.
+var pythonPackageDirPatterns = []string{
+	"python*/site-packages",
+	"python*/dist-packages",
+	"lib/python*/site-packages",
+	"lib/python*/dist-packages",
+}
+
+// pythonLister reports the distributions installed in the site-packages and dist-packages
+// directories of any python interpreters found under its search roots
+type pythonLister struct {
+	root        string
+	searchRoots []string
+	logger      *zap.Logger
+}
+
+// PythonLister creates a lister for python distributions, such as ones installed by pip.
+// The search roots are within the filesystem at root and the DefaultPythonPaths are used
+// when none are given.
+func PythonLister(root string, searchRoots []string, logger *zap.Logger) SoftwarePackageLister {
+	if len(searchRoots) == 0 {
+		searchRoots = DefaultPythonPaths
+	}
+	rootedSearchRoots := make([]string, 0, len(searchRoots))
+	for _, searchRoot := range searchRoots {
+		rootedSearchRoots = append(rootedSearchRoots, rootedPath(root, searchRoot))
+	}
+	return &pythonLister{
+		root:        root,
+		searchRoots: rootedSearchRoots,
+		logger:      logger,
+	}
+}
+
+func (p *pythonLister) PackagingSystem() string {
+	return "python"
+}
+
+func (p *pythonLister) IsSupported() bool {
+	return len(p.packageDirs()) > 0
+}
+
+// packageDirs locates the distinct site-packages and dist-packages directories
+func (p *pythonLister) packageDirs() []string {
+	var dirs []string
+	seen := make(map[string]bool)
+
+	add := func(dir string) {
+		resolved, err := p.resolveSymlinks(dir)
+		if err != nil {
+			return
+		}
+		if info, err := os.Stat(resolved); err != nil || !info.IsDir() {
+			return
+		}
+		if !seen[resolved] {
+			seen[resolved] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, root := range p.searchRoots {
+		switch filepath.Base(root) {
+		case "site-packages", "dist-packages":
+			add(root)
+			continue
+		}
+
+		for _, pattern := range pythonPackageDirPatterns {
+			for _, match := range p.glob(root, pattern) {
+				add(match)
+			}
+		}
+	}
+
+	return dirs
+}
+
+// glob and resolveSymlinks follow the links of a scanned filesystem against its root, rather
+// than the host, since an absolute link, such as a venv's lib64 linked to its lib, otherwise
+// leads to a directory of the host being listed or to the linked directory being dropped
+func (p *pythonLister) glob(dir, pattern string) []string {
+	if isHostRoot(p.root) {
+		// the patterns are fixed, so the only possible error is ErrBadPattern
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		return matches
+	}
+	return rootedGlob(p.root, dir, pattern)
+}
+
+func (p *pythonLister) resolveSymlinks(dir string) (string, error) {
+	if isHostRoot(p.root) {
+		return filepath.EvalSymlinks(dir)
+	}
+	return rootedPath(p.root, unrootedPath(p.root, dir)), nil
+}
+
+func (p *pythonLister) ListPackages(ctx context.Context) ([]SoftwarePackage, error) {
+	var pkgs []SoftwarePackage
+
+	for _, dir := range p.packageDirs() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		p.logger.Debug("reading python packages", zap.String("path", dir))
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read python packages directory: %w", err)
+		}
+
+		for _, entry := range entries {
+			metadataPath := pythonMetadataPath(dir, entry)
+			if metadataPath == "" {
+				continue
+			}
+
+			pkg, err := readPythonMetadata(metadataPath)
+			if err != nil {
+				// a single broken distribution shouldn't prevent reporting the others
+				if os.IsNotExist(err) {
+					p.logger.Warn("python distribution is missing its metadata", zap.String("path", metadataPath))
+				} else {
+					p.logger.Warn("failed to read python distribution metadata",
+						zap.String("path", metadataPath), zap.Error(err))
+				}
+				continue
+			}
+			pkg.Location = unrootedPath(p.root, dir)
+			pkgs = append(pkgs, pkg)
+		}
+	}
+
+	return pkgs, nil
+}
+
+// pythonMetadataPath returns the path of the metadata file for an installed distribution
+// or an empty string if the directory entry is not a distribution
+func pythonMetadataPath(dir string, entry os.FileInfo) string {
+	name := entry.Name()
+	switch {
+	case strings.HasSuffix(name, ".dist-info") && entry.IsDir():
+		return filepath.Join(dir, name, "METADATA")
+	case strings.HasSuffix(name, ".egg-info") && entry.IsDir():
+		return filepath.Join(dir, name, "PKG-INFO")
+	case strings.HasSuffix(name, ".egg-info"):
+		// older distutils installs write the PKG-INFO content as a single file
+		return filepath.Join(dir, name)
+	default:
+		return ""
+	}
+}
+
+func readPythonMetadata(path string) (SoftwarePackage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return SoftwarePackage{}, err
+	}
+	defer file.Close()
+
+	pkg, err := parsePythonMetadata(file)
+	if err != nil {
+		return SoftwarePackage{}, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return pkg, nil
+}
+
+// parsePythonMetadata reads the name and version from the email header style of the core
+// metadata, stopping at the blank line that precedes the long description
+func parsePythonMetadata(reader io.Reader) (SoftwarePackage, error) {
+	var pkg SoftwarePackage
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		switch parts[0] {
+		case "Name":
+			pkg.Name = strings.TrimSpace(parts[1])
+		case "Version":
+			pkg.Version = strings.TrimSpace(parts[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return SoftwarePackage{}, err
+	}
+
+	if pkg.Name == "" {
+		return SoftwarePackage{}, errors.New("missing the Name field")
+	}
+	return pkg, nil
+}
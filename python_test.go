@@ -0,0 +1,75 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPythonLister_ListPackages(t *testing.T) {
+	distPackages := filepath.Join("testdata", "python", "usr", "lib", "python3", "dist-packages")
+	sitePackages := filepath.Join("testdata", "python", "usr", "local", "lib", "python3.11", "site-packages")
+	venvPackages := filepath.Join("testdata", "python", "venv", "lib", "python3.11", "site-packages")
+
+	lister := PythonLister("", []string{
+		filepath.Join("testdata", "python", "usr", "lib"),
+		filepath.Join("testdata", "python", "usr", "local", "lib"),
+		filepath.Join("testdata", "python", "venv"),
+		// given twice to verify de-duplication
+		venvPackages,
+		filepath.Join("testdata", "python", "does-not-exist"),
+	}, zap.NewNop())
+
+	assert.Equal(t, "python", lister.PackagingSystem())
+	require.True(t, lister.IsSupported())
+
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, []SoftwarePackage{
+		{Name: "PyGObject", Version: "3.42.2", Location: distPackages},
+		{Name: "PyYAML", Version: "6.0", Location: distPackages},
+		{Name: "distro-info", Version: "1.5", Location: distPackages},
+		{Name: "requests", Version: "2.31.0", Location: sitePackages},
+		{Name: "requests", Version: "2.28.1", Location: venvPackages},
+	}, packages)
+}
+
+func TestPythonLister_notSupported(t *testing.T) {
+	lister := PythonLister("", []string{filepath.Join("testdata", "not-python")}, zap.NewNop())
+
+	assert.False(t, lister.IsSupported())
+}
+
+func TestPythonLister_defaultPaths(t *testing.T) {
+	lister := PythonLister("", nil, zap.NewNop())
+	require.IsType(t, &pythonLister{}, lister)
+
+	assert.Equal(t, DefaultPythonPaths, lister.(*pythonLister).searchRoots)
+}
+
+func TestParsePythonMetadata_stopsAtBody(t *testing.T) {
+	pkg, err := parsePythonMetadata(strings.NewReader("Name: PyYAML\nVersion: 6.0\n\nVersion: 7.0\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "6.0", pkg.Version)
+}
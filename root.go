@@ -0,0 +1,120 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxRootedSymlinks bounds the symlinks followed while resolving a single rooted path,
+// which matches the limit used by Linux
+const maxRootedSymlinks = 40
+
+// rootedPath returns where the given absolute path of the scanned filesystem is located when
+// that filesystem is mounted at root. An empty root, or /, is the live host and the path is
+// returned as is.
+//
+// The symlinks within the path are resolved against root, rather than the host, since
+// absolute symlinks within a container rootfs or disk image, such as /var/lib/rpm on newer
+// distributions, are relative to that filesystem. The path is still returned when it doesn't
+// exist so that callers report the usual not-exist errors.
+func rootedPath(root, path string) string {
+	if isHostRoot(root) {
+		return path
+	}
+	root = filepath.Clean(root)
+
+	remaining := strings.Split(filepath.ToSlash(filepath.Clean("/"+path)), "/")
+	resolved := root
+	links := 0
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			// never ascend above the root
+			if resolved != root {
+				resolved = filepath.Dir(resolved)
+			}
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(next)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 || links >= maxRootedSymlinks {
+			resolved = next
+			continue
+		}
+
+		target, err := os.Readlink(next)
+		if err != nil {
+			resolved = next
+			continue
+		}
+		links++
+		if filepath.IsAbs(target) {
+			resolved = root
+		}
+		remaining = append(strings.Split(filepath.ToSlash(target), "/"), remaining...)
+	}
+
+	return resolved
+}
+
+// rootedGlob is like filepath.Glob for a pattern relative to dir, which is within root, but
+// the symlinks of each match are resolved against root, as done by rootedPath
+func rootedGlob(root, dir, pattern string) []string {
+	matches := []string{dir}
+	for _, part := range strings.Split(pattern, "/") {
+		var next []string
+		for _, match := range matches {
+			entries, err := ioutil.ReadDir(match)
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				if ok, _ := filepath.Match(part, entry.Name()); ok {
+					next = append(next, rootedPath(root, unrootedPath(root, filepath.Join(match, entry.Name()))))
+				}
+			}
+		}
+		matches = next
+	}
+	return matches
+}
+
+// unrootedPath is the inverse of rootedPath, which allows for reporting locations as they
+// are known within the scanned filesystem rather than where it is mounted
+func unrootedPath(root, path string) string {
+	if isHostRoot(root) {
+		return path
+	}
+	rel, err := filepath.Rel(filepath.Clean(root), path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return path
+	}
+	return filepath.Join("/", rel)
+}
+
+func isHostRoot(root string) bool {
+	return root == "" || filepath.Clean(root) == "/"
+}
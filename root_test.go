@@ -0,0 +1,116 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRootedPath_host(t *testing.T) {
+	assert.Equal(t, "/var/lib/dpkg/status", rootedPath("", "/var/lib/dpkg/status"))
+	assert.Equal(t, "/var/lib/dpkg/status", rootedPath("/", "/var/lib/dpkg/status"))
+}
+
+func TestRootedPath_symlinks(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "usr", "lib", "sysimage", "rpm"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "var", "lib"), 0755))
+	// an absolute symlink is relative to the root, not the host
+	require.NoError(t, os.Symlink("/usr/lib/sysimage/rpm", filepath.Join(root, "var", "lib", "rpm")))
+	// and a relative one can't escape the root
+	require.NoError(t, os.Symlink("../../../../../etc", filepath.Join(root, "var", "lib", "escape")))
+
+	assert.Equal(t,
+		filepath.Join(root, "usr", "lib", "sysimage", "rpm", "rpmdb.sqlite"),
+		rootedPath(root, "/var/lib/rpm/rpmdb.sqlite"))
+	assert.Equal(t,
+		filepath.Join(root, "etc", "passwd"),
+		rootedPath(root, "/var/lib/escape/passwd"))
+	assert.Equal(t,
+		filepath.Join(root, "does", "not", "exist"),
+		rootedPath(root, "/does/not/exist"))
+}
+
+func TestUnrootedPath(t *testing.T) {
+	assert.Equal(t, "/usr/lib/node_modules/npm", unrootedPath("/mnt/image", "/mnt/image/usr/lib/node_modules/npm"))
+	assert.Equal(t, "/", unrootedPath("/mnt/image/", "/mnt/image"))
+	assert.Equal(t, "/elsewhere", unrootedPath("/mnt/image", "/elsewhere"))
+	assert.Equal(t, "/usr/lib", unrootedPath("", "/usr/lib"))
+}
+
+func TestDebianLister_root(t *testing.T) {
+	root := t.TempDir()
+	statusPath := filepath.Join(root, "var", "lib", "dpkg", "status")
+	require.NoError(t, os.MkdirAll(filepath.Dir(statusPath), 0755))
+	copyFile(t, filepath.Join("testdata", "dpkg", "status"), statusPath, 0644)
+
+	lister := DebianLister(root, zap.NewNop())
+	require.True(t, lister.IsSupported())
+
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, packages, 6)
+}
+
+func TestNpmLister_root(t *testing.T) {
+	root, err := filepath.Abs(filepath.Join("testdata", "npm"))
+	require.NoError(t, err)
+
+	lister := NpmLister(root, []string{"/app"}, zap.NewNop())
+	require.True(t, lister.IsSupported())
+
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	require.NotEmpty(t, packages)
+	for _, pkg := range packages {
+		// locations are reported as they are within the root
+		assert.Regexp(t, "^/app/node_modules/", pkg.Location)
+	}
+}
+
+func TestPythonLister_root(t *testing.T) {
+	root := t.TempDir()
+	sitePackages := filepath.Join(root, "usr", "lib", "python3.11", "site-packages")
+	require.NoError(t, os.MkdirAll(filepath.Join(sitePackages, "six-1.16.0.dist-info"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(sitePackages, "six-1.16.0.dist-info", "METADATA"),
+		[]byte("Name: six\nVersion: 1.16.0\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "usr", "lib64"), 0755))
+	// absolute symlinks are relative to the root, so these are the same directory as above
+	require.NoError(t, os.Symlink("/usr/lib/python3.11", filepath.Join(root, "usr", "lib64", "python3.11")))
+	require.NoError(t, os.Symlink("/usr/lib", filepath.Join(root, "usr", "local")))
+
+	for _, searchRoots := range [][]string{
+		{"/usr/lib64"},
+		{"/usr/lib", "/usr/lib64", "/usr/local"},
+	} {
+		lister := PythonLister(root, searchRoots, zap.NewNop())
+		require.True(t, lister.IsSupported())
+
+		packages, err := lister.ListPackages(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []SoftwarePackage{
+			{Name: "six", Version: "1.16.0", Location: "/usr/lib/python3.11/site-packages"},
+		}, packages, "search roots %v", searchRoots)
+	}
+}
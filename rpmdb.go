@@ -0,0 +1,348 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	rpmdbSqliteName = "rpmdb.sqlite"
+	rpmdbBdbName    = "Packages"
+)
+
+// rpmdbDirs are the locations of the RPM database, where the latter is used by newer
+// distributions with the former retained as a symlink
+var rpmdbDirs = []string{"/var/lib/rpm", "/usr/lib/sysimage/rpm"}
+
+// RPM header tags and types, as declared in rpm's rpmtag.h
+const (
+	rpmTagName        = 1000
+	rpmTagVersion     = 1001
+	rpmTagRelease     = 1002
+	rpmTagEpoch       = 1003
+	rpmTagSummary     = 1004
+	rpmTagInstallTime = 1008
+	rpmTagSize        = 1009
+	rpmTagVendor      = 1011
+	rpmTagLicense     = 1014
+	rpmTagArch        = 1022
+	rpmTagSourceRpm   = 1044
+
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeStringArray = 8
+	rpmTypeI18nString  = 9
+
+	rpmHeaderIndexEntrySize = 16
+)
+
+// rpmdbLister reads the installed package headers directly from the RPM database, which allows
+// for listing packages in minimal images that retain the database but not the rpm executable.
+// Both the sqlite database used by newer distributions and the legacy BerkeleyDB hash
+// database are supported.
+type rpmdbLister struct {
+	// dbPaths are tried in order and the first one that exists is used
+	dbPaths []string
+	logger  *zap.Logger
+}
+
+// RpmdbLister creates a lister that decodes the RPM database, of the filesystem at root, rather
+// than invoking rpm
+func RpmdbLister(root string, logger *zap.Logger) SoftwarePackageLister {
+	var dbPaths []string
+	for _, dir := range rpmdbDirs {
+		dbPaths = append(dbPaths,
+			rootedPath(root, filepath.Join(dir, rpmdbSqliteName)),
+			rootedPath(root, filepath.Join(dir, rpmdbBdbName)))
+	}
+	return &rpmdbLister{
+		dbPaths: dbPaths,
+		logger:  logger,
+	}
+}
+
+func (r *rpmdbLister) PackagingSystem() string {
+	return "rpm"
+}
+
+func (r *rpmdbLister) IsSupported() bool {
+	return r.dbPath() != ""
+}
+
+// WatchPaths includes the write-ahead log of the sqlite database since committed transactions
+// are written to it rather than the database file itself
+func (r *rpmdbLister) WatchPaths() []string {
+	var paths []string
+	for _, path := range r.dbPaths {
+		paths = append(paths, path)
+		if filepath.Base(path) == rpmdbSqliteName {
+			paths = append(paths, path+"-wal")
+		}
+	}
+	return paths
+}
+
+func (r *rpmdbLister) Fingerprint() (string, error) {
+	return fingerprintPaths(r.WatchPaths())
+}
+
+func (r *rpmdbLister) dbPath() string {
+	for _, path := range r.dbPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func (r *rpmdbLister) ListPackages(ctx context.Context) ([]SoftwarePackage, error) {
+	path := r.dbPath()
+	if path == "" {
+		return nil, fmt.Errorf("none of the rpm databases exist: %v", r.dbPaths)
+	}
+
+	r.logger.Debug("reading rpm database", zap.String("path", path))
+	var blobs [][]byte
+	var err error
+	switch filepath.Base(path) {
+	case rpmdbSqliteName:
+		blobs, err = readSqliteTableColumn(ctx, path, "Packages", 1)
+	case rpmdbBdbName:
+		blobs, err = readBdbHashValues(ctx, path)
+	default:
+		err = errors.New("unknown database type")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rpm database %s: %w", path, err)
+	}
+
+	pkgs, malformed := decodeRpmHeaders(blobs)
+	if malformed != nil {
+		if len(pkgs) == 0 {
+			return nil, malformed
+		}
+		r.logger.Warn("ignoring malformed rpm headers",
+			zap.String("path", path), zap.Int("count", malformed.Count),
+			zap.String("example", malformed.Example))
+		return pkgs, malformed
+	}
+	return pkgs, nil
+}
+
+// decodeRpmHeaders skips the headers that can't be decoded, such as from a damaged database,
+// so that the remaining packages are still reported
+func decodeRpmHeaders(blobs [][]byte) ([]SoftwarePackage, *MalformedRecordsError) {
+	pkgs := make([]SoftwarePackage, 0, len(blobs))
+	var malformed *MalformedRecordsError
+	for i, blob := range blobs {
+		pkg, err := decodeRpmHeader(blob)
+		if err != nil {
+			if malformed == nil {
+				malformed = &MalformedRecordsError{Example: fmt.Sprintf("rpm header %d: %s", i, err)}
+			}
+			malformed.Count++
+			continue
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, malformed
+}
+
+type rpmHeaderEntry struct {
+	tag    int32
+	typ    uint32
+	offset int32
+	count  uint32
+}
+
+// rpmHeader is the decoded form of a header blob as stored in the RPM database, which is the
+// same layout as a package file's header but without the leading magic and reserved bytes
+type rpmHeader struct {
+	entries map[int32]rpmHeaderEntry
+	store   []byte
+}
+
+func parseRpmHeader(blob []byte) (*rpmHeader, error) {
+	if len(blob) < 8 {
+		return nil, errors.New("header blob is too short")
+	}
+	indexCount := binary.BigEndian.Uint32(blob[0:4])
+	dataLength := binary.BigEndian.Uint32(blob[4:8])
+
+	indexEnd := 8 + uint64(indexCount)*rpmHeaderIndexEntrySize
+	if indexEnd+uint64(dataLength) > uint64(len(blob)) {
+		return nil, fmt.Errorf("header declares %d entries and %d bytes of data, but blob is %d bytes",
+			indexCount, dataLength, len(blob))
+	}
+
+	header := &rpmHeader{
+		entries: make(map[int32]rpmHeaderEntry, indexCount),
+		store:   blob[indexEnd : indexEnd+uint64(dataLength)],
+	}
+	for i := uint32(0); i < indexCount; i++ {
+		entry := blob[8+i*rpmHeaderIndexEntrySize:]
+		tag := int32(binary.BigEndian.Uint32(entry[0:4]))
+		header.entries[tag] = rpmHeaderEntry{
+			tag:    tag,
+			typ:    binary.BigEndian.Uint32(entry[4:8]),
+			offset: int32(binary.BigEndian.Uint32(entry[8:12])),
+			count:  binary.BigEndian.Uint32(entry[12:16]),
+		}
+	}
+
+	return header, nil
+}
+
+// getString returns the value of a string tag, or the first value of a string array tag, and
+// false if the tag is not present
+func (h *rpmHeader) getString(tag int32) (string, bool, error) {
+	entry, ok := h.entries[tag]
+	if !ok {
+		return "", false, nil
+	}
+	switch entry.typ {
+	case rpmTypeString, rpmTypeStringArray, rpmTypeI18nString:
+	default:
+		return "", false, fmt.Errorf("tag %d has type %d rather than a string", tag, entry.typ)
+	}
+	if entry.offset < 0 || int(entry.offset) >= len(h.store) {
+		return "", false, fmt.Errorf("tag %d has an offset outside of the data store", tag)
+	}
+
+	value := h.store[entry.offset:]
+	end := bytes.IndexByte(value, 0)
+	if end < 0 {
+		return "", false, fmt.Errorf("tag %d has an unterminated string", tag)
+	}
+	return string(value[:end]), true, nil
+}
+
+// getInt32 returns the first value of an int32 tag and false if the tag is not present
+func (h *rpmHeader) getInt32(tag int32) (int32, bool, error) {
+	entry, ok := h.entries[tag]
+	if !ok {
+		return 0, false, nil
+	}
+	if entry.typ != rpmTypeInt32 || entry.count < 1 {
+		return 0, false, fmt.Errorf("tag %d has type %d rather than int32", tag, entry.typ)
+	}
+	if entry.offset < 0 || int(entry.offset)+4 > len(h.store) {
+		return 0, false, fmt.Errorf("tag %d has an offset outside of the data store", tag)
+	}
+	return int32(binary.BigEndian.Uint32(h.store[entry.offset:])), true, nil
+}
+
+// decodeRpmHeader converts a header blob into a package where the version is formatted like
+// rpm's %{evr} query tag. The extended metadata is also decoded, where absent tags are left
+// empty.
+func decodeRpmHeader(blob []byte) (SoftwarePackage, error) {
+	header, err := parseRpmHeader(blob)
+	if err != nil {
+		return SoftwarePackage{}, err
+	}
+
+	name, _, err := header.getString(rpmTagName)
+	if err != nil {
+		return SoftwarePackage{}, err
+	}
+	if name == "" {
+		return SoftwarePackage{}, errors.New("header is missing the package name")
+	}
+	version, _, err := header.getString(rpmTagVersion)
+	if err != nil {
+		return SoftwarePackage{}, err
+	}
+	release, _, err := header.getString(rpmTagRelease)
+	if err != nil {
+		return SoftwarePackage{}, err
+	}
+	epoch, hasEpoch, err := header.getInt32(rpmTagEpoch)
+	if err != nil {
+		return SoftwarePackage{}, err
+	}
+	arch, _, err := header.getString(rpmTagArch)
+	if err != nil {
+		return SoftwarePackage{}, err
+	}
+
+	pkg := SoftwarePackage{
+		Name: name,
+		Arch: arch,
+	}
+
+	pkg.Version = version
+	if release != "" {
+		pkg.Version += "-" + release
+	}
+	if hasEpoch {
+		pkg.Epoch = strconv.Itoa(int(epoch))
+		pkg.Version = pkg.Epoch + ":" + pkg.Version
+	}
+
+	installTime, _, err := header.getInt32(rpmTagInstallTime)
+	if err != nil {
+		return SoftwarePackage{}, err
+	}
+	// both are unsigned in rpm, but stored as int32
+	pkg.InstallTime = int64(uint32(installTime))
+	size, _, err := header.getInt32(rpmTagSize)
+	if err != nil {
+		return SoftwarePackage{}, err
+	}
+	pkg.InstalledSize = int64(uint32(size))
+
+	if pkg.Vendor, _, err = header.getString(rpmTagVendor); err != nil {
+		return SoftwarePackage{}, err
+	}
+	if pkg.License, _, err = header.getString(rpmTagLicense); err != nil {
+		return SoftwarePackage{}, err
+	}
+	if pkg.Summary, _, err = header.getString(rpmTagSummary); err != nil {
+		return SoftwarePackage{}, err
+	}
+	sourceRpm, _, err := header.getString(rpmTagSourceRpm)
+	if err != nil {
+		return SoftwarePackage{}, err
+	}
+	pkg.SourcePackage = rpmSourcePackageName(sourceRpm)
+
+	return pkg, nil
+}
+
+// rpmSourcePackageName extracts the name from the file name of a source rpm, such as
+// bash-4.4.19-7.el8.src.rpm, by removing the version and release
+func rpmSourcePackageName(sourceRpm string) string {
+	name := strings.TrimSuffix(strings.TrimSuffix(sourceRpm, ".src.rpm"), ".nosrc.rpm")
+	for i := 0; i < 2; i++ {
+		dash := strings.LastIndexByte(name, '-')
+		if dash <= 0 {
+			return name
+		}
+		name = name[:dash]
+	}
+	return name
+}
@@ -0,0 +1,227 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// This file implements just enough of the BerkeleyDB hash access method's on-disk format to
+// iterate over the values of the legacy RPM Packages database. The pages are scanned
+// sequentially, so the hash buckets themselves are never computed.
+
+const (
+	bdbHashMagic = 0x061561
+
+	bdbPageHeaderSize = 26
+
+	bdbPageTypeHashUnsorted = 2
+	bdbPageTypeOverflow     = 7
+	bdbPageTypeHashMeta     = 8
+	bdbPageTypeHash         = 13
+
+	bdbItemKeyData = 1
+	bdbItemOffPage = 3
+)
+
+type bdbFile struct {
+	reader    io.ReaderAt
+	byteOrder binary.ByteOrder
+	pageSize  uint32
+	lastPage  uint32
+}
+
+// readBdbHashValues returns every value of a BerkeleyDB hash database, skipping the record
+// with a zero key that rpm uses for its own bookkeeping
+func readBdbHashValues(ctx context.Context, path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	db, err := openBdb(&contextReaderAt{ctx: ctx, reader: file})
+	if err != nil {
+		return nil, err
+	}
+
+	var values [][]byte
+	for pageNumber := uint32(1); pageNumber <= db.lastPage; pageNumber++ {
+		page, err := db.readPage(pageNumber)
+		if err != nil {
+			return nil, err
+		}
+
+		pageType := page[25]
+		if pageType != bdbPageTypeHash && pageType != bdbPageTypeHashUnsorted {
+			continue
+		}
+
+		pageValues, err := db.readHashPage(pageNumber, page)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, pageValues...)
+	}
+
+	return values, nil
+}
+
+func openBdb(reader io.ReaderAt) (*bdbFile, error) {
+	meta := make([]byte, 512)
+	if _, err := reader.ReadAt(meta, 0); err != nil {
+		return nil, fmt.Errorf("failed to read berkeleydb metadata: %w", err)
+	}
+
+	var byteOrder binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint32(meta[12:16]) == bdbHashMagic:
+		byteOrder = binary.LittleEndian
+	case binary.BigEndian.Uint32(meta[12:16]) == bdbHashMagic:
+		byteOrder = binary.BigEndian
+	default:
+		return nil, errors.New("not a berkeleydb hash database")
+	}
+
+	if meta[25] != bdbPageTypeHashMeta {
+		return nil, fmt.Errorf("unexpected berkeleydb metadata page type %d", meta[25])
+	}
+	if meta[24] != 0 {
+		return nil, errors.New("encrypted berkeleydb databases are not supported")
+	}
+
+	pageSize := byteOrder.Uint32(meta[20:24])
+	if pageSize < 512 || pageSize > 65536 {
+		return nil, fmt.Errorf("invalid berkeleydb page size %d", pageSize)
+	}
+
+	return &bdbFile{
+		reader:    reader,
+		byteOrder: byteOrder,
+		pageSize:  pageSize,
+		lastPage:  byteOrder.Uint32(meta[32:36]),
+	}, nil
+}
+
+func (b *bdbFile) readPage(pageNumber uint32) ([]byte, error) {
+	if pageNumber > b.lastPage {
+		return nil, fmt.Errorf("berkeleydb page %d is out of range", pageNumber)
+	}
+	page := make([]byte, b.pageSize)
+	_, err := b.reader.ReadAt(page, int64(pageNumber)*int64(b.pageSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read berkeleydb page %d: %w", pageNumber, err)
+	}
+	return page, nil
+}
+
+// readHashPage returns the values of the key/value pairs on a hash bucket page. Items are
+// stored from the end of the page towards the index of item offsets that follows the header.
+func (b *bdbFile) readHashPage(pageNumber uint32, page []byte) ([][]byte, error) {
+	entries := int(b.byteOrder.Uint16(page[20:22]))
+	if bdbPageHeaderSize+entries*2 > len(page) {
+		return nil, fmt.Errorf("berkeleydb page %d has too many entries", pageNumber)
+	}
+
+	offsets := make([]int, entries)
+	for i := range offsets {
+		offsets[i] = int(b.byteOrder.Uint16(page[bdbPageHeaderSize+i*2:]))
+	}
+	itemEnd := func(i int) int {
+		if i == 0 {
+			return len(page)
+		}
+		return offsets[i-1]
+	}
+	// each item must be non-empty, which also keeps it within the page
+	for i := range offsets {
+		if offsets[i] >= itemEnd(i) {
+			return nil, fmt.Errorf("berkeleydb page %d has an invalid item offset", pageNumber)
+		}
+	}
+
+	var values [][]byte
+	for i := 0; i+1 < entries; i += 2 {
+		key := page[offsets[i]:itemEnd(i)]
+		if key[0] == bdbItemKeyData && isAllZero(key[1:]) {
+			continue
+		}
+
+		item := page[offsets[i+1]:itemEnd(i+1)]
+		switch item[0] {
+		case bdbItemKeyData:
+			values = append(values, item[1:])
+		case bdbItemOffPage:
+			if len(item) < 12 {
+				return nil, fmt.Errorf("berkeleydb page %d has a truncated off-page item", pageNumber)
+			}
+			value, err := b.readOverflow(b.byteOrder.Uint32(item[4:8]), b.byteOrder.Uint32(item[8:12]))
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		default:
+			return nil, fmt.Errorf("berkeleydb page %d has unsupported item type %d", pageNumber, item[0])
+		}
+	}
+
+	return values, nil
+}
+
+// readOverflow assembles a value stored across a chain of overflow pages, where the header's
+// free area offset field is re-purposed as the number of bytes used on each page
+func (b *bdbFile) readOverflow(pageNumber uint32, length uint32) ([]byte, error) {
+	value := make([]byte, 0, length)
+	for visited := uint32(0); pageNumber != 0; visited++ {
+		if visited > b.lastPage {
+			return nil, errors.New("berkeleydb overflow chain has a cycle")
+		}
+		page, err := b.readPage(pageNumber)
+		if err != nil {
+			return nil, err
+		}
+		if page[25] != bdbPageTypeOverflow {
+			return nil, fmt.Errorf("berkeleydb page %d is not an overflow page", pageNumber)
+		}
+
+		used := int(b.byteOrder.Uint16(page[22:24]))
+		if bdbPageHeaderSize+used > len(page) {
+			return nil, fmt.Errorf("berkeleydb overflow page %d has an invalid length", pageNumber)
+		}
+		value = append(value, page[bdbPageHeaderSize:bdbPageHeaderSize+used]...)
+		pageNumber = b.byteOrder.Uint32(page[16:20])
+	}
+
+	if uint32(len(value)) != length {
+		return nil, fmt.Errorf("berkeleydb overflow value was %d bytes rather than %d", len(value), length)
+	}
+	return value, nil
+}
+
+func isAllZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
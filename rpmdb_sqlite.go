@@ -0,0 +1,485 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// This file implements just enough of the SQLite file format, https://www.sqlite.org/fileformat.html,
+// to read the rows of a table without needing cgo or a full SQLite implementation. The committed
+// transactions of the write-ahead log are also read since rpm only checkpoints them into the
+// database file when it closes the database cleanly, which isn't the case after a crash or
+// while a transaction is running.
+
+const (
+	sqliteMagic      = "SQLite format 3\x00"
+	sqliteHeaderSize = 100
+
+	sqlitePageInteriorTable = 0x05
+	sqlitePageLeafTable     = 0x0d
+
+	// sqliteMaxDepth guards against cycles in a corrupted b-tree
+	sqliteMaxDepth = 64
+
+	sqliteWalHeaderSize      = 32
+	sqliteWalFrameHeaderSize = 24
+	// sqliteWalMagic has its least significant bit set when the checksums are big-endian
+	sqliteWalMagic = 0x377f0682
+)
+
+type sqliteFile struct {
+	reader     io.ReaderAt
+	pageSize   int
+	usableSize int
+	pageCount  uint32
+	// wal, when not nil, is consulted for the pages before the database file
+	wal *sqliteWal
+}
+
+// sqliteWal locates the most recently committed version of each page in a write-ahead log
+type sqliteWal struct {
+	reader io.ReaderAt
+	// frames is the offset of the latest committed content of each page
+	frames map[uint32]int64
+	// pageCount is the size of the database, in pages, as of the last commit
+	pageCount uint32
+}
+
+// readSqliteTableColumn returns the blob (or text) values of the given zero-based column from
+// every row of the named table
+func readSqliteTableColumn(ctx context.Context, path string, table string, column int) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openSqlite(&contextReaderAt{ctx: ctx, reader: file}, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	walFile, err := os.Open(path + "-wal")
+	if err == nil {
+		defer walFile.Close()
+		walInfo, err := walFile.Stat()
+		if err != nil {
+			return nil, err
+		}
+		err = db.openWal(&contextReaderAt{ctx: ctx, reader: walFile}, walInfo.Size())
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	rootPage, err := db.findTableRootPage(table)
+	if err != nil {
+		return nil, err
+	}
+
+	var values [][]byte
+	err = db.walkTable(rootPage, 0, func(record []interface{}) error {
+		if column >= len(record) {
+			return fmt.Errorf("row of table %s has only %d columns", table, len(record))
+		}
+		switch value := record[column].(type) {
+		case []byte:
+			values = append(values, value)
+		case string:
+			values = append(values, []byte(value))
+		default:
+			return fmt.Errorf("column %d of table %s has unexpected type %T", column, table, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func openSqlite(reader io.ReaderAt, size int64) (*sqliteFile, error) {
+	header := make([]byte, sqliteHeaderSize)
+	if _, err := reader.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to read sqlite header: %w", err)
+	}
+	if string(header[0:16]) != sqliteMagic {
+		return nil, errors.New("not a sqlite database")
+	}
+
+	pageSize := int(binary.BigEndian.Uint16(header[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return nil, fmt.Errorf("invalid sqlite page size %d", pageSize)
+	}
+	reserved := int(header[20])
+
+	return &sqliteFile{
+		reader:     reader,
+		pageSize:   pageSize,
+		usableSize: pageSize - reserved,
+		pageCount:  uint32(size / int64(pageSize)),
+	}, nil
+}
+
+// openWal reads the frames of the write-ahead log up to its last commit, where the frames
+// that follow, such as of a transaction that is still being written, and any left over from
+// before the last checkpoint, which have a stale salt or checksum, are ignored just as done by
+// SQLite itself. An empty or invalid log has no committed frames.
+func (s *sqliteFile) openWal(reader io.ReaderAt, size int64) error {
+	if size < sqliteWalHeaderSize {
+		return nil
+	}
+	header := make([]byte, sqliteWalHeaderSize)
+	if _, err := reader.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("failed to read sqlite write-ahead log header: %w", err)
+	}
+	magic := binary.BigEndian.Uint32(header[0:4])
+	if magic&^1 != sqliteWalMagic {
+		return nil
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if magic&1 == 1 {
+		order = binary.BigEndian
+	}
+	if int(binary.BigEndian.Uint32(header[8:12])) != s.pageSize {
+		return nil
+	}
+	s0, s1 := sqliteWalChecksum(order, header[0:24], 0, 0)
+	if s0 != binary.BigEndian.Uint32(header[24:28]) || s1 != binary.BigEndian.Uint32(header[28:32]) {
+		return nil
+	}
+
+	wal := &sqliteWal{reader: reader, frames: make(map[uint32]int64)}
+	pending := make(map[uint32]int64)
+	frame := make([]byte, sqliteWalFrameHeaderSize+s.pageSize)
+	for offset := int64(sqliteWalHeaderSize); offset+int64(len(frame)) <= size; offset += int64(len(frame)) {
+		if _, err := reader.ReadAt(frame, offset); err != nil {
+			return fmt.Errorf("failed to read sqlite write-ahead log frame: %w", err)
+		}
+		if !bytes.Equal(frame[8:16], header[16:24]) {
+			break
+		}
+		s0, s1 = sqliteWalChecksum(order, frame[0:8], s0, s1)
+		s0, s1 = sqliteWalChecksum(order, frame[sqliteWalFrameHeaderSize:], s0, s1)
+		if s0 != binary.BigEndian.Uint32(frame[16:20]) || s1 != binary.BigEndian.Uint32(frame[20:24]) {
+			break
+		}
+
+		pending[binary.BigEndian.Uint32(frame[0:4])] = offset + sqliteWalFrameHeaderSize
+		// the database size is only set in the last frame of each transaction
+		if commitSize := binary.BigEndian.Uint32(frame[4:8]); commitSize != 0 {
+			for pageNumber, pageOffset := range pending {
+				wal.frames[pageNumber] = pageOffset
+			}
+			pending = make(map[uint32]int64)
+			wal.pageCount = commitSize
+		}
+	}
+
+	if len(wal.frames) > 0 {
+		s.wal = wal
+		s.pageCount = wal.pageCount
+	}
+	return nil
+}
+
+// sqliteWalChecksum continues the cumulative checksum of the write-ahead log over the content,
+// which is a multiple of 8 bytes
+func sqliteWalChecksum(order binary.ByteOrder, content []byte, s0, s1 uint32) (uint32, uint32) {
+	for i := 0; i+8 <= len(content); i += 8 {
+		s0 += order.Uint32(content[i:i+4]) + s1
+		s1 += order.Uint32(content[i+4:i+8]) + s0
+	}
+	return s0, s1
+}
+
+func (s *sqliteFile) readPage(pageNumber uint32) ([]byte, error) {
+	if pageNumber < 1 || pageNumber > s.pageCount {
+		return nil, fmt.Errorf("sqlite page %d is out of range", pageNumber)
+	}
+	page := make([]byte, s.pageSize)
+	reader, offset := s.reader, int64(pageNumber-1)*int64(s.pageSize)
+	if s.wal != nil {
+		if walOffset, ok := s.wal.frames[pageNumber]; ok {
+			reader, offset = s.wal.reader, walOffset
+		}
+	}
+	_, err := reader.ReadAt(page, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sqlite page %d: %w", pageNumber, err)
+	}
+	return page, nil
+}
+
+// findTableRootPage locates the table in the sqlite_schema table, which is always rooted at page 1
+func (s *sqliteFile) findTableRootPage(table string) (uint32, error) {
+	var rootPage uint32
+	err := s.walkTable(1, 0, func(record []interface{}) error {
+		// columns are type, name, tbl_name, rootpage, sql
+		if len(record) < 4 || rootPage != 0 {
+			return nil
+		}
+		if record[0] == "table" && record[1] == table {
+			if page, ok := record[3].(int64); ok {
+				rootPage = uint32(page)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if rootPage == 0 {
+		return 0, fmt.Errorf("table %s not found", table)
+	}
+	return rootPage, nil
+}
+
+func (s *sqliteFile) walkTable(pageNumber uint32, depth int, handler func(record []interface{}) error) error {
+	if depth > sqliteMaxDepth {
+		return errors.New("sqlite b-tree is too deep")
+	}
+
+	page, err := s.readPage(pageNumber)
+	if err != nil {
+		return err
+	}
+
+	headerOffset := 0
+	if pageNumber == 1 {
+		headerOffset = sqliteHeaderSize
+	}
+	pageType := page[headerOffset]
+	cellCount := int(binary.BigEndian.Uint16(page[headerOffset+3:]))
+
+	switch pageType {
+	case sqlitePageInteriorTable:
+		cellPointers := headerOffset + 12
+		if cellPointers+cellCount*2 > len(page) {
+			return fmt.Errorf("sqlite page %d has too many cells", pageNumber)
+		}
+		for i := 0; i < cellCount; i++ {
+			cellOffset := int(binary.BigEndian.Uint16(page[cellPointers+i*2:]))
+			if cellOffset+4 > len(page) {
+				return fmt.Errorf("sqlite page %d has an invalid cell offset", pageNumber)
+			}
+			child := binary.BigEndian.Uint32(page[cellOffset:])
+			if err := s.walkTable(child, depth+1, handler); err != nil {
+				return err
+			}
+		}
+		rightMost := binary.BigEndian.Uint32(page[headerOffset+8:])
+		return s.walkTable(rightMost, depth+1, handler)
+
+	case sqlitePageLeafTable:
+		cellPointers := headerOffset + 8
+		if cellPointers+cellCount*2 > len(page) {
+			return fmt.Errorf("sqlite page %d has too many cells", pageNumber)
+		}
+		for i := 0; i < cellCount; i++ {
+			cellOffset := int(binary.BigEndian.Uint16(page[cellPointers+i*2:]))
+			payload, err := s.readLeafPayload(page, cellOffset)
+			if err != nil {
+				return fmt.Errorf("failed to read cell %d of sqlite page %d: %w", i, pageNumber, err)
+			}
+			record, err := decodeSqliteRecord(payload)
+			if err != nil {
+				return fmt.Errorf("failed to decode cell %d of sqlite page %d: %w", i, pageNumber, err)
+			}
+			if err := handler(record); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("sqlite page %d has unexpected type %d", pageNumber, pageType)
+	}
+}
+
+// readLeafPayload assembles the payload of a table leaf cell, following overflow pages as needed
+func (s *sqliteFile) readLeafPayload(page []byte, cellOffset int) ([]byte, error) {
+	if cellOffset >= len(page) {
+		return nil, errors.New("cell offset is beyond the page")
+	}
+	payloadSize, n := sqliteVarint(page[cellOffset:])
+	if n == 0 {
+		return nil, errors.New("invalid payload size")
+	}
+	// skip over the rowid
+	_, rowidLen := sqliteVarint(page[cellOffset+n:])
+	if rowidLen == 0 {
+		return nil, errors.New("invalid rowid")
+	}
+	start := cellOffset + n + rowidLen
+
+	total := int(payloadSize)
+	local := s.localPayloadSize(total)
+	if start+local > len(page) {
+		return nil, errors.New("cell payload extends beyond the page")
+	}
+
+	payload := make([]byte, 0, total)
+	payload = append(payload, page[start:start+local]...)
+	if local == total {
+		return payload, nil
+	}
+
+	if start+local+4 > len(page) {
+		return nil, errors.New("cell overflow pointer extends beyond the page")
+	}
+	overflow := binary.BigEndian.Uint32(page[start+local:])
+	for visited := uint32(0); len(payload) < total; visited++ {
+		if overflow == 0 || visited > s.pageCount {
+			return nil, errors.New("overflow chain ended before the payload was complete")
+		}
+		overflowPage, err := s.readPage(overflow)
+		if err != nil {
+			return nil, err
+		}
+		chunk := s.usableSize - 4
+		if remaining := total - len(payload); remaining < chunk {
+			chunk = remaining
+		}
+		payload = append(payload, overflowPage[4:4+chunk]...)
+		overflow = binary.BigEndian.Uint32(overflowPage[0:4])
+	}
+
+	return payload, nil
+}
+
+// localPayloadSize computes how much of a table leaf payload is stored on the b-tree page itself
+func (s *sqliteFile) localPayloadSize(payloadSize int) int {
+	maxLocal := s.usableSize - 35
+	if payloadSize <= maxLocal {
+		return payloadSize
+	}
+	minLocal := ((s.usableSize - 12) * 32 / 255) - 23
+	local := minLocal + ((payloadSize - minLocal) % (s.usableSize - 4))
+	if local > maxLocal {
+		return minLocal
+	}
+	return local
+}
+
+// decodeSqliteRecord decodes a record into int64, float64, string, []byte, or nil values
+func decodeSqliteRecord(payload []byte) ([]interface{}, error) {
+	headerSize, n := sqliteVarint(payload)
+	if n == 0 || int(headerSize) > len(payload) {
+		return nil, errors.New("invalid record header")
+	}
+
+	var serialTypes []uint64
+	for offset := n; offset < int(headerSize); {
+		serialType, n := sqliteVarint(payload[offset:int(headerSize)])
+		if n == 0 {
+			return nil, errors.New("invalid record serial type")
+		}
+		serialTypes = append(serialTypes, serialType)
+		offset += n
+	}
+
+	values := make([]interface{}, 0, len(serialTypes))
+	body := payload[headerSize:]
+	for _, serialType := range serialTypes {
+		var size int
+		switch {
+		case serialType <= 4:
+			size = int(serialType)
+		case serialType == 5:
+			size = 6
+		case serialType == 6 || serialType == 7:
+			size = 8
+		case serialType == 8 || serialType == 9:
+			size = 0
+		case serialType >= 12:
+			size = int((serialType - 12) / 2)
+		default:
+			return nil, fmt.Errorf("reserved serial type %d", serialType)
+		}
+		if size > len(body) {
+			return nil, errors.New("record value extends beyond the payload")
+		}
+		raw := body[:size]
+		body = body[size:]
+
+		switch {
+		case serialType == 0:
+			values = append(values, nil)
+		case serialType == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(raw)))
+		case serialType == 8:
+			values = append(values, int64(0))
+		case serialType == 9:
+			values = append(values, int64(1))
+		case serialType < 12:
+			// big-endian twos-complement integer of the given size
+			var value int64
+			if raw[0]&0x80 != 0 {
+				value = -1
+			}
+			for _, b := range raw {
+				value = value<<8 | int64(b)
+			}
+			values = append(values, value)
+		case serialType%2 == 0:
+			values = append(values, raw)
+		default:
+			values = append(values, string(raw))
+		}
+	}
+
+	return values, nil
+}
+
+// sqliteVarint decodes sqlite's big-endian variable length integer and returns the value
+// and the number of bytes consumed, which is zero if the buffer was too short
+func sqliteVarint(buf []byte) (uint64, int) {
+	var value uint64
+	for i := 0; i < 9; i++ {
+		if i >= len(buf) {
+			return 0, 0
+		}
+		if i == 8 {
+			return value<<8 | uint64(buf[i]), 9
+		}
+		value = value<<7 | uint64(buf[i]&0x7f)
+		if buf[i]&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+	return value, 9
+}
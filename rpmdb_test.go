@@ -0,0 +1,273 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// expectedRpmdbPackages are the packages placed in both of the fixture databases
+var expectedRpmdbPackages = []SoftwarePackage{
+	{Name: "tzdata", Version: "2019a-1.el8", Arch: "noarch"},
+	{Name: "dbus-common", Version: "1:1.12.8-7.el8", Arch: "noarch", Epoch: "1"},
+	{Name: "bash", Version: "4.4.19-7.el8", Arch: "x86_64"},
+	{Name: "gpg-pubkey", Version: "8483c65d-5ccc5b19", Arch: ""},
+	{Name: "openssl-libs", Version: "1:1.1.1c-2.el8", Arch: "x86_64", Epoch: "1"},
+}
+
+func TestRpmdbLister_ListPackages_sqlite(t *testing.T) {
+	lister := &rpmdbLister{
+		dbPaths: []string{
+			filepath.Join("testdata", "rpmdb-sqlite", rpmdbSqliteName),
+			filepath.Join("testdata", "rpmdb-sqlite", rpmdbBdbName),
+		},
+		logger: zap.NewNop(),
+	}
+
+	assert.Equal(t, "rpm", lister.PackagingSystem())
+	require.True(t, lister.IsSupported())
+
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	// the fixture also contains enough filler packages to require interior b-tree pages
+	require.Len(t, packages, 45)
+	assert.Equal(t, expectedRpmdbPackages, packages[:5])
+	assert.Equal(t, SoftwarePackage{Name: "filler-39", Version: "1.0-1", Arch: "x86_64"}, packages[44])
+}
+
+func TestRpmdbLister_ListPackages_sqliteWal(t *testing.T) {
+	// the fixture's write-ahead log has a committed transaction, which removed tzdata and
+	// installed zlib, that wasn't checkpointed into the database file
+	dir := filepath.Join("testdata", "rpmdb-sqlite-wal")
+	lister := &rpmdbLister{
+		dbPaths: []string{filepath.Join(dir, rpmdbSqliteName)},
+		logger:  zap.NewNop(),
+	}
+
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	require.Len(t, packages, 45)
+	assert.Equal(t, expectedRpmdbPackages[1:5], packages[:4])
+	assert.Equal(t, SoftwarePackage{Name: "zlib", Version: "1.2.11-10.el8", Arch: "x86_64"}, packages[44])
+
+	wal, err := ioutil.ReadFile(filepath.Join(dir, rpmdbSqliteName+"-wal"))
+	require.NoError(t, err)
+	frameSize := sqliteWalFrameHeaderSize + 1024
+
+	t.Run("uncommitted", func(t *testing.T) {
+		// without its last frame, the transaction was never committed
+		copyDir := t.TempDir()
+		copyFile(t, filepath.Join(dir, rpmdbSqliteName), filepath.Join(copyDir, rpmdbSqliteName), 0644)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(copyDir, rpmdbSqliteName+"-wal"), wal[:len(wal)-frameSize], 0644))
+
+		blobs, err := readSqliteTableColumn(context.Background(), filepath.Join(copyDir, rpmdbSqliteName), "Packages", 1)
+		require.NoError(t, err)
+		pkgs, malformed := decodeRpmHeaders(blobs)
+		require.Nil(t, malformed)
+		assert.Equal(t, expectedRpmdbPackages, pkgs[:5])
+	})
+
+	t.Run("stale frames", func(t *testing.T) {
+		// a frame left over from before a checkpoint has a different salt
+		stale := append([]byte{}, wal...)
+		stale = append(stale, wal[sqliteWalHeaderSize:sqliteWalHeaderSize+frameSize]...)
+		stale[len(wal)+8]++
+		copyDir := t.TempDir()
+		copyFile(t, filepath.Join(dir, rpmdbSqliteName), filepath.Join(copyDir, rpmdbSqliteName), 0644)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(copyDir, rpmdbSqliteName+"-wal"), stale, 0644))
+
+		blobs, err := readSqliteTableColumn(context.Background(), filepath.Join(copyDir, rpmdbSqliteName), "Packages", 1)
+		require.NoError(t, err)
+		assert.Len(t, blobs, 45)
+	})
+}
+
+func TestRpmdbLister_ListPackages_bdb(t *testing.T) {
+	lister := &rpmdbLister{
+		dbPaths: []string{
+			filepath.Join("testdata", "rpmdb-bdb", rpmdbSqliteName),
+			filepath.Join("testdata", "rpmdb-bdb", rpmdbBdbName),
+		},
+		logger: zap.NewNop(),
+	}
+
+	require.True(t, lister.IsSupported())
+
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, expectedRpmdbPackages, packages)
+}
+
+func TestRpmdbLister_ListPackages_cancelled(t *testing.T) {
+	lister := &rpmdbLister{
+		dbPaths: []string{filepath.Join("testdata", "rpmdb-sqlite", rpmdbSqliteName)},
+		logger:  zap.NewNop(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := lister.ListPackages(ctx)
+	assert.True(t, errors.Is(err, context.Canceled), err)
+}
+
+func TestRpmdbLister_notSupported(t *testing.T) {
+	lister := &rpmdbLister{
+		dbPaths: []string{filepath.Join("testdata", "not-rpmdb", rpmdbSqliteName)},
+		logger:  zap.NewNop(),
+	}
+
+	assert.False(t, lister.IsSupported())
+	_, err := lister.ListPackages(context.Background())
+	assert.Error(t, err)
+}
+
+func TestReadSqliteTableColumn_notSqlite(t *testing.T) {
+	_, err := readSqliteTableColumn(context.Background(), filepath.Join("testdata", "rpmdb-bdb", rpmdbBdbName), "Packages", 1)
+	assert.EqualError(t, err, "not a sqlite database")
+}
+
+func TestReadSqliteTableColumn_missingTable(t *testing.T) {
+	_, err := readSqliteTableColumn(context.Background(), filepath.Join("testdata", "rpmdb-sqlite", rpmdbSqliteName), "Nope", 1)
+	assert.EqualError(t, err, "table Nope not found")
+}
+
+func TestReadBdbHashValues_notBdb(t *testing.T) {
+	_, err := readBdbHashValues(context.Background(), filepath.Join("testdata", "rpmdb-sqlite", rpmdbSqliteName))
+	assert.EqualError(t, err, "not a berkeleydb hash database")
+}
+
+func TestSqliteFile_walkTable_tooManyCells(t *testing.T) {
+	const pageSize = 512
+	data := make([]byte, 2*pageSize)
+	page := data[pageSize:]
+	page[0] = sqlitePageLeafTable
+	binary.BigEndian.PutUint16(page[3:], 0xffff)
+	db := &sqliteFile{reader: bytes.NewReader(data), pageSize: pageSize, usableSize: pageSize, pageCount: 2}
+
+	err := db.walkTable(2, 0, func(record []interface{}) error {
+		return nil
+	})
+	assert.EqualError(t, err, "sqlite page 2 has too many cells")
+}
+
+func TestBdbFile_readHashPage_emptyItem(t *testing.T) {
+	page := make([]byte, 512)
+	binary.LittleEndian.PutUint16(page[20:], 2)
+	// the value has the same offset as the key, so it has no content, not even its type
+	binary.LittleEndian.PutUint16(page[bdbPageHeaderSize:], 500)
+	binary.LittleEndian.PutUint16(page[bdbPageHeaderSize+2:], 500)
+	db := &bdbFile{byteOrder: binary.LittleEndian, pageSize: 512, lastPage: 1}
+
+	_, err := db.readHashPage(1, page)
+	assert.EqualError(t, err, "berkeleydb page 1 has an invalid item offset")
+}
+
+func TestDecodeRpmHeader_truncated(t *testing.T) {
+	_, err := decodeRpmHeader([]byte{0, 0, 0, 1, 0, 0, 0, 16})
+	assert.EqualError(t, err, "header declares 1 entries and 16 bytes of data, but blob is 8 bytes")
+}
+
+func TestDecodeRpmHeaders_skipsMalformed(t *testing.T) {
+	pkgs, malformed := decodeRpmHeaders([][]byte{
+		buildRpmHeaderBlob(map[int32]string{rpmTagName: "bash", rpmTagVersion: "4.4.19", rpmTagRelease: "7.el8"}, nil),
+		{0, 0, 0, 1, 0, 0, 0, 16},
+	})
+
+	require.NotNil(t, malformed)
+	assert.Equal(t, 1, malformed.Count)
+	assert.Equal(t, "rpm header 1: header declares 1 entries and 16 bytes of data, but blob is 8 bytes", malformed.Example)
+	require.Len(t, pkgs, 1)
+	assert.Equal(t, "bash", pkgs[0].Name)
+}
+
+// buildRpmHeaderBlob encodes the string and int32 tags in the header blob layout of the database
+func buildRpmHeaderBlob(strings map[int32]string, ints map[int32]int32) []byte {
+	var index, store bytes.Buffer
+	addEntry := func(tag int32, typ uint32, value []byte) {
+		for _, v := range []uint32{uint32(tag), typ, uint32(store.Len()), 1} {
+			_ = binary.Write(&index, binary.BigEndian, v)
+		}
+		store.Write(value)
+	}
+	for tag, value := range ints {
+		// int32 values are aligned in the store
+		for store.Len()%4 != 0 {
+			store.WriteByte(0)
+		}
+		var encoded [4]byte
+		binary.BigEndian.PutUint32(encoded[:], uint32(value))
+		addEntry(tag, rpmTypeInt32, encoded[:])
+	}
+	for tag, value := range strings {
+		addEntry(tag, rpmTypeString, append([]byte(value), 0))
+	}
+
+	var blob bytes.Buffer
+	_ = binary.Write(&blob, binary.BigEndian, uint32(len(strings)+len(ints)))
+	_ = binary.Write(&blob, binary.BigEndian, uint32(store.Len()))
+	blob.Write(index.Bytes())
+	blob.Write(store.Bytes())
+	return blob.Bytes()
+}
+
+func TestDecodeRpmHeader_extended(t *testing.T) {
+	blob := buildRpmHeaderBlob(map[int32]string{
+		rpmTagName:      "dbus-common",
+		rpmTagVersion:   "1.12.8",
+		rpmTagRelease:   "7.el8",
+		rpmTagArch:      "noarch",
+		rpmTagSummary:   "D-BUS message bus configuration",
+		rpmTagVendor:    "Red Hat, Inc.",
+		rpmTagLicense:   "(GPLv2+ or AFL) and GPLv2+",
+		rpmTagSourceRpm: "dbus-1.12.8-7.el8.src.rpm",
+	}, map[int32]int32{
+		rpmTagEpoch:       1,
+		rpmTagInstallTime: 1571326382,
+		rpmTagSize:        11327,
+	})
+
+	pkg, err := decodeRpmHeader(blob)
+	require.NoError(t, err)
+	assert.Equal(t, SoftwarePackage{
+		Name:          "dbus-common",
+		Version:       "1:1.12.8-7.el8",
+		Arch:          "noarch",
+		Epoch:         "1",
+		InstallTime:   1571326382,
+		InstalledSize: 11327,
+		Vendor:        "Red Hat, Inc.",
+		SourcePackage: "dbus",
+		License:       "(GPLv2+ or AFL) and GPLv2+",
+		Summary:       "D-BUS message bus configuration",
+	}, pkg)
+}
+
+func TestRpmSourcePackageName(t *testing.T) {
+	assert.Equal(t, "bash", rpmSourcePackageName("bash-4.4.19-7.el8.src.rpm"))
+	assert.Equal(t, "python-six", rpmSourcePackageName("python-six-1.11.0-8.el8.src.rpm"))
+	assert.Equal(t, "nvidia-driver", rpmSourcePackageName("nvidia-driver-450.80-1.nosrc.rpm"))
+	assert.Equal(t, "", rpmSourcePackageName(""))
+}
@@ -0,0 +1,45 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// ToolName identifies the agent as the creator of SBOM documents
+const ToolName = "salus-packages-agent"
+
+// toolIdentity is the name of the agent including its version, if known
+func toolIdentity(toolVersion string) string {
+	if toolVersion == "" {
+		return ToolName
+	}
+	return ToolName + "-" + toolVersion
+}
+
+// newUuid generates a random, version 4 UUID used to uniquely identify SBOM documents
+func newUuid() string {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate UUID: %v", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	snapStatePath = "/var/lib/snapd/state.json"
+)
+
+// snapMountDirs are where snaps are mounted, where the latter is used by distributions,
+// such as Fedora, that don't allow for a top-level /snap directory
+var snapMountDirs = []string{"/snap", "/var/lib/snapd/snap"}
+
+// snapState is the subset of snapd's state that identifies the installed snaps
+type snapState struct {
+	Data struct {
+		Snaps map[string]struct {
+			Type            string `json:"type"`
+			Active          bool   `json:"active"`
+			Current         string `json:"current"`
+			Channel         string `json:"channel"`
+			TrackingChannel string `json:"tracking-channel"`
+		} `json:"snaps"`
+	} `json:"data"`
+}
+
+// snapLister reads snapd's state file to determine the installed snaps and their current
+// revision. Since the state does not record the version of each snap, that is read from the
+// snap.yaml of the mounted revision.
+type snapLister struct {
+	statePath string
+	mountDirs []string
+	logger    *zap.Logger
+}
+
+// SnapLister creates a lister for the snaps installed by snapd in the filesystem at root
+func SnapLister(root string, logger *zap.Logger) SoftwarePackageLister {
+	mountDirs := make([]string, 0, len(snapMountDirs))
+	for _, dir := range snapMountDirs {
+		mountDirs = append(mountDirs, rootedPath(root, dir))
+	}
+	return &snapLister{
+		statePath: rootedPath(root, snapStatePath),
+		mountDirs: mountDirs,
+		logger:    logger,
+	}
+}
+
+func (s *snapLister) PackagingSystem() string {
+	return "snap"
+}
+
+func (s *snapLister) IsSupported() bool {
+	_, err := os.Stat(s.statePath)
+	return err == nil
+}
+
+func (s *snapLister) WatchPaths() []string {
+	return []string{s.statePath}
+}
+
+func (s *snapLister) Fingerprint() (string, error) {
+	return fingerprintPaths(s.WatchPaths())
+}
+
+func (s *snapLister) ListPackages(ctx context.Context) ([]SoftwarePackage, error) {
+	s.logger.Debug("reading snapd state", zap.String("path", s.statePath))
+	file, err := os.Open(s.statePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapd state: %w", err)
+	}
+	defer file.Close()
+
+	var state snapState
+	err = json.NewDecoder(&contextReader{ctx: ctx, reader: file}).Decode(&state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode snapd state: %w", err)
+	}
+
+	names := make([]string, 0, len(state.Data.Snaps))
+	for name := range state.Data.Snaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pkgs := make([]SoftwarePackage, 0, len(names))
+	for _, name := range names {
+		snap := state.Data.Snaps[name]
+
+		channel := snap.TrackingChannel
+		if channel == "" {
+			channel = snap.Channel
+		}
+		extra := map[string]string{
+			"revision": snap.Current,
+			"type":     snap.Type,
+		}
+		if channel != "" {
+			extra["channel"] = channel
+		}
+		if !snap.Active {
+			extra["disabled"] = "true"
+		}
+
+		pkgs = append(pkgs, SoftwarePackage{
+			Name:    name,
+			Version: s.snapVersion(name, snap.Current),
+			Extra:   extra,
+		})
+	}
+
+	return pkgs, nil
+}
+
+// snapVersion reads the version from the metadata of the mounted snap revision or returns
+// an empty string if the revision isn't mounted
+func (s *snapLister) snapVersion(name, revision string) string {
+	for _, mountDir := range s.mountDirs {
+		path := filepath.Join(mountDir, name, revision, "meta", "snap.yaml")
+		version, err := readSnapYamlVersion(path)
+		if err == nil {
+			return version
+		}
+		if !os.IsNotExist(err) {
+			s.logger.Warn("failed to read snap metadata", zap.String("path", path), zap.Error(err))
+		}
+	}
+	return ""
+}
+
+// readSnapYamlVersion locates the top-level version key of a snap.yaml, which is a simple
+// enough lookup to not need a full YAML parser
+func readSnapYamlVersion(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "version:") {
+			version := strings.TrimSpace(strings.TrimPrefix(line, "version:"))
+			return strings.Trim(version, `'"`), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%s has no version", path)
+}
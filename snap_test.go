@@ -0,0 +1,71 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapLister_ListPackages(t *testing.T) {
+	lister := &snapLister{
+		statePath: filepath.Join("testdata", "snap", "snapd", "state.json"),
+		mountDirs: []string{
+			filepath.Join("testdata", "snap", "not-mount"),
+			filepath.Join("testdata", "snap", "mount"),
+		},
+		logger: zap.NewNop(),
+	}
+
+	assert.Equal(t, "snap", lister.PackagingSystem())
+	require.True(t, lister.IsSupported())
+
+	packages, err := lister.ListPackages(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, []SoftwarePackage{
+		{
+			Name:    "core20",
+			Version: "20230801",
+			Extra:   map[string]string{"revision": "1974", "type": "base", "channel": "latest/stable"},
+		},
+		{
+			Name:    "firefox",
+			Version: "119.0-2",
+			Extra:   map[string]string{"revision": "3252", "type": "app", "channel": "latest/stable"},
+		},
+		{
+			// not mounted, so the version isn't known
+			Name:    "hello",
+			Version: "",
+			Extra:   map[string]string{"revision": "42", "type": "app", "disabled": "true"},
+		},
+	}, packages)
+}
+
+func TestSnapLister_notSupported(t *testing.T) {
+	lister := &snapLister{
+		statePath: filepath.Join("testdata", "not-snap", "state.json"),
+		logger:    zap.NewNop(),
+	}
+
+	assert.False(t, lister.IsSupported())
+}
@@ -0,0 +1,504 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SpdxVersion        = "SPDX-2.3"
+	spdxDataLicense    = "CC0-1.0"
+	spdxDocumentId     = "SPDXRef-DOCUMENT"
+	spdxHostId         = "SPDXRef-Host"
+	spdxOsId           = "SPDXRef-OperatingSystem"
+	spdxNoAssertion    = "NOASSERTION"
+	spdxNamespaceBase  = "https://github.com/racker/salus-packages-agent/spdx/"
+	spdxLicenseRefBase = "LicenseRef-"
+)
+
+// SpdxEncoding selects the encoding of SPDX documents
+type SpdxEncoding int
+
+const (
+	SpdxJson SpdxEncoding = iota
+	SpdxTagValue
+)
+
+// spdxInvalidIdChars are replaced in the identifiers derived from package systems and licenses
+// since an SPDX identifier may only contain letters, numbers, periods, and hyphens
+var spdxInvalidIdChars = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// spdxEmailAddress matches the trailing email address of a maintainer, such as a Debian
+// Maintainer field, which SPDX declares in parentheses rather than angle brackets
+var spdxEmailAddress = regexp.MustCompile(`\s*<([^>]*)>$`)
+
+type spdxDocument struct {
+	SpdxVersion          string                     `json:"spdxVersion"`
+	DataLicense          string                     `json:"dataLicense"`
+	SpdxId               string                     `json:"SPDXID"`
+	Name                 string                     `json:"name"`
+	DocumentNamespace    string                     `json:"documentNamespace"`
+	CreationInfo         spdxCreationInfo           `json:"creationInfo"`
+	Packages             []spdxPackage              `json:"packages"`
+	Relationships        []spdxRelationship         `json:"relationships"`
+	ExtractedLicenseInfo []spdxExtractedLicenseInfo `json:"hasExtractedLicensingInfos,omitempty"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+	Comment  string   `json:"comment,omitempty"`
+}
+
+type spdxPackage struct {
+	SpdxId                string            `json:"SPDXID"`
+	Name                  string            `json:"name"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	Supplier              string            `json:"supplier,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	LicenseConcluded      string            `json:"licenseConcluded,omitempty"`
+	LicenseDeclared       string            `json:"licenseDeclared,omitempty"`
+	Summary               string            `json:"summary,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	Comment               string            `json:"comment,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SpdxElementId      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSpdxElement string `json:"relatedSpdxElement"`
+}
+
+// spdxExtractedLicenseInfo declares a license in the terms of its package system, which are
+// rarely valid SPDX license expressions, such as rpm's GPLv2+
+type spdxExtractedLicenseInfo struct {
+	LicenseId     string `json:"licenseId"`
+	ExtractedText string `json:"extractedText"`
+	Name          string `json:"name"`
+}
+
+// spdxReporter writes each batch as an SPDX document, where the host is a package that contains
+// a package per reported package, once the batch is closed
+type spdxReporter struct {
+	// mu serializes the writing of the batches of concurrent configs
+	mu          *sync.Mutex
+	out         io.Writer
+	encoding    SpdxEncoding
+	hostname    string
+	toolVersion string
+	logger      *zap.Logger
+	// newUuid generates the unique part of each document's namespace
+	newUuid func() string
+}
+
+// NewSpdxReporter creates a reporter that writes each batch to out as an SPDX document
+// describing the host. The toolVersion, if known, is the version of the agent recorded as the
+// creator of the document.
+func NewSpdxReporter(out io.Writer, encoding SpdxEncoding, hostname string, toolVersion string,
+	logger *zap.Logger) PackagesReporter {
+	return &spdxReporter{
+		mu:          &sync.Mutex{},
+		out:         out,
+		encoding:    encoding,
+		hostname:    hostname,
+		toolVersion: toolVersion,
+		logger:      logger,
+		newUuid:     newUuid,
+	}
+}
+
+func (s *spdxReporter) StartBatch(timestamp time.Time, tags map[string]string) PackagesReporterBatch {
+	document := spdxDocument{
+		SpdxVersion:       SpdxVersion,
+		DataLicense:       spdxDataLicense,
+		SpdxId:            spdxDocumentId,
+		Name:              s.hostname,
+		DocumentNamespace: spdxNamespaceBase + spdxInvalidIdChars.ReplaceAllString(s.hostname, "-") + "-" + s.newUuid(),
+		CreationInfo: spdxCreationInfo{
+			Created:  timestamp.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: " + toolIdentity(s.toolVersion)},
+		},
+		Packages: []spdxPackage{{
+			SpdxId:                spdxHostId,
+			Name:                  s.hostname,
+			DownloadLocation:      spdxNoAssertion,
+			PrimaryPackagePurpose: "DEVICE",
+		}},
+		Relationships: []spdxRelationship{{
+			SpdxElementId:      spdxDocumentId,
+			RelationshipType:   "DESCRIBES",
+			RelatedSpdxElement: spdxHostId,
+		}},
+	}
+
+	var comments []string
+	for _, key := range sortedKeys(tags) {
+		comments = append(comments, fmt.Sprintf("Tag %s: %s", key, tags[key]))
+	}
+
+	return &spdxReporterBatch{
+		reporter:   s,
+		document:   document,
+		comments:   comments,
+		ids:        make(map[string]struct{}),
+		licenseIds: make(map[string]string),
+	}
+}
+
+type spdxReporterBatch struct {
+	reporter *spdxReporter
+	document spdxDocument
+	// comments are the lines of the creation comment, which describe the tags and failures
+	comments []string
+	// ids tracks the package identifiers in use
+	ids map[string]struct{}
+	// licenseIds maps each declared license to its extracted license identifier
+	licenseIds map[string]string
+}
+
+func (s *spdxReporterBatch) ReportSuccess(system string, packages []SoftwarePackage) {
+	for _, pkg := range packages {
+		spdxPkg := s.spdxPackage(system, pkg)
+		s.document.Packages = append(s.document.Packages, spdxPkg)
+		s.document.Relationships = append(s.document.Relationships, spdxRelationship{
+			SpdxElementId:      spdxHostId,
+			RelationshipType:   "CONTAINS",
+			RelatedSpdxElement: spdxPkg.SpdxId,
+		})
+	}
+}
+
+func (s *spdxReporterBatch) spdxPackage(system string, pkg SoftwarePackage) spdxPackage {
+	spdxPkg := spdxPackage{
+		SpdxId:                s.uniqueId("SPDXRef-Package-" + system + "-" + pkg.Name),
+		Name:                  pkg.Name,
+		VersionInfo:           pkg.Version,
+		Supplier:              spdxSupplier(pkg.Vendor),
+		DownloadLocation:      spdxNoAssertion,
+		LicenseConcluded:      spdxNoAssertion,
+		LicenseDeclared:       s.licenseId(pkg.License),
+		Summary:               pkg.Summary,
+		PrimaryPackagePurpose: "LIBRARY",
+	}
+	switch system {
+	case "snap", "flatpak":
+		spdxPkg.PrimaryPackagePurpose = "APPLICATION"
+	}
+	if purl := packagePurl(system, pkg); purl != "" {
+		spdxPkg.ExternalRefs = []spdxExternalRef{{
+			ReferenceCategory: "PACKAGE-MANAGER",
+			ReferenceType:     "purl",
+			ReferenceLocator:  purl,
+		}}
+	}
+	return spdxPkg
+}
+
+// uniqueId sanitizes the identifier and adds a numeric suffix when it is already in use, such
+// as for the same package installed in more than one location
+func (s *spdxReporterBatch) uniqueId(id string) string {
+	id = spdxInvalidIdChars.ReplaceAllString(id, "-")
+	unique := id
+	for i := 2; ; i++ {
+		if _, exists := s.ids[unique]; !exists {
+			break
+		}
+		unique = id + "-" + strconv.Itoa(i)
+	}
+	s.ids[unique] = struct{}{}
+	return unique
+}
+
+// licenseId returns the declared license as it is, when it is an SPDX license expression, or
+// otherwise the identifier of its extracted license info, adding the info the first time the
+// license is seen
+func (s *spdxReporterBatch) licenseId(license string) string {
+	if license == "" {
+		return spdxNoAssertion
+	}
+	if isSpdxLicenseExpression(license) {
+		return license
+	}
+	if id, ok := s.licenseIds[license]; ok {
+		return id
+	}
+
+	id := s.uniqueId(spdxLicenseRefBase + strings.Trim(spdxInvalidIdChars.ReplaceAllString(license, "-"), "-"))
+	s.licenseIds[license] = id
+	s.document.ExtractedLicenseInfo = append(s.document.ExtractedLicenseInfo, spdxExtractedLicenseInfo{
+		LicenseId:     id,
+		ExtractedText: license,
+		Name:          license,
+	})
+	return id
+}
+
+var (
+	spdxLicenseIdSet   = lowerCaseSet(spdxLicenseIds)
+	spdxExceptionIdSet = lowerCaseSet(spdxExceptionIds)
+)
+
+// isSpdxLicenseExpression determines if the license is an SPDX license expression, such as
+// "MIT" or "(GPL-2.0-or-later WITH Classpath-exception-2.0) OR MIT", of the identifiers of the
+// SPDX License List, which are matched without regard to case
+func isSpdxLicenseExpression(license string) bool {
+	parser := &spdxExpressionParser{
+		tokens: strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(license)),
+	}
+	return parser.expression() && parser.pos == len(parser.tokens)
+}
+
+// spdxExpressionParser is a recursive descent parser of the license expression grammar of
+// https://spdx.github.io/spdx-spec/v2.3/SPDX-license-expressions/
+type spdxExpressionParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *spdxExpressionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// expression parses the terms joined by the AND and OR operators
+func (p *spdxExpressionParser) expression() bool {
+	if !p.term() {
+		return false
+	}
+	for p.peek() == "AND" || p.peek() == "OR" {
+		p.pos++
+		if !p.term() {
+			return false
+		}
+	}
+	return true
+}
+
+// term parses a parenthesized expression or a license identifier, which may be "or later"
+// and may have an exception
+func (p *spdxExpressionParser) term() bool {
+	if p.peek() == "(" {
+		p.pos++
+		if !p.expression() || p.peek() != ")" {
+			return false
+		}
+		p.pos++
+		return true
+	}
+
+	if !spdxLicenseIdSet[strings.ToLower(strings.TrimSuffix(p.peek(), "+"))] {
+		return false
+	}
+	p.pos++
+	if p.peek() == "WITH" {
+		p.pos++
+		if !spdxExceptionIdSet[strings.ToLower(p.peek())] {
+			return false
+		}
+		p.pos++
+	}
+	return true
+}
+
+func lowerCaseSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[strings.ToLower(value)] = true
+	}
+	return set
+}
+
+// spdxSupplier formats the vendor of a package as an SPDX organization
+func spdxSupplier(vendor string) string {
+	if vendor == "" {
+		return ""
+	}
+	return "Organization: " + spdxEmailAddress.ReplaceAllString(vendor, " ($1)")
+}
+
+func (s *spdxReporterBatch) ReportChanges(system string, changes []PackageChange) {
+	// an SBOM only describes the current inventory
+}
+
+// ReportFailure records the package system in the creation comment since the document will be
+// missing its packages
+func (s *spdxReporterBatch) ReportFailure(system string, err error) {
+	s.reporter.logger.Warn("SBOM will be missing the packages of a failed package system",
+		zap.String("system", system), zap.Error(err))
+	s.comments = append(s.comments, "Failed to list the packages of "+system)
+}
+
+// RequiresExtended is true since the declared license, supplier, and summary are part of each
+// package
+func (s *spdxReporterBatch) RequiresExtended() bool {
+	return true
+}
+
+func (s *spdxReporterBatch) ReportCollection(system string, summary CollectionSummary) {
+	// not applicable to an SBOM
+}
+
+func (s *spdxReporterBatch) ReportVulnerabilities(system string, vulnerabilities []PackageVulnerability) {
+	// SPDX 2.3 has no representation of vulnerabilities, which are reported by the other formats
+}
+
+// ReportOsInfo adds the distribution as an operating system package contained by the host and
+// describes the host in its package comment
+func (s *spdxReporterBatch) ReportOsInfo(info OsInfo) {
+	if info.Distro != nil && info.Distro.ID != "" {
+		osId := s.uniqueId(spdxOsId)
+		s.document.Packages = append(s.document.Packages, spdxPackage{
+			SpdxId:                osId,
+			Name:                  info.Distro.ID,
+			VersionInfo:           info.Distro.VersionID,
+			DownloadLocation:      spdxNoAssertion,
+			Summary:               info.Distro.PrettyName,
+			PrimaryPackagePurpose: "OPERATING_SYSTEM",
+		})
+		s.document.Relationships = append(s.document.Relationships, spdxRelationship{
+			SpdxElementId:      spdxHostId,
+			RelationshipType:   "CONTAINS",
+			RelatedSpdxElement: osId,
+		})
+	}
+
+	var comments []string
+	for _, detail := range []struct{ label, value string }{
+		{"Kernel release", info.KernelRelease},
+		{"Architecture", info.Arch},
+		{"Machine ID", info.MachineId},
+	} {
+		if detail.value != "" {
+			comments = append(comments, detail.label+": "+detail.value)
+		}
+	}
+	s.document.Packages[0].Comment = strings.Join(comments, "\n")
+}
+
+func (s *spdxReporterBatch) Close() error {
+	s.document.CreationInfo.Comment = strings.Join(s.comments, "\n")
+
+	s.reporter.mu.Lock()
+	defer s.reporter.mu.Unlock()
+
+	var err error
+	switch s.reporter.encoding {
+	case SpdxTagValue:
+		err = writeSpdxTagValue(s.reporter.out, &s.document)
+	default:
+		encoder := json.NewEncoder(s.reporter.out)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(s.document)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write SPDX document: %w", err)
+	}
+	return nil
+}
+
+// spdxTagValueWriter writes the tags of the tag-value format, retaining the first error
+type spdxTagValueWriter struct {
+	out io.Writer
+	err error
+}
+
+func (w *spdxTagValueWriter) line(line string) {
+	if w.err == nil {
+		_, w.err = io.WriteString(w.out, line+"\n")
+	}
+}
+
+// tag writes the tag when the value is present, where multi-line values are enclosed in text
+// elements
+func (w *spdxTagValueWriter) tag(tag string, value string) {
+	if value == "" {
+		return
+	}
+	if strings.Contains(value, "\n") {
+		value = "<text>" + value + "</text>"
+	}
+	w.line(tag + ": " + value)
+}
+
+func writeSpdxTagValue(out io.Writer, document *spdxDocument) error {
+	w := &spdxTagValueWriter{out: out}
+
+	w.tag("SPDXVersion", document.SpdxVersion)
+	w.tag("DataLicense", document.DataLicense)
+	w.tag("SPDXID", document.SpdxId)
+	w.tag("DocumentName", document.Name)
+	w.tag("DocumentNamespace", document.DocumentNamespace)
+	for _, creator := range document.CreationInfo.Creators {
+		w.tag("Creator", creator)
+	}
+	w.tag("Created", document.CreationInfo.Created)
+	w.tag("CreatorComment", document.CreationInfo.Comment)
+
+	for _, pkg := range document.Packages {
+		w.line("")
+		w.tag("PackageName", pkg.Name)
+		w.tag("SPDXID", pkg.SpdxId)
+		w.tag("PackageVersion", pkg.VersionInfo)
+		w.tag("PackageSupplier", pkg.Supplier)
+		w.tag("PackageDownloadLocation", pkg.DownloadLocation)
+		w.tag("FilesAnalyzed", strconv.FormatBool(pkg.FilesAnalyzed))
+		w.tag("PackageLicenseConcluded", pkg.LicenseConcluded)
+		w.tag("PackageLicenseDeclared", pkg.LicenseDeclared)
+		w.tag("PackageSummary", pkg.Summary)
+		for _, ref := range pkg.ExternalRefs {
+			w.tag("ExternalRef", ref.ReferenceCategory+" "+ref.ReferenceType+" "+ref.ReferenceLocator)
+		}
+		// the tag-value format hyphenates the purposes that JSON declares with underscores
+		w.tag("PrimaryPackagePurpose", strings.ReplaceAll(pkg.PrimaryPackagePurpose, "_", "-"))
+		w.tag("PackageComment", pkg.Comment)
+	}
+
+	w.line("")
+	for _, relationship := range document.Relationships {
+		w.tag("Relationship",
+			relationship.SpdxElementId+" "+relationship.RelationshipType+" "+relationship.RelatedSpdxElement)
+	}
+
+	for _, license := range document.ExtractedLicenseInfo {
+		w.line("")
+		w.tag("LicenseID", license.LicenseId)
+		w.line("ExtractedText: <text>" + license.ExtractedText + "</text>")
+		w.tag("LicenseName", license.Name)
+	}
+
+	return w.err
+}
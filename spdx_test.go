@@ -0,0 +1,319 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xeipuuv/gojsonschema"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func reportSpdx(t *testing.T, encoding SpdxEncoding) string {
+	timestamp, err := time.ParseInLocation(time.RFC3339, "2006-01-02T15:04:05Z", time.UTC)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	reporter := NewSpdxReporter(&out, encoding, "web-1", "1.2.0", zap.NewNop())
+	reporter.(*spdxReporter).newUuid = func() string {
+		return "3e671687-395b-41f5-a30f-a58921a69b79"
+	}
+	batch := reporter.StartBatch(timestamp, map[string]string{"image": "debian:10"})
+	require.True(t, requiresExtended(batch))
+
+	batch.ReportOsInfo(OsInfo{
+		Distro:        &OsRelease{ID: "debian", VersionID: "10", PrettyName: "Debian GNU/Linux 10 (buster)"},
+		KernelRelease: "4.19.0-6-amd64",
+		Arch:          "x86_64",
+	})
+	batch.ReportSuccess("debian", []SoftwarePackage{
+		{Name: "libstdc++6", Version: "8.3.0-6", Arch: "amd64",
+			Vendor: "Debian GCC Maintainers <debian-gcc@lists.debian.org>", Summary: "GNU Standard C++ Library v3",
+			License: "GPL-3+ with GCC-Runtime-Library-exception"},
+		{Name: "tzdata", Version: "2019c-0+deb10u1", Arch: "all"},
+	})
+	batch.ReportSuccess("python", []SoftwarePackage{
+		{Name: "six", Version: "1.16.0", License: "MIT", Location: "/usr/lib/python3/dist-packages"},
+		{Name: "six", Version: "1.16.0", License: "MIT", Location: "/srv/venv/lib/python3.7/site-packages"},
+	})
+	batch.ReportSuccess("snap", []SoftwarePackage{
+		{Name: "core18", Version: "20191126", License: "(GPL-2.0 OR MIT) AND Apache-2.0"},
+	})
+	batch.ReportFailure("npm", errors.New("failed to read manifest"))
+	require.NoError(t, batch.Close())
+
+	return out.String()
+}
+
+func TestSpdxReporter_json(t *testing.T) {
+	document := reportSpdx(t, SpdxJson)
+
+	assert.JSONEq(t, `{
+  "spdxVersion": "SPDX-2.3",
+  "dataLicense": "CC0-1.0",
+  "SPDXID": "SPDXRef-DOCUMENT",
+  "name": "web-1",
+  "documentNamespace": "https://github.com/racker/salus-packages-agent/spdx/web-1-3e671687-395b-41f5-a30f-a58921a69b79",
+  "creationInfo": {
+    "created": "2006-01-02T15:04:05Z",
+    "creators": ["Tool: salus-packages-agent-1.2.0"],
+    "comment": "Tag image: debian:10\nFailed to list the packages of npm"
+  },
+  "packages": [
+    {
+      "SPDXID": "SPDXRef-Host",
+      "name": "web-1",
+      "downloadLocation": "NOASSERTION",
+      "filesAnalyzed": false,
+      "primaryPackagePurpose": "DEVICE",
+      "comment": "Kernel release: 4.19.0-6-amd64\nArchitecture: x86_64"
+    },
+    {
+      "SPDXID": "SPDXRef-OperatingSystem",
+      "name": "debian",
+      "versionInfo": "10",
+      "downloadLocation": "NOASSERTION",
+      "filesAnalyzed": false,
+      "summary": "Debian GNU/Linux 10 (buster)",
+      "primaryPackagePurpose": "OPERATING_SYSTEM"
+    },
+    {
+      "SPDXID": "SPDXRef-Package-debian-libstdc-6",
+      "name": "libstdc++6",
+      "versionInfo": "8.3.0-6",
+      "supplier": "Organization: Debian GCC Maintainers (debian-gcc@lists.debian.org)",
+      "downloadLocation": "NOASSERTION",
+      "filesAnalyzed": false,
+      "licenseConcluded": "NOASSERTION",
+      "licenseDeclared": "LicenseRef-GPL-3-with-GCC-Runtime-Library-exception",
+      "summary": "GNU Standard C++ Library v3",
+      "externalRefs": [
+        {"referenceCategory": "PACKAGE-MANAGER", "referenceType": "purl", "referenceLocator": "pkg:deb/debian/libstdc%2B%2B6@8.3.0-6?arch=amd64"}
+      ],
+      "primaryPackagePurpose": "LIBRARY"
+    },
+    {
+      "SPDXID": "SPDXRef-Package-debian-tzdata",
+      "name": "tzdata",
+      "versionInfo": "2019c-0+deb10u1",
+      "downloadLocation": "NOASSERTION",
+      "filesAnalyzed": false,
+      "licenseConcluded": "NOASSERTION",
+      "licenseDeclared": "NOASSERTION",
+      "externalRefs": [
+        {"referenceCategory": "PACKAGE-MANAGER", "referenceType": "purl", "referenceLocator": "pkg:deb/debian/tzdata@2019c-0%2Bdeb10u1?arch=all"}
+      ],
+      "primaryPackagePurpose": "LIBRARY"
+    },
+    {
+      "SPDXID": "SPDXRef-Package-python-six",
+      "name": "six",
+      "versionInfo": "1.16.0",
+      "downloadLocation": "NOASSERTION",
+      "filesAnalyzed": false,
+      "licenseConcluded": "NOASSERTION",
+      "licenseDeclared": "MIT",
+      "externalRefs": [
+        {"referenceCategory": "PACKAGE-MANAGER", "referenceType": "purl", "referenceLocator": "pkg:pypi/six@1.16.0"}
+      ],
+      "primaryPackagePurpose": "LIBRARY"
+    },
+    {
+      "SPDXID": "SPDXRef-Package-python-six-2",
+      "name": "six",
+      "versionInfo": "1.16.0",
+      "downloadLocation": "NOASSERTION",
+      "filesAnalyzed": false,
+      "licenseConcluded": "NOASSERTION",
+      "licenseDeclared": "MIT",
+      "externalRefs": [
+        {"referenceCategory": "PACKAGE-MANAGER", "referenceType": "purl", "referenceLocator": "pkg:pypi/six@1.16.0"}
+      ],
+      "primaryPackagePurpose": "LIBRARY"
+    },
+    {
+      "SPDXID": "SPDXRef-Package-snap-core18",
+      "name": "core18",
+      "versionInfo": "20191126",
+      "downloadLocation": "NOASSERTION",
+      "filesAnalyzed": false,
+      "licenseConcluded": "NOASSERTION",
+      "licenseDeclared": "(GPL-2.0 OR MIT) AND Apache-2.0",
+      "primaryPackagePurpose": "APPLICATION"
+    }
+  ],
+  "relationships": [
+    {"spdxElementId": "SPDXRef-DOCUMENT", "relationshipType": "DESCRIBES", "relatedSpdxElement": "SPDXRef-Host"},
+    {"spdxElementId": "SPDXRef-Host", "relationshipType": "CONTAINS", "relatedSpdxElement": "SPDXRef-OperatingSystem"},
+    {"spdxElementId": "SPDXRef-Host", "relationshipType": "CONTAINS", "relatedSpdxElement": "SPDXRef-Package-debian-libstdc-6"},
+    {"spdxElementId": "SPDXRef-Host", "relationshipType": "CONTAINS", "relatedSpdxElement": "SPDXRef-Package-debian-tzdata"},
+    {"spdxElementId": "SPDXRef-Host", "relationshipType": "CONTAINS", "relatedSpdxElement": "SPDXRef-Package-python-six"},
+    {"spdxElementId": "SPDXRef-Host", "relationshipType": "CONTAINS", "relatedSpdxElement": "SPDXRef-Package-python-six-2"},
+    {"spdxElementId": "SPDXRef-Host", "relationshipType": "CONTAINS", "relatedSpdxElement": "SPDXRef-Package-snap-core18"}
+  ],
+  "hasExtractedLicensingInfos": [
+    {"licenseId": "LicenseRef-GPL-3-with-GCC-Runtime-Library-exception", "extractedText": "GPL-3+ with GCC-Runtime-Library-exception", "name": "GPL-3+ with GCC-Runtime-Library-exception"}
+  ]
+}`, document)
+
+	result := validateSpdxSchema(t, document)
+	assert.Empty(t, result.Errors())
+}
+
+func TestSpdxReporter_tagValue(t *testing.T) {
+	assert.Equal(t, `SPDXVersion: SPDX-2.3
+DataLicense: CC0-1.0
+SPDXID: SPDXRef-DOCUMENT
+DocumentName: web-1
+DocumentNamespace: https://github.com/racker/salus-packages-agent/spdx/web-1-3e671687-395b-41f5-a30f-a58921a69b79
+Creator: Tool: salus-packages-agent-1.2.0
+Created: 2006-01-02T15:04:05Z
+CreatorComment: <text>Tag image: debian:10
+Failed to list the packages of npm</text>
+
+PackageName: web-1
+SPDXID: SPDXRef-Host
+PackageDownloadLocation: NOASSERTION
+FilesAnalyzed: false
+PrimaryPackagePurpose: DEVICE
+PackageComment: <text>Kernel release: 4.19.0-6-amd64
+Architecture: x86_64</text>
+
+PackageName: debian
+SPDXID: SPDXRef-OperatingSystem
+PackageVersion: 10
+PackageDownloadLocation: NOASSERTION
+FilesAnalyzed: false
+PackageSummary: Debian GNU/Linux 10 (buster)
+PrimaryPackagePurpose: OPERATING-SYSTEM
+
+PackageName: libstdc++6
+SPDXID: SPDXRef-Package-debian-libstdc-6
+PackageVersion: 8.3.0-6
+PackageSupplier: Organization: Debian GCC Maintainers (debian-gcc@lists.debian.org)
+PackageDownloadLocation: NOASSERTION
+FilesAnalyzed: false
+PackageLicenseConcluded: NOASSERTION
+PackageLicenseDeclared: LicenseRef-GPL-3-with-GCC-Runtime-Library-exception
+PackageSummary: GNU Standard C++ Library v3
+ExternalRef: PACKAGE-MANAGER purl pkg:deb/debian/libstdc%2B%2B6@8.3.0-6?arch=amd64
+PrimaryPackagePurpose: LIBRARY
+
+PackageName: tzdata
+SPDXID: SPDXRef-Package-debian-tzdata
+PackageVersion: 2019c-0+deb10u1
+PackageDownloadLocation: NOASSERTION
+FilesAnalyzed: false
+PackageLicenseConcluded: NOASSERTION
+PackageLicenseDeclared: NOASSERTION
+ExternalRef: PACKAGE-MANAGER purl pkg:deb/debian/tzdata@2019c-0%2Bdeb10u1?arch=all
+PrimaryPackagePurpose: LIBRARY
+
+PackageName: six
+SPDXID: SPDXRef-Package-python-six
+PackageVersion: 1.16.0
+PackageDownloadLocation: NOASSERTION
+FilesAnalyzed: false
+PackageLicenseConcluded: NOASSERTION
+PackageLicenseDeclared: MIT
+ExternalRef: PACKAGE-MANAGER purl pkg:pypi/six@1.16.0
+PrimaryPackagePurpose: LIBRARY
+
+PackageName: six
+SPDXID: SPDXRef-Package-python-six-2
+PackageVersion: 1.16.0
+PackageDownloadLocation: NOASSERTION
+FilesAnalyzed: false
+PackageLicenseConcluded: NOASSERTION
+PackageLicenseDeclared: MIT
+ExternalRef: PACKAGE-MANAGER purl pkg:pypi/six@1.16.0
+PrimaryPackagePurpose: LIBRARY
+
+PackageName: core18
+SPDXID: SPDXRef-Package-snap-core18
+PackageVersion: 20191126
+PackageDownloadLocation: NOASSERTION
+FilesAnalyzed: false
+PackageLicenseConcluded: NOASSERTION
+PackageLicenseDeclared: (GPL-2.0 OR MIT) AND Apache-2.0
+PrimaryPackagePurpose: APPLICATION
+
+Relationship: SPDXRef-DOCUMENT DESCRIBES SPDXRef-Host
+Relationship: SPDXRef-Host CONTAINS SPDXRef-OperatingSystem
+Relationship: SPDXRef-Host CONTAINS SPDXRef-Package-debian-libstdc-6
+Relationship: SPDXRef-Host CONTAINS SPDXRef-Package-debian-tzdata
+Relationship: SPDXRef-Host CONTAINS SPDXRef-Package-python-six
+Relationship: SPDXRef-Host CONTAINS SPDXRef-Package-python-six-2
+Relationship: SPDXRef-Host CONTAINS SPDXRef-Package-snap-core18
+
+LicenseID: LicenseRef-GPL-3-with-GCC-Runtime-Library-exception
+ExtractedText: <text>GPL-3+ with GCC-Runtime-Library-exception</text>
+LicenseName: GPL-3+ with GCC-Runtime-Library-exception
+`, reportSpdx(t, SpdxTagValue))
+}
+
+func TestIsSpdxLicenseExpression(t *testing.T) {
+	for _, license := range []string{
+		"MIT",
+		"mit",
+		"GPL-2.0+",
+		"(GPL-2.0 OR MIT) AND Apache-2.0",
+		"GPL-2.0-or-later WITH Classpath-exception-2.0",
+		"((MIT))",
+	} {
+		assert.True(t, isSpdxLicenseExpression(license), license)
+	}
+	for _, license := range []string{
+		"",
+		"GPLv2+",
+		"(GPLv2+ or AFL) and GPLv2+",
+		"MIT and BSD-3-Clause",
+		"MIT OR",
+		"(MIT",
+		"MIT)",
+		"GPL-2.0 WITH MIT",
+		"Public Domain",
+	} {
+		assert.False(t, isSpdxLicenseExpression(license), license)
+	}
+}
+
+func TestSpdxSchema_rejectsInvalid(t *testing.T) {
+	// ensures the schema used above is strict enough to catch a malformed document
+	result := validateSpdxSchema(t, `{"spdxVersion": "SPDX-2.3", "SPDXID": "SPDXRef-DOCUMENT",
+  "packages": [{"SPDXID": "SPDXRef-Package", "name": "tzdata", "version": "2019c"}]}`)
+	assert.False(t, result.Valid())
+}
+
+// spdxSchemaUrl is the SPDX 2.3 JSON schema as published with the specification
+const spdxSchemaUrl = "https://raw.githubusercontent.com/spdx/spdx-spec/v2.3/schemas/spdx-schema.json"
+
+// validateSpdxSchema validates the document against the published schema, rather than a
+// copy of it, and skips the remainder of the test when the schema can't be retrieved
+func validateSpdxSchema(t *testing.T, document string) *gojsonschema.Result {
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader(spdxSchemaUrl))
+	if err != nil {
+		t.Skipf("unable to retrieve the SPDX schema: %v", err)
+	}
+	result, err := schema.Validate(gojsonschema.NewStringLoader(document))
+	require.NoError(t, err)
+	return result
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/multierr"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CollectionState is what is persisted for each config between runs of the agent
+type CollectionState struct {
+	// LastCollection is when the config was last collected, whether or not it succeeded
+	LastCollection time.Time `json:"last-collection"`
+	// Systems holds the last successful inventory of each packaging system
+	Systems map[string]*SystemState `json:"systems"`
+}
+
+type SystemState struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Packages  []SoftwarePackage `json:"packages"`
+}
+
+// StateStore persists the state of each config as a JSON file, named after the config, in
+// its directory
+type StateStore struct {
+	dir string
+}
+
+// NewStateStore creates a store that persists to the given directory, creating it if needed
+func NewStateStore(dir string) (*StateStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	return &StateStore{dir: dir}, nil
+}
+
+func (s *StateStore) path(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+// Load retrieves the state of the named config or an empty state if none was persisted
+func (s *StateStore) Load(name string) (*CollectionState, error) {
+	state := &CollectionState{Systems: make(map[string]*SystemState)}
+
+	content, err := ioutil.ReadFile(s.path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, fmt.Errorf("failed to read state of %s: %w", name, err)
+	}
+
+	err = json.Unmarshal(content, state)
+	if err != nil {
+		return &CollectionState{Systems: make(map[string]*SystemState)},
+			fmt.Errorf("failed to decode state of %s: %w", name, err)
+	}
+	if state.Systems == nil {
+		state.Systems = make(map[string]*SystemState)
+	}
+	return state, nil
+}
+
+// Save persists the state of the named config. The state is written to a temporary file that
+// replaces the previous state, so that a crash cannot leave a partially written file.
+func (s *StateStore) Save(name string, state *CollectionState) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode state of %s: %w", name, err)
+	}
+
+	file, err := ioutil.TempFile(s.dir, name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create state of %s: %w", name, err)
+	}
+	_, err = file.Write(content)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), s.path(name))
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return fmt.Errorf("failed to write state of %s: %w", name, err)
+	}
+	return nil
+}
+
+// stateRecordingBatch records the successful inventories reported to the decorated batch and
+// persists the state when the batch is closed
+type stateRecordingBatch struct {
+	PackagesReporterBatch
+	store     *StateStore
+	name      string
+	state     *CollectionState
+	timestamp time.Time
+}
+
+func (s *stateRecordingBatch) ReportSuccess(system string, packages []SoftwarePackage) {
+	s.state.Systems[system] = &SystemState{Timestamp: s.timestamp, Packages: packages}
+	s.PackagesReporterBatch.ReportSuccess(system, packages)
+}
+
+// ReportPartialSuccess keeps the previously recorded inventory of the package system
+func (s *stateRecordingBatch) ReportPartialSuccess(system string, packages []SoftwarePackage) {
+	reportPartialSuccess(s.PackagesReporterBatch, system, packages)
+}
+
+func (s *stateRecordingBatch) Close() error {
+	s.state.LastCollection = s.timestamp
+	return multierr.Combine(
+		s.store.Save(s.name, s.state),
+		s.PackagesReporterBatch.Close(),
+	)
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateStore_roundTrip(t *testing.T) {
+	store, err := NewStateStore(filepath.Join(t.TempDir(), "state"))
+	require.NoError(t, err)
+
+	state, err := store.Load("deb-monitor")
+	require.NoError(t, err)
+	assert.True(t, state.LastCollection.IsZero())
+	assert.Empty(t, state.Systems)
+
+	timestamp := time.Date(2020, 1, 15, 17, 45, 53, 0, time.UTC)
+	state.LastCollection = timestamp
+	state.Systems["debian"] = &SystemState{
+		Timestamp: timestamp,
+		Packages: []SoftwarePackage{
+			{Name: "dpkg", Version: "1.19.7", Arch: "amd64", Extra: map[string]string{"Priority": "required"}},
+		},
+	}
+	require.NoError(t, store.Save("deb-monitor", state))
+
+	restored, err := store.Load("deb-monitor")
+	require.NoError(t, err)
+	assert.Equal(t, state, restored)
+
+	// only the state file remains
+	entries, err := ioutil.ReadDir(store.dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "deb-monitor.json", entries[0].Name())
+}
+
+func TestStateStore_corrupt(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bad.json"), []byte("{not json"), 0600))
+	store, err := NewStateStore(dir)
+	require.NoError(t, err)
+
+	state, err := store.Load("bad")
+	assert.Error(t, err)
+	// ...but a usable state is still provided
+	require.NotNil(t, state)
+	assert.NotNil(t, state.Systems)
+}
+
+func TestCollectWithConfigs_restoredState(t *testing.T) {
+	store, err := NewStateStore(t.TempDir())
+	require.NoError(t, err)
+
+	lastCollection := time.Now().Add(-10 * time.Minute)
+	require.NoError(t, store.Save("deb-monitor", &CollectionState{
+		LastCollection: lastCollection,
+		Systems: map[string]*SystemState{
+			"mock1": {
+				Timestamp: lastCollection,
+				Packages:  []SoftwarePackage{{Name: "dpkg", Version: "1.19.7", Arch: "amd64"}},
+			},
+		},
+	}))
+
+	lister := &mockPackageLister{}
+	lister.On("PackagingSystem").Return("mock1")
+	lister.On("IsSupported").Return(true)
+	lister.On("ListPackages").Return([]SoftwarePackage{{Name: "dpkg", Version: "1.19.8", Arch: "amd64"}}, nil)
+	listersFromConfig = func(config *Config, logger *zap.Logger) []SoftwarePackageLister {
+		return []SoftwarePackageLister{lister}
+	}
+	initialCollectionDelay = 1 * time.Millisecond
+
+	t.Run("interval not elapsed", func(t *testing.T) {
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		defer cancelFunc()
+
+		reporter := &mockReporter{}
+		CollectWithConfigs(ctx, []*Config{{
+			Name:     "deb-monitor",
+			Interval: Interval(1 * time.Hour),
+		}}, reporter, store, zap.NewNop())
+
+		time.Sleep(50 * time.Millisecond)
+		reporter.AssertNotCalled(t, "StartBatch", mock.Anything, mock.Anything)
+	})
+
+	t.Run("changes since restored", func(t *testing.T) {
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		defer cancelFunc()
+
+		closed := make(chan struct{})
+		batch := &mockReporterBatch{}
+		batch.On("ReportChanges", mock.Anything, mock.Anything)
+		batch.On("ReportOsInfo", mock.Anything)
+		batch.On("Close").Return(nil).Run(func(mock.Arguments) {
+			close(closed)
+		})
+		reporter := &mockReporter{}
+		reporter.On("StartBatch", mock.Anything, mock.Anything).Return(batch)
+
+		CollectWithConfigs(ctx, []*Config{{
+			Name:       "deb-monitor",
+			Interval:   Interval(5 * time.Minute),
+			ReportMode: ReportChanges,
+		}}, reporter, store, zap.NewNop())
+
+		select {
+		case <-closed:
+		case <-time.After(1 * time.Second):
+			t.Fatal("timeout waiting for collection")
+		}
+
+		// the restored inventory is the baseline for the changes
+		batch.AssertCalled(t, "ReportChanges", "mock1", []PackageChange{
+			{Change: PackageUpgraded, Name: "dpkg", Arch: "amd64", OldVersion: "1.19.7", NewVersion: "1.19.8"},
+		})
+		batch.AssertNotCalled(t, "ReportSuccess", mock.Anything, mock.Anything)
+
+		state, err := store.Load("deb-monitor")
+		require.NoError(t, err)
+		assert.True(t, state.LastCollection.After(lastCollection))
+		assert.Equal(t, "1.19.8", state.Systems["mock1"].Packages[0].Version)
+	})
+}
@@ -0,0 +1 @@
+# not metadata
@@ -0,0 +1,639 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CompareVersions orders two versions of a package using the rules of the packaging system
+// that installed it. The result is negative when a is older than b, zero when they are
+// equivalent, and positive when a is newer than b.
+func CompareVersions(system string, a, b string) int {
+	switch system {
+	case "debian":
+		return compareDpkgVersions(a, b)
+	case "rpm":
+		return compareRpmVersions(a, b)
+	case "apk":
+		return compareApkVersions(a, b)
+	case "python":
+		return comparePep440Versions(a, b)
+	case "npm":
+		return compareSemverVersions(a, b)
+	default:
+		return compareGenericVersions(a, b)
+	}
+}
+
+// splitEpoch separates the optional numeric epoch prefix, as used by both dpkg and rpm,
+// from the remainder of the version
+func splitEpoch(version string) (int, string) {
+	i := strings.IndexByte(version, ':')
+	if i < 0 {
+		return 0, version
+	}
+	epoch, err := strconv.Atoi(version[:i])
+	if err != nil {
+		return 0, version
+	}
+	return epoch, version[i+1:]
+}
+
+// versionEpoch returns the epoch prefix of a dpkg or rpm version, or empty if it has none
+func versionEpoch(version string) string {
+	i := strings.IndexByte(version, ':')
+	if i < 0 {
+		return ""
+	}
+	if _, err := strconv.Atoi(version[:i]); err != nil {
+		return ""
+	}
+	return version[:i]
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compareDpkgVersions implements the [epoch:]upstream[-revision] ordering of dpkg's verrevcmp
+func compareDpkgVersions(a, b string) int {
+	epochA, restA := splitEpoch(a)
+	epochB, restB := splitEpoch(b)
+	if c := compareInts(epochA, epochB); c != 0 {
+		return c
+	}
+
+	upstreamA, revisionA := splitDpkgRevision(restA)
+	upstreamB, revisionB := splitDpkgRevision(restB)
+	if c := dpkgVerRevCmp(upstreamA, upstreamB); c != 0 {
+		return c
+	}
+	return dpkgVerRevCmp(revisionA, revisionB)
+}
+
+func splitDpkgRevision(version string) (string, string) {
+	i := strings.LastIndexByte(version, '-')
+	if i < 0 {
+		return version, ""
+	}
+	return version[:i], version[i+1:]
+}
+
+// dpkgOrder weighs a character of the non-digit parts, where letters sort before
+// non-letters and a tilde sorts before anything, even the end of the part
+func dpkgOrder(c byte) int {
+	switch {
+	case isDigit(c):
+		return 0
+	case isLetter(c):
+		return int(c)
+	case c == '~':
+		return -1
+	default:
+		return int(c) + 256
+	}
+}
+
+func dpkgVerRevCmp(a, b string) int {
+	for a != "" || b != "" {
+		firstDiff := 0
+		for (a != "" && !isDigit(a[0])) || (b != "" && !isDigit(b[0])) {
+			orderA, orderB := 0, 0
+			if a != "" {
+				orderA = dpkgOrder(a[0])
+			}
+			if b != "" {
+				orderB = dpkgOrder(b[0])
+			}
+			if orderA != orderB {
+				return compareInts(orderA, orderB)
+			}
+			a, b = a[1:], b[1:]
+		}
+
+		for a != "" && a[0] == '0' {
+			a = a[1:]
+		}
+		for b != "" && b[0] == '0' {
+			b = b[1:]
+		}
+		for a != "" && isDigit(a[0]) && b != "" && isDigit(b[0]) {
+			if firstDiff == 0 {
+				firstDiff = compareInts(int(a[0]), int(b[0]))
+			}
+			a, b = a[1:], b[1:]
+		}
+		if a != "" && isDigit(a[0]) {
+			return 1
+		}
+		if b != "" && isDigit(b[0]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return firstDiff
+		}
+	}
+	return 0
+}
+
+// compareRpmVersions implements the [epoch:]version-release ordering of rpm, where the
+// version and release are each compared with rpmvercmp
+func compareRpmVersions(a, b string) int {
+	epochA, restA := splitEpoch(a)
+	epochB, restB := splitEpoch(b)
+	if c := compareInts(epochA, epochB); c != 0 {
+		return c
+	}
+
+	versionA, releaseA := splitDpkgRevision(restA)
+	versionB, releaseB := splitDpkgRevision(restB)
+	if c := rpmVerCmp(versionA, versionB); c != 0 {
+		return c
+	}
+	return rpmVerCmp(releaseA, releaseB)
+}
+
+// rpmVerCmp compares alternating runs of digits and letters, where separators are ignored,
+// a tilde sorts before anything, and a caret sorts after the end but before anything else
+func rpmVerCmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	for a != "" || b != "" {
+		for a != "" && !isAlnum(a[0]) && a[0] != '~' && a[0] != '^' {
+			a = a[1:]
+		}
+		for b != "" && !isAlnum(b[0]) && b[0] != '~' && b[0] != '^' {
+			b = b[1:]
+		}
+
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if strings.HasPrefix(a, "^") || strings.HasPrefix(b, "^") {
+			if a == "" {
+				return -1
+			}
+			if b == "" {
+				return 1
+			}
+			if !strings.HasPrefix(a, "^") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "^") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if a == "" || b == "" {
+			break
+		}
+
+		var segA, segB string
+		numeric := isDigit(a[0])
+		if numeric {
+			segA, a = spanPrefix(a, isDigit)
+			segB, b = spanPrefix(b, isDigit)
+		} else {
+			segA, a = spanPrefix(a, isLetter)
+			segB, b = spanPrefix(b, isLetter)
+		}
+
+		// numeric segments are newer than alphabetic ones
+		if segB == "" {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+
+		if numeric {
+			if c := compareNumericStrings(segA, segB); c != 0 {
+				return c
+			}
+		} else if c := strings.Compare(segA, segB); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	default:
+		return 1
+	}
+}
+
+// apkVersion is a version of the form number{.number}...{letter}{_suffix{number}}...{-r#}
+// that is ordered by apk
+type apkVersion struct {
+	numbers  []string
+	letter   byte
+	suffixes []apkSuffix
+	revision string
+}
+
+type apkSuffix struct {
+	rank   int
+	number string
+}
+
+// apkSuffixRanks orders the suffixes, where the negative ranks are pre-releases that are
+// older than the version without the suffix
+var apkSuffixRanks = map[string]int{
+	"alpha": -4,
+	"beta":  -3,
+	"pre":   -2,
+	"rc":    -1,
+	"cvs":   1,
+	"svn":   2,
+	"git":   3,
+	"hg":    4,
+	"p":     5,
+}
+
+func parseApkVersion(version string) (apkVersion, bool) {
+	var v apkVersion
+	rest := version
+	if i := strings.LastIndex(rest, "-r"); i >= 0 {
+		v.revision = rest[i+2:]
+		rest = rest[:i]
+		if !isNumeric(v.revision) {
+			return v, false
+		}
+	}
+
+	for {
+		var number string
+		number, rest = spanPrefix(rest, isDigit)
+		if number == "" {
+			return v, false
+		}
+		v.numbers = append(v.numbers, number)
+		if !strings.HasPrefix(rest, ".") {
+			break
+		}
+		rest = rest[1:]
+	}
+
+	if rest != "" && rest[0] >= 'a' && rest[0] <= 'z' {
+		v.letter = rest[0]
+		rest = rest[1:]
+	}
+
+	for strings.HasPrefix(rest, "_") {
+		var name, number string
+		name, rest = spanPrefix(rest[1:], isLetter)
+		rank, ok := apkSuffixRanks[name]
+		if !ok {
+			return v, false
+		}
+		number, rest = spanPrefix(rest, isDigit)
+		v.suffixes = append(v.suffixes, apkSuffix{rank: rank, number: number})
+	}
+
+	return v, rest == ""
+}
+
+// compareApkVersions implements the ordering of apk-tools, falling back to the generic
+// ordering for versions that apk would consider invalid
+func compareApkVersions(a, b string) int {
+	versionA, okA := parseApkVersion(a)
+	versionB, okB := parseApkVersion(b)
+	if !okA || !okB {
+		return compareGenericVersions(a, b)
+	}
+
+	for i := 0; i < len(versionA.numbers) && i < len(versionB.numbers); i++ {
+		if c := compareNumericStrings(versionA.numbers[i], versionB.numbers[i]); c != 0 {
+			return c
+		}
+	}
+	if c := compareInts(len(versionA.numbers), len(versionB.numbers)); c != 0 {
+		return c
+	}
+
+	if c := compareInts(int(versionA.letter), int(versionB.letter)); c != 0 {
+		return c
+	}
+
+	suffixesA, suffixesB := versionA.suffixes, versionB.suffixes
+	for len(suffixesA) > 0 && len(suffixesB) > 0 {
+		if c := compareInts(suffixesA[0].rank, suffixesB[0].rank); c != 0 {
+			return c
+		}
+		if c := compareNumericStrings(suffixesA[0].number, suffixesB[0].number); c != 0 {
+			return c
+		}
+		suffixesA, suffixesB = suffixesA[1:], suffixesB[1:]
+	}
+	// an additional pre-release suffix, such as 1.0_rc1 compared to 1.0, is older
+	if len(suffixesA) > 0 {
+		if suffixesA[0].rank < 0 {
+			return -1
+		}
+		return 1
+	}
+	if len(suffixesB) > 0 {
+		if suffixesB[0].rank < 0 {
+			return 1
+		}
+		return -1
+	}
+
+	return compareNumericStrings(versionA.revision, versionB.revision)
+}
+
+// pep440Pattern matches the permissive forms of PEP 440 versions that are normalized by pip
+var pep440Pattern = regexp.MustCompile(`^v?(?:(\d+)!)?(\d+(?:\.\d+)*)` +
+	`(?:[-_.]?(alpha|a|beta|b|preview|pre|c|rc)[-_.]?(\d+)?)?` +
+	`(?:-(\d+)|[-_.]?(post|rev|r)[-_.]?(\d+)?)?` +
+	`(?:[-_.]?(dev)[-_.]?(\d+)?)?` +
+	`(?:\+([a-z0-9]+(?:[-_.][a-z0-9]+)*))?$`)
+
+// pep440PreReleaseRanks orders the pre-release phases, including their alternate spellings
+var pep440PreReleaseRanks = map[string]int{
+	"a": 1, "alpha": 1,
+	"b": 2, "beta": 2,
+	"rc": 3, "c": 3, "pre": 3, "preview": 3,
+}
+
+type pep440Version struct {
+	epoch   string
+	release []string
+	// preRank is zero for a development release of a final release, which is older than its
+	// pre-releases, and four for a release that isn't a pre-release
+	preRank   int
+	preNumber string
+	hasPost   bool
+	post      string
+	hasDev    bool
+	dev       string
+	local     []string
+}
+
+func parsePep440Version(version string) (pep440Version, bool) {
+	match := pep440Pattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(version)))
+	if match == nil {
+		return pep440Version{}, false
+	}
+
+	v := pep440Version{
+		epoch:     match[1],
+		release:   strings.Split(match[2], "."),
+		preNumber: match[4],
+		hasPost:   match[5] != "" || match[6] != "",
+		post:      match[5] + match[7],
+		hasDev:    match[8] != "",
+		dev:       match[9],
+	}
+	if match[10] != "" {
+		v.local = strings.FieldsFunc(match[10], func(r rune) bool {
+			return r == '-' || r == '_' || r == '.'
+		})
+	}
+	switch {
+	case match[3] != "":
+		v.preRank = pep440PreReleaseRanks[match[3]]
+	case v.hasDev && !v.hasPost:
+		v.preRank = 0
+	default:
+		v.preRank = 4
+	}
+	return v, true
+}
+
+// comparePep440Versions implements the ordering of python package versions, falling back to
+// the generic ordering for versions that don't conform to PEP 440
+func comparePep440Versions(a, b string) int {
+	versionA, okA := parsePep440Version(a)
+	versionB, okB := parsePep440Version(b)
+	if !okA || !okB {
+		return compareGenericVersions(a, b)
+	}
+
+	if c := compareNumericStrings(versionA.epoch, versionB.epoch); c != 0 {
+		return c
+	}
+	// trailing zeros of the release are insignificant, so 1.0 is the same as 1.0.0
+	for i := 0; i < len(versionA.release) || i < len(versionB.release); i++ {
+		var partA, partB string
+		if i < len(versionA.release) {
+			partA = versionA.release[i]
+		}
+		if i < len(versionB.release) {
+			partB = versionB.release[i]
+		}
+		if c := compareNumericStrings(partA, partB); c != 0 {
+			return c
+		}
+	}
+
+	if c := compareInts(versionA.preRank, versionB.preRank); c != 0 {
+		return c
+	}
+	if c := compareNumericStrings(versionA.preNumber, versionB.preNumber); c != 0 {
+		return c
+	}
+	if c := compareBools(versionA.hasPost, versionB.hasPost); c != 0 {
+		return c
+	}
+	if c := compareNumericStrings(versionA.post, versionB.post); c != 0 {
+		return c
+	}
+	// a development release is older than the release it leads to
+	if c := compareBools(!versionA.hasDev, !versionB.hasDev); c != 0 {
+		return c
+	}
+	if c := compareNumericStrings(versionA.dev, versionB.dev); c != 0 {
+		return c
+	}
+	return comparePep440Local(versionA.local, versionB.local)
+}
+
+// comparePep440Local orders the local version labels, where a release with a label is newer
+// than one without and numeric segments are newer than alphanumeric ones
+func comparePep440Local(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		numericA, numericB := isNumeric(a[i]), isNumeric(b[i])
+		var c int
+		switch {
+		case numericA && numericB:
+			c = compareNumericStrings(a[i], b[i])
+		case numericA:
+			c = 1
+		case numericB:
+			c = -1
+		default:
+			c = strings.Compare(a[i], b[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(a), len(b))
+}
+
+var semverPattern = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// compareSemverVersions implements the precedence of semantic versions, as used by npm,
+// falling back to the generic ordering for versions that aren't semantic versions
+func compareSemverVersions(a, b string) int {
+	matchA := semverPattern.FindStringSubmatch(a)
+	matchB := semverPattern.FindStringSubmatch(b)
+	if matchA == nil || matchB == nil {
+		return compareGenericVersions(a, b)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if c := compareNumericStrings(matchA[i], matchB[i]); c != 0 {
+			return c
+		}
+	}
+
+	// a release is newer than its pre-releases and the build metadata is ignored
+	preReleaseA, preReleaseB := matchA[4], matchB[4]
+	switch {
+	case preReleaseA == preReleaseB:
+		return 0
+	case preReleaseA == "":
+		return 1
+	case preReleaseB == "":
+		return -1
+	}
+
+	identifiersA := strings.Split(preReleaseA, ".")
+	identifiersB := strings.Split(preReleaseB, ".")
+	for i := 0; i < len(identifiersA) && i < len(identifiersB); i++ {
+		numericA, numericB := isNumeric(identifiersA[i]), isNumeric(identifiersB[i])
+		var c int
+		switch {
+		case numericA && numericB:
+			c = compareNumericStrings(identifiersA[i], identifiersB[i])
+		case numericA:
+			c = -1
+		case numericB:
+			c = 1
+		default:
+			c = strings.Compare(identifiersA[i], identifiersB[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(identifiersA), len(identifiersB))
+}
+
+// compareGenericVersions is used for packaging systems without their own ordering and
+// compares alternating runs of digits, numerically, and non-digits, lexically
+func compareGenericVersions(a, b string) int {
+	for a != "" && b != "" {
+		var segA, segB string
+		if isDigit(a[0]) && isDigit(b[0]) {
+			segA, a = spanPrefix(a, isDigit)
+			segB, b = spanPrefix(b, isDigit)
+			if c := compareNumericStrings(segA, segB); c != 0 {
+				return c
+			}
+			continue
+		}
+
+		notDigit := func(c byte) bool { return !isDigit(c) }
+		segA, a = spanPrefix(a, notDigit)
+		segB, b = spanPrefix(b, notDigit)
+		if segA == "" || segB == "" {
+			// a number is newer than text, such as 1.0.1 compared to 1.0-beta
+			if segA == "" {
+				return 1
+			}
+			return -1
+		}
+		if c := strings.Compare(segA, segB); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(a), len(b))
+}
+
+func spanPrefix(s string, accept func(byte) bool) (string, string) {
+	i := 0
+	for i < len(s) && accept(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// compareNumericStrings compares arbitrarily long runs of digits without overflowing
+func compareNumericStrings(a, b string) int {
+	a = strings.TrimLeft(a, "0")
+	b = strings.TrimLeft(b, "0")
+	if c := compareInts(len(a), len(b)); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+// compareBools orders false before true
+func compareBools(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
+
+func isNumeric(s string) bool {
+	return s != "" && strings.TrimLeft(s, "0123456789") == ""
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || isLetter(c)
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type versionComparison struct {
+	a, b     string
+	expected int
+}
+
+func assertVersionComparisons(t *testing.T, system string, comparisons []versionComparison) {
+	for _, c := range comparisons {
+		assert.Equal(t, c.expected, CompareVersions(system, c.a, c.b), "%s compared to %s", c.a, c.b)
+		// and the comparison is symmetric
+		assert.Equal(t, -c.expected, CompareVersions(system, c.b, c.a), "%s compared to %s", c.b, c.a)
+	}
+}
+
+func TestCompareVersions_dpkg(t *testing.T) {
+	assertVersionComparisons(t, "debian", []versionComparison{
+		{"1.0", "1.0", 0},
+		{"1.0-1", "1.0-2", -1},
+		{"1:1.0", "2.0", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1-1", "1.0~rc2-1", -1},
+		{"1.0", "1.0+b1", -1},
+		{"1.10", "1.9", 1},
+		{"2.28-10+deb10u1", "2.28-10", 1},
+		{"1.0a", "1.0", 1},
+		{"1.0-1ubuntu1", "1.0-1", 1},
+		{"007", "7", 0},
+	})
+}
+
+func TestCompareVersions_rpm(t *testing.T) {
+	assertVersionComparisons(t, "rpm", []versionComparison{
+		{"1.0-1.el8", "1.0-1.el8", 0},
+		{"1.0-1.el8", "1.0-2.el8", -1},
+		{"1:1.12.8-7.el8", "1.12.9-1.el8", 1},
+		{"2.8-6.el8", "2.10-1.el8", -1},
+		{"1.0~rc1-1", "1.0-1", -1},
+		{"1.0^git1-1", "1.0-1", 1},
+		{"1.0^git1-1", "1.0.1-1", -1},
+		{"1.0a-1", "1.0.1-1", -1},
+		{"5.4.17-2136.el8", "5.4.17-2102.el8", 1},
+	})
+}
+
+func TestCompareVersions_apk(t *testing.T) {
+	assertVersionComparisons(t, "apk", []versionComparison{
+		{"1.1.24-r0", "1.1.24-r0", 0},
+		{"1.1.24-r0", "1.1.24-r2", -1},
+		{"1.1.24-r10", "1.1.24-r9", 1},
+		{"1.1.22-r3", "1.1.24-r0", -1},
+		{"1.2_rc1-r0", "1.2-r0", -1},
+		{"1.2_alpha2", "1.2_beta1", -1},
+		{"1.2_p1", "1.2", 1},
+		{"1.2_p1", "1.2.1", -1},
+		{"1.2a", "1.2", 1},
+		{"1.2a", "1.2b", -1},
+		{"1.2", "1.2.0", -1},
+		{"2.12.1_git20190226-r0", "2.12.1-r0", 1},
+		{"3.0.7-r2", "3.0.10-r0", -1},
+	})
+}
+
+func TestCompareVersions_pep440(t *testing.T) {
+	assertVersionComparisons(t, "python", []versionComparison{
+		{"1.16.0", "1.16.0", 0},
+		{"1.0", "1.0.0", 0},
+		{"5.3.1", "5.4", -1},
+		{"1.26.4", "1.26.10", -1},
+		{"1.0.dev1", "1.0a1", -1},
+		{"1.0a1", "1.0a2", -1},
+		{"1.0a2", "1.0b1", -1},
+		{"1.0b1", "1.0rc1", -1},
+		{"1.0rc1", "1.0", -1},
+		{"1.0", "1.0.post1", -1},
+		{"1.0.post1.dev1", "1.0.post1", -1},
+		{"1.0.post1", "1.1.dev0", -1},
+		{"1.0", "1.0+ubuntu1", -1},
+		{"1.0+ubuntu1", "1.0+ubuntu2", -1},
+		{"1.0+abc", "1.0+5", -1},
+		{"1!0.5", "2.0", 1},
+		{"1.0-1", "1.0.post1", 0},
+		{"1.0RC1", "1.0c1", 0},
+		{"v2.0", "2.0", 0},
+	})
+}
+
+func TestCompareVersions_semver(t *testing.T) {
+	assertVersionComparisons(t, "npm", []versionComparison{
+		{"4.3.4", "4.3.4", 0},
+		{"4.3.4", "4.10.0", -1},
+		{"1.0.0-alpha", "1.0.0", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0+build.1", "1.0.0", 0},
+		{"2.6.8", "2.6.9", -1},
+	})
+}
+
+func TestCompareVersions_generic(t *testing.T) {
+	assertVersionComparisons(t, "snap", []versionComparison{
+		{"4.3.4", "4.3.4", 0},
+		{"4.3.4", "4.10.0", -1},
+		{"1.0.1", "1.0-beta", 1},
+		{"20230801", "20230615", 1},
+	})
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// WatchPathsProvider is optionally implemented by a SoftwarePackageLister to declare the
+// files or directories of its package database, which change when packages are installed or
+// removed. A change within a declared directory, or to a declared file, triggers a collection.
+type WatchPathsProvider interface {
+	WatchPaths() []string
+}
+
+// listingState is shared by the collections of a config and the watcher of its package
+// databases, since the package manager tools can change their own database while being
+// queried, such as rpm checkpointing its sqlite write-ahead log, which would otherwise
+// schedule another collection after each one
+type listingState struct {
+	mu     sync.Mutex
+	active bool
+}
+
+func (l *listingState) set(active bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active = active
+}
+
+func (l *listingState) isActive() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active
+}
+
+// databaseWatcher uses inotify, via fsnotify, to notice changes to the package databases of
+// its listers. Package managers commonly replace their database files by renaming a new
+// file over the old one, so files are watched through their parent directory.
+type databaseWatcher struct {
+	watcher  *fsnotify.Watcher
+	dirs     map[string]bool
+	files    map[string]bool
+	debounce time.Duration
+	// listing, when not nil, indicates the agent's own listing, whose changes are ignored
+	listing *listingState
+	logger  *zap.Logger
+}
+
+// newDatabaseWatcher watches the paths declared by the given listers, where the returned
+// watcher is nil when none of the listers declare paths that exist
+func newDatabaseWatcher(listers []SoftwarePackageLister, debounce time.Duration, listing *listingState, logger *zap.Logger) (*databaseWatcher, error) {
+	d := &databaseWatcher{
+		dirs:     make(map[string]bool),
+		files:    make(map[string]bool),
+		debounce: debounce,
+		listing:  listing,
+		logger:   logger,
+	}
+
+	watchDirs := make(map[string]bool)
+	for _, lister := range listers {
+		provider, ok := lister.(WatchPathsProvider)
+		if !ok {
+			continue
+		}
+		for _, path := range provider.WatchPaths() {
+			if isDir(path) {
+				d.dirs[path] = true
+				watchDirs[path] = true
+			} else if isDir(filepath.Dir(path)) {
+				// files that don't exist yet, such as a write-ahead log, are still noticed
+				// when created since their directory is watched
+				d.files[path] = true
+				watchDirs[filepath.Dir(path)] = true
+			} else {
+				logger.Debug("skipping watch of missing path", zap.String("path", path))
+			}
+		}
+	}
+	if len(watchDirs) == 0 {
+		return nil, nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create package database watcher: %w", err)
+	}
+	for dir := range watchDirs {
+		logger.Debug("watching package database", zap.String("path", dir))
+		err = watcher.Add(dir)
+		if err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+	}
+	d.watcher = watcher
+
+	return d, nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// matches determines if the event is a change to a watched file or within a watched directory
+func (d *databaseWatcher) matches(event fsnotify.Event) bool {
+	// the agent's own reading doesn't cause events, but permission changes aren't interesting
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	return d.files[event.Name] || d.dirs[filepath.Dir(event.Name)]
+}
+
+// run sends to trigger once the watched paths have stopped changing for the debounce
+// duration, since a single package transaction changes the database many times. The
+// watcher is closed when the context is done.
+func (d *databaseWatcher) run(ctx context.Context, trigger chan<- struct{}) {
+	defer d.watcher.Close()
+
+	debounceTimer := time.NewTimer(d.debounce)
+	debounceTimer.Stop()
+	defer debounceTimer.Stop()
+
+	for {
+		select {
+		case event, ok := <-d.watcher.Events:
+			if !ok {
+				return
+			}
+			if !d.matches(event) {
+				continue
+			}
+			if d.listing.isActive() {
+				d.logger.Debug("ignoring package database change during listing", zap.Stringer("event", event))
+				continue
+			}
+			d.logger.Debug("package database changed", zap.Stringer("event", event))
+			debounceTimer.Reset(d.debounce)
+		case err, ok := <-d.watcher.Errors:
+			if !ok {
+				return
+			}
+			d.logger.Warn("error while watching package databases", zap.Error(err))
+		case <-debounceTimer.C:
+			select {
+			case trigger <- struct{}{}:
+			default:
+				// a collection is already pending
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchPackageDatabases starts watching the package databases of the listers and returns the
+// channel that is sent to after they change, other than while the listing, if given, is
+// active. The returned channel is nil, and so never receives, when none of the databases can
+// be watched.
+func watchPackageDatabases(ctx context.Context, listers []SoftwarePackageLister, debounce time.Duration, listing *listingState, logger *zap.Logger) <-chan struct{} {
+	watcher, err := newDatabaseWatcher(listers, debounce, listing, logger)
+	if err != nil {
+		logger.Warn("unable to watch package databases, relying on the interval", zap.Error(err))
+		return nil
+	}
+	if watcher == nil {
+		logger.Debug("none of the package databases can be watched")
+		return nil
+	}
+
+	// the buffer holds a pending trigger while a collection is in progress
+	trigger := make(chan struct{}, 1)
+	go watcher.run(ctx, trigger)
+	return trigger
+}
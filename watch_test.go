@@ -0,0 +1,238 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package packagesagent
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type watchingPackageLister struct {
+	mockPackageLister
+	watchPaths []string
+}
+
+func (w *watchingPackageLister) WatchPaths() []string {
+	return w.watchPaths
+}
+
+func TestDatabaseWatcher_debounced(t *testing.T) {
+	dir := t.TempDir()
+	statusPath := filepath.Join(dir, "status")
+	require.NoError(t, ioutil.WriteFile(statusPath, []byte("Package: dpkg\n"), 0644))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	trigger := watchPackageDatabases(ctx, []SoftwarePackageLister{
+		&watchingPackageLister{watchPaths: []string{statusPath}},
+	}, 100*time.Millisecond, nil, zap.NewNop())
+	require.NotNil(t, trigger)
+
+	// dpkg writes a new file and renames it over the status file
+	for i := 0; i < 3; i++ {
+		newPath := filepath.Join(dir, "status-new")
+		require.NoError(t, ioutil.WriteFile(newPath, []byte("Package: apt\n"), 0644))
+		require.NoError(t, os.Rename(newPath, statusPath))
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	select {
+	case <-trigger:
+	case <-time.After(2 * time.Second):
+		t.Fatal("change to status file did not trigger")
+	}
+
+	select {
+	case <-trigger:
+		t.Fatal("the changes should have been debounced into one trigger")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestDatabaseWatcher_ignoresOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	statusPath := filepath.Join(dir, "status")
+	require.NoError(t, ioutil.WriteFile(statusPath, []byte("Package: dpkg\n"), 0644))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	trigger := watchPackageDatabases(ctx, []SoftwarePackageLister{
+		&watchingPackageLister{watchPaths: []string{statusPath}},
+	}, 10*time.Millisecond, nil, zap.NewNop())
+	require.NotNil(t, trigger)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "lock"), nil, 0644))
+
+	select {
+	case <-trigger:
+		t.Fatal("change to other file should not trigger")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestDatabaseWatcher_directory(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "local")
+	require.NoError(t, os.Mkdir(localPath, 0755))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	trigger := watchPackageDatabases(ctx, []SoftwarePackageLister{
+		&watchingPackageLister{watchPaths: []string{localPath}},
+	}, 10*time.Millisecond, nil, zap.NewNop())
+	require.NotNil(t, trigger)
+
+	require.NoError(t, os.Mkdir(filepath.Join(localPath, "pacman-5.2.2-1"), 0755))
+
+	select {
+	case <-trigger:
+	case <-time.After(2 * time.Second):
+		t.Fatal("new entry in directory did not trigger")
+	}
+}
+
+func TestDatabaseWatcher_nothingToWatch(t *testing.T) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	lister := &mockPackageLister{}
+	trigger := watchPackageDatabases(ctx, []SoftwarePackageLister{
+		lister,
+		&watchingPackageLister{watchPaths: []string{"/does/not/exist/status"}},
+	}, 10*time.Millisecond, nil, zap.NewNop())
+	assert.Nil(t, trigger)
+}
+
+func TestDebianLister_WatchPaths(t *testing.T) {
+	lister := DebianLister("/mnt/host", zap.NewNop())
+
+	provider, ok := lister.(WatchPathsProvider)
+	require.True(t, ok)
+	assert.Equal(t, []string{"/mnt/host/var/lib/dpkg/status", "/mnt/host/var/lib/dpkg/status-old"},
+		provider.WatchPaths())
+}
+
+func TestCollectWithConfigs_watch(t *testing.T) {
+	dir := t.TempDir()
+	statusPath := filepath.Join(dir, "status")
+	require.NoError(t, ioutil.WriteFile(statusPath, []byte("Package: dpkg\n"), 0644))
+
+	lister := &watchingPackageLister{watchPaths: []string{statusPath}}
+	lister.On("PackagingSystem").Return("mock1")
+	lister.On("IsSupported").Return(true)
+	lister.On("ListPackages").Return([]SoftwarePackage{{Name: "dpkg", Version: "1.19.7"}}, nil)
+	listersFromConfig = func(config *Config, logger *zap.Logger) []SoftwarePackageLister {
+		return []SoftwarePackageLister{lister}
+	}
+	initialCollectionDelay = 1 * time.Millisecond
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	collected := make(chan struct{}, 2)
+	batch := &mockReporterBatch{}
+	batch.On("ReportSuccess", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		collected <- struct{}{}
+	})
+	batch.On("ReportOsInfo", mock.Anything)
+	batch.On("Close").Return(nil)
+	reporter := &mockReporter{}
+	reporter.On("StartBatch", mock.Anything, mock.Anything).Return(batch)
+
+	CollectWithConfigs(ctx, []*Config{{
+		Interval:      Interval(1 * time.Hour),
+		ReportMode:    ReportFull,
+		Watch:         true,
+		WatchDebounce: Interval(10 * time.Millisecond),
+	}}, reporter, nil, zap.NewNop())
+
+	select {
+	case <-collected:
+	case <-time.After(1 * time.Second):
+		t.Fatal("initial collection did not happen")
+	}
+
+	require.NoError(t, ioutil.WriteFile(statusPath, []byte("Package: apt\n"), 0644))
+
+	select {
+	case <-collected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("change to status file did not trigger a collection")
+	}
+}
+
+func TestCollectWithConfigs_watchIgnoresOwnListing(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "rpmdb.sqlite")
+	require.NoError(t, ioutil.WriteFile(dbPath, []byte("v1"), 0644))
+
+	lister := &watchingPackageLister{watchPaths: []string{dbPath}}
+	lister.On("PackagingSystem").Return("mock1")
+	lister.On("IsSupported").Return(true)
+	// such as rpm checkpointing its write-ahead log when queried
+	lister.On("ListPackages").Run(func(mock.Arguments) {
+		require.NoError(t, ioutil.WriteFile(dbPath, []byte("v1"), 0644))
+		// allows for the watcher to receive the event while the listing is still active
+		time.Sleep(20 * time.Millisecond)
+	}).Return([]SoftwarePackage{{Name: "bash", Version: "4.4.19-10.el8"}}, nil)
+	listersFromConfig = func(config *Config, logger *zap.Logger) []SoftwarePackageLister {
+		return []SoftwarePackageLister{lister}
+	}
+	initialCollectionDelay = 1 * time.Millisecond
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	collected := make(chan struct{}, 2)
+	batch := &mockReporterBatch{}
+	batch.On("ReportSuccess", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		collected <- struct{}{}
+	})
+	batch.On("ReportOsInfo", mock.Anything)
+	batch.On("Close").Return(nil)
+	reporter := &mockReporter{}
+	reporter.On("StartBatch", mock.Anything, mock.Anything).Return(batch)
+
+	CollectWithConfigs(ctx, []*Config{{
+		Interval:      Interval(1 * time.Hour),
+		ReportMode:    ReportFull,
+		Watch:         true,
+		WatchDebounce: Interval(10 * time.Millisecond),
+	}}, reporter, nil, zap.NewNop())
+
+	select {
+	case <-collected:
+	case <-time.After(1 * time.Second):
+		t.Fatal("initial collection did not happen")
+	}
+
+	select {
+	case <-collected:
+		t.Fatal("the collection's own change to the database should not trigger another")
+	case <-time.After(300 * time.Millisecond):
+	}
+}